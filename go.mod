@@ -8,7 +8,6 @@ require (
 	github.com/BertoldVdb/logrus-prefixed-formatter v0.5.4
 	github.com/google/uuid v1.6.0
 	github.com/miekg/dns v1.1.62
-	github.com/sigurn/crc8 v0.0.0-20220107193325-2243fe600f9f
 	github.com/sirupsen/logrus v1.9.3
 	golang.org/x/crypto v0.29.0
 	golang.org/x/sys v0.27.0
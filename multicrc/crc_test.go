@@ -32,3 +32,19 @@ func TestCRCs(t *testing.T) {
 		t.Error("Little endian result is wrong")
 	}
 }
+
+func TestParamsByName(t *testing.T) {
+	for _, params := range PredefinedParams() {
+		found, ok := ParamsByName(params.Name)
+		if !ok || found != params {
+			t.Error("Could not find", params.Name)
+		}
+	}
+
+	if found, _ := ParamsByName("crc16ccittfalse"); found != Crc16CCITTFALSE {
+		t.Error("Variable name was not accepted")
+	}
+	if _, ok := ParamsByName("Crc99"); ok {
+		t.Error("Unknown CRC was found")
+	}
+}
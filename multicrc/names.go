@@ -0,0 +1,35 @@
+package multicrc
+
+import "strings"
+
+var predefinedParams = []*Params{
+	CrcNone, Crc16A, Crc16ARC, Crc16AUGCCITT, Crc16BUYPASS, Crc16CCITTFALSE, Crc16CCITZERO,
+	Crc16CDMA2000, Crc16DDS110, Crc16DECTR, Crc16DECTX, Crc16DNP, Crc16EN13757, Crc16GENIBUS,
+	Crc16KERMIT, Crc16MAXIM, Crc16MCRF4XX, Crc16MODBUS, Crc16RIELLO, Crc16T10DIF, Crc16TELEDISK,
+	Crc16TMS37157, Crc16USB, Crc16X25, Crc16XMODEM, Crc32BZIP2, Crc32C, Crc32D, Crc32, Crc32JAMCRC,
+	Crc32MPEG2, Crc32POSIX, Crc32Q, Crc32XFER, Crc88H2F, Crc8CDMA2000, Crc8DARC, Crc8DVBS2, Crc8EBU,
+	Crc8, Crc8ICODE, Crc8ITU, Crc8MAXIM, Crc8ROHC, Crc8SAEJ1850, Crc8SAEJ1850ZERO, Crc8WCDMA,
+}
+
+func normalizeName(name string) string {
+	return strings.ToLower(strings.ReplaceAll(name, "_", ""))
+}
+
+// ParamsByName returns the predefined CRC with the given name. Both the variable name (eg, Crc16CCITTFALSE)
+// and Params.Name (eg, Crc16CCITT_FALSE) are accepted, the comparison is case insensitive
+func ParamsByName(name string) (*Params, bool) {
+	name = normalizeName(name)
+
+	for _, params := range predefinedParams {
+		if normalizeName(params.Name) == name {
+			return params, true
+		}
+	}
+
+	return nil, false
+}
+
+// PredefinedParams returns all predefined CRCs
+func PredefinedParams() []*Params {
+	return append([]*Params(nil), predefinedParams...)
+}
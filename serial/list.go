@@ -0,0 +1,186 @@
+package serial
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PortInfo describes a serial port found by List
+type PortInfo struct {
+	// Name is the device path that can be used as PortName, eg. /dev/ttyUSB0
+	Name string
+
+	// Driver is the name of the kernel driver, eg. ftdi_sio or cdc_acm
+	Driver string
+
+	// USB contains information about the USB adapter, it is nil for other ports
+	USB *USBInfo
+}
+
+// USBInfo contains the attributes of a USB serial adapter
+type USBInfo struct {
+	VID             uint16
+	PID             uint16
+	SerialNumber    string
+	Manufacturer    string
+	Product         string
+	InterfaceNumber int
+}
+
+// PortMatch selects a port by its attributes instead of by path. Empty fields match every port.
+type PortMatch struct {
+	Driver string
+
+	/* These fields only match USB ports */
+	VID             uint16
+	PID             uint16
+	SerialNumber    string
+	Manufacturer    string
+	Product         string
+	InterfaceNumber *int
+}
+
+var (
+	ErrorNoPort        = errors.New("no matching port found")
+	ErrorMultiplePorts = errors.New("multiple ports match")
+)
+
+const (
+	sysfsTTY = "/sys/class/tty"
+	devDir   = "/dev"
+)
+
+// List returns the serial ports present in the system, sorted by name. Only ports backed by a
+// device are returned, virtual terminals are skipped.
+func List() ([]PortInfo, error) {
+	return listPorts(sysfsTTY, devDir)
+}
+
+func readAttribute(dir string, name string) (string, bool) {
+	buf, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return "", false
+	}
+	return strings.TrimSpace(string(buf)), true
+}
+
+func readHexAttribute(dir string, name string) (uint64, bool) {
+	value, ok := readAttribute(dir, name)
+	if !ok {
+		return 0, false
+	}
+
+	result, err := strconv.ParseUint(value, 16, 16)
+	return result, err == nil
+}
+
+/* usbInfo walks up from the device directory to the USB device, collecting the interface number on the way */
+func usbInfo(device string) *USBInfo {
+	info := &USBInfo{InterfaceNumber: -1}
+
+	for dir := device; ; dir = filepath.Dir(dir) {
+		if info.InterfaceNumber < 0 {
+			if value, ok := readHexAttribute(dir, "bInterfaceNumber"); ok {
+				info.InterfaceNumber = int(value)
+			}
+		}
+
+		if vid, ok := readHexAttribute(dir, "idVendor"); ok {
+			pid, _ := readHexAttribute(dir, "idProduct")
+			info.VID = uint16(vid)
+			info.PID = uint16(pid)
+			info.SerialNumber, _ = readAttribute(dir, "serial")
+			info.Manufacturer, _ = readAttribute(dir, "manufacturer")
+			info.Product, _ = readAttribute(dir, "product")
+			return info
+		}
+
+		if parent := filepath.Dir(dir); parent == dir {
+			return nil
+		}
+	}
+}
+
+func listPorts(sysfs string, dev string) ([]PortInfo, error) {
+	entries, err := os.ReadDir(sysfs)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []PortInfo
+	for _, entry := range entries {
+		device, err := filepath.EvalSymlinks(filepath.Join(sysfs, entry.Name(), "device"))
+		if err != nil {
+			continue
+		}
+
+		info := PortInfo{
+			Name: filepath.Join(dev, entry.Name()),
+			USB:  usbInfo(device),
+		}
+
+		if driver, err := filepath.EvalSymlinks(filepath.Join(device, "driver")); err == nil {
+			info.Driver = filepath.Base(driver)
+		}
+
+		result = append(result, info)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+
+	return result, nil
+}
+
+// Matches returns true if the port has the requested attributes
+func (m *PortMatch) Matches(info *PortInfo) bool {
+	if m.Driver != "" && m.Driver != info.Driver {
+		return false
+	}
+
+	usb := m.VID != 0 || m.PID != 0 || m.SerialNumber != "" || m.Manufacturer != "" || m.Product != "" || m.InterfaceNumber != nil
+	if !usb {
+		return true
+	}
+
+	u := info.USB
+	return u != nil &&
+		(m.VID == 0 || m.VID == u.VID) &&
+		(m.PID == 0 || m.PID == u.PID) &&
+		(m.SerialNumber == "" || m.SerialNumber == u.SerialNumber) &&
+		(m.Manufacturer == "" || m.Manufacturer == u.Manufacturer) &&
+		(m.Product == "" || m.Product == u.Product) &&
+		(m.InterfaceNumber == nil || *m.InterfaceNumber == u.InterfaceNumber)
+}
+
+/* find returns the only port in ports that matches */
+func (m *PortMatch) find(ports []PortInfo) (string, error) {
+	name := ""
+	for i := range ports {
+		if m.Matches(&ports[i]) {
+			if name != "" {
+				return "", ErrorMultiplePorts
+			}
+			name = ports[i].Name
+		}
+	}
+
+	if name == "" {
+		return "", ErrorNoPort
+	}
+	return name, nil
+}
+
+// Find returns the path of the only port that matches
+func (m *PortMatch) Find() (string, error) {
+	ports, err := List()
+	if err != nil {
+		return "", err
+	}
+	return m.find(ports)
+}
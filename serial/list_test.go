@@ -0,0 +1,104 @@
+package serial
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+/* createSysfs creates a fake sysfs tree with an FTDI adapter, a CDC ACM device with two ports, an on-board
+ * UART and a virtual terminal */
+func createSysfs(t *testing.T) string {
+	root := t.TempDir()
+
+	mkdir := func(path string) {
+		if err := os.MkdirAll(filepath.Join(root, path), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write := func(path string, value string) {
+		if err := os.WriteFile(filepath.Join(root, path), []byte(value+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	link := func(path string, target string) {
+		if err := os.Symlink(filepath.Join(root, target), filepath.Join(root, path)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, m := range []string{"ftdi_sio", "cdc_acm", "serial8250"} {
+		mkdir("bus/drivers/" + m)
+	}
+
+	usb := "devices/pci0000:00/usb1/"
+	mkdir(usb + "1-1/1-1:1.0/ttyUSB0")
+	write(usb+"1-1/idVendor", "0403")
+	write(usb+"1-1/idProduct", "6001")
+	write(usb+"1-1/serial", "A12345")
+	write(usb+"1-1/manufacturer", "FTDI")
+	write(usb+"1-1/product", "FT232R USB UART")
+	write(usb+"1-1/1-1:1.0/bInterfaceNumber", "00")
+	link(usb+"1-1/1-1:1.0/ttyUSB0/driver", "bus/drivers/ftdi_sio")
+
+	for _, m := range []string{"0", "2"} {
+		mkdir(usb + "1-2/1-2:1." + m)
+		write(usb+"1-2/1-2:1."+m+"/bInterfaceNumber", "0"+m)
+		link(usb+"1-2/1-2:1."+m+"/driver", "bus/drivers/cdc_acm")
+	}
+	write(usb+"1-2/idVendor", "2341")
+	write(usb+"1-2/idProduct", "8036")
+	write(usb+"1-2/product", "Leonardo")
+
+	mkdir("devices/platform/serial8250")
+	link("devices/platform/serial8250/driver", "bus/drivers/serial8250")
+
+	for _, m := range []string{"ttyUSB0", "ttyACM0", "ttyACM1", "ttyS0", "tty0"} {
+		mkdir("class/tty/" + m)
+	}
+	link("class/tty/ttyUSB0/device", usb+"1-1/1-1:1.0/ttyUSB0")
+	link("class/tty/ttyACM0/device", usb+"1-2/1-2:1.0")
+	link("class/tty/ttyACM1/device", usb+"1-2/1-2:1.2")
+	link("class/tty/ttyS0/device", "devices/platform/serial8250")
+
+	return filepath.Join(root, "class/tty")
+}
+
+func TestList(t *testing.T) {
+	ports, err := listPorts(createSysfs(t), "/dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []PortInfo{
+		{Name: "/dev/ttyACM0", Driver: "cdc_acm", USB: &USBInfo{VID: 0x2341, PID: 0x8036, Product: "Leonardo", InterfaceNumber: 0}},
+		{Name: "/dev/ttyACM1", Driver: "cdc_acm", USB: &USBInfo{VID: 0x2341, PID: 0x8036, Product: "Leonardo", InterfaceNumber: 2}},
+		{Name: "/dev/ttyS0", Driver: "serial8250"},
+		{Name: "/dev/ttyUSB0", Driver: "ftdi_sio", USB: &USBInfo{VID: 0x0403, PID: 0x6001, SerialNumber: "A12345",
+			Manufacturer: "FTDI", Product: "FT232R USB UART", InterfaceNumber: 0}},
+	}
+
+	if !reflect.DeepEqual(ports, expected) {
+		t.Fatal("Wrong ports", ports)
+	}
+
+	intf := 2
+	tests := []struct {
+		match    PortMatch
+		expected string
+		err      error
+	}{
+		{PortMatch{SerialNumber: "A12345"}, "/dev/ttyUSB0", nil},
+		{PortMatch{Driver: "serial8250"}, "/dev/ttyS0", nil},
+		{PortMatch{VID: 0x2341, InterfaceNumber: &intf}, "/dev/ttyACM1", nil},
+		{PortMatch{VID: 0x2341}, "", ErrorMultiplePorts},
+		{PortMatch{VID: 0x2341, PID: 0x6001}, "", ErrorNoPort},
+	}
+
+	for _, m := range tests {
+		if name, err := m.match.find(ports); name != m.expected || err != m.err {
+			t.Error("Wrong match", m.match, name, err)
+		}
+	}
+}
@@ -0,0 +1,575 @@
+package serial
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ErrorDisconnected is returned by a ReconnectingPort while the device is not present. Unlike ErrorClosed
+// it is transient, the call can be retried after the port was reopened. Read and Write first wait up to
+// RetryInterval for the device, so a loop that retries them does not spin.
+var ErrorDisconnected = errors.New("port is disconnected")
+
+// PortEventType describes a change in the connection of a ReconnectingPort
+type PortEventType int
+
+const (
+	// PortConnected is emitted when the device was (re)opened
+	PortConnected PortEventType = 0
+
+	// PortDisconnected is emitted when the device was removed or failed
+	PortDisconnected PortEventType = 1
+)
+
+func (e PortEventType) String() string {
+	switch e {
+	case PortConnected:
+		return "Connected"
+	case PortDisconnected:
+		return "Disconnected"
+	}
+	return "Unknown"
+}
+
+// PortEvent is passed to the event handler of a ReconnectingPort
+type PortEvent struct {
+	Type PortEventType
+
+	// PortName is the path of the device that was opened or lost
+	PortName string
+
+	// Error is the reason of the disconnection, only set for PortDisconnected
+	Error error
+}
+
+// ReconnectConfig contains the parameters of a ReconnectingPort. Zero values are replaced by the defaults.
+type ReconnectConfig struct {
+	// RetryInterval is the time between open attempts, it is also the interval used to check if the
+	// device is still present. Default: 1s
+	RetryInterval time.Duration
+
+	// OnEvent is called when the port is connected or disconnected. Calls are not concurrent.
+	OnEvent func(event PortEvent)
+}
+
+// DefaultReconnectConfig returns the default reconnect configuration
+func DefaultReconnectConfig() *ReconnectConfig {
+	return &ReconnectConfig{
+		RetryInterval: time.Second,
+	}
+}
+
+func (c *ReconnectConfig) withDefaults() ReconnectConfig {
+	def := DefaultReconnectConfig()
+	if c == nil {
+		return *def
+	}
+
+	result := *c
+	if result.RetryInterval <= 0 {
+		result.RetryInterval = def.RetryInterval
+	}
+
+	return result
+}
+
+// ReconnectingPort implements Port and reopens the device after it was removed, eg. when a USB adapter is
+// unplugged. All settings, pin states and deadlines are applied again after reopening.
+type ReconnectingPort struct {
+	config ReconnectConfig
+
+	/* Protects everything below */
+	mtx sync.Mutex
+
+	options  PortOptions
+	dtr      *bool
+	rts      *bool
+	deadline [2]time.Time
+
+	/* deadlineChanged is closed and replaced when a deadline is set, to wake up waiting calls */
+	deadlineChanged chan (struct{})
+
+	port      Port
+	portName  string
+	connected chan (struct{})
+	lost      chan (error)
+	closed    bool
+	closeChan chan (struct{})
+	done      chan (struct{})
+}
+
+// OpenReconnecting creates a port that keeps trying to open the device described by options. It returns
+// immediately, WaitConnected can be used to wait for the device. When options.PortName refers to a USB
+// adapter with a serial number the port is later reopened by its attributes, so it can get a new path.
+func OpenReconnecting(options *PortOptions, config *ReconnectConfig) *ReconnectingPort {
+	r := &ReconnectingPort{
+		config:    config.withDefaults(),
+		options:   *options,
+		connected: make(chan (struct{})),
+		lost:      make(chan (error), 1),
+		closeChan: make(chan (struct{})),
+		done:      make(chan (struct{})),
+
+		deadlineChanged: make(chan (struct{})),
+	}
+
+	go r.run()
+
+	return r
+}
+
+/* identify returns the attributes of the device that can replace its path, nil if they are not unique enough */
+func identify(name string) *PortMatch {
+	ports, err := List()
+	if err != nil {
+		return nil
+	}
+
+	target, err := filepath.EvalSymlinks(name)
+	if err != nil {
+		return nil
+	}
+
+	for _, m := range ports {
+		if m.Name != target || m.USB == nil || m.USB.SerialNumber == "" {
+			continue
+		}
+
+		intf := m.USB.InterfaceNumber
+		return &PortMatch{
+			VID:             m.USB.VID,
+			PID:             m.USB.PID,
+			SerialNumber:    m.USB.SerialNumber,
+			InterfaceNumber: &intf,
+		}
+	}
+
+	return nil
+}
+
+func (r *ReconnectingPort) emit(event PortEvent) {
+	if r.config.OnEvent != nil {
+		r.config.OnEvent(event)
+	}
+}
+
+/* open returns the opened port and the options that were used, with the path of the device filled in */
+func (r *ReconnectingPort) open() (Port, PortOptions, error) {
+	r.mtx.Lock()
+	options := r.options
+	r.mtx.Unlock()
+
+	if options.PortName == "" && options.Match != nil {
+		name, err := options.Match.Find()
+		if err != nil {
+			return nil, options, err
+		}
+		options.PortName = name
+	}
+
+	port, err := Open(&options)
+	return port, options, err
+}
+
+/* connect opens the device and applies the state that can't be passed to Open */
+func (r *ReconnectingPort) connect() error {
+	port, options, err := r.open()
+	if err != nil {
+		return err
+	}
+	name := options.PortName
+
+	/* Listing the ports walks sysfs, so it is done before taking the lock */
+	var match *PortMatch
+	if options.Match == nil {
+		match = identify(name)
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	err = r.restore(port)
+	if err == nil && r.closed {
+		err = ErrorClosed
+	}
+	if err != nil {
+		port.Close()
+		return err
+	}
+
+	if r.options.Match == nil && match != nil {
+		r.options.Match = match
+		r.options.PortName = ""
+	}
+
+	r.port = port
+	r.portName = name
+	close(r.connected)
+
+	return nil
+}
+
+/* restore must be called with the lock held */
+func (r *ReconnectingPort) restore(port Port) error {
+	if r.dtr != nil {
+		if err := port.SetDTR(*r.dtr); err != nil {
+			return err
+		}
+	}
+	/* In RS-485 mode RTS is controlled by the port, restoring it would override its idle level */
+	if r.rts != nil && (r.options.RS485 == nil || !r.options.RS485.Enabled) {
+		if err := port.SetRTS(*r.rts); err != nil {
+			return err
+		}
+	}
+	if err := port.SetReadDeadline(r.deadline[0]); err != nil {
+		return err
+	}
+	return port.SetWriteDeadline(r.deadline[1])
+}
+
+func (r *ReconnectingPort) disconnect() (Port, string) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	port := r.port
+	r.port = nil
+	r.connected = make(chan (struct{}))
+
+	return port, r.portName
+}
+
+func (r *ReconnectingPort) run() {
+	defer close(r.done)
+
+	for {
+		for r.connect() != nil {
+			select {
+			case <-time.After(r.config.RetryInterval):
+			case <-r.closeChan:
+				return
+			}
+		}
+
+		r.mtx.Lock()
+		name := r.portName
+		r.mtx.Unlock()
+		r.emit(PortEvent{Type: PortConnected, PortName: name})
+
+		/* A removed device is noticed by a failing call, or by its path disappearing when the port is idle */
+		var err error
+		for err == nil {
+			select {
+			case err = <-r.lost:
+			case <-time.After(r.config.RetryInterval):
+				_, err = os.Stat(name)
+			case <-r.closeChan:
+				return
+			}
+		}
+
+		port, name := r.disconnect()
+		port.Close()
+		r.emit(PortEvent{Type: PortDisconnected, PortName: name, Error: err})
+
+		/* Drop errors of calls that were still using the old port */
+		select {
+		case <-r.lost:
+		default:
+		}
+	}
+}
+
+// WaitConnected waits until the device is open
+func (r *ReconnectingPort) WaitConnected(ctx context.Context) error {
+	r.mtx.Lock()
+	closed := r.closed
+	port := r.port
+	connected := r.connected
+	r.mtx.Unlock()
+
+	if closed {
+		return ErrorClosed
+	}
+	if port != nil {
+		return nil
+	}
+
+	select {
+	case <-connected:
+		return nil
+	case <-r.closeChan:
+		return ErrorClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r *ReconnectingPort) current() (Port, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if r.closed {
+		return nil, ErrorClosed
+	} else if r.port == nil {
+		return nil, ErrorDisconnected
+	}
+	return r.port, nil
+}
+
+/* deviceLost returns true for errors that indicate the device is gone. A hangup makes reads return EOF. */
+func deviceLost(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, ErrorClosed) || errors.Is(err, syscall.EIO) ||
+		errors.Is(err, syscall.ENODEV) || errors.Is(err, syscall.ENXIO)
+}
+
+/* checkError converts errors of a lost device to ErrorDisconnected and starts reconnecting */
+func (r *ReconnectingPort) checkError(port Port, err error) error {
+	if !deviceLost(err) {
+		return err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if r.closed {
+		return ErrorClosed
+	}
+
+	if r.port == port {
+		select {
+		case r.lost <- err:
+		default:
+		}
+	}
+
+	return ErrorDisconnected
+}
+
+/* wait returns the open port. While the device is disconnected it waits until it is reopened, RetryInterval
+ * has passed or the deadline of the direction (0 for reading, 1 for writing) or the given limit expires. */
+func (r *ReconnectingPort) wait(direction int, limit time.Time) (Port, error) {
+	retry := time.NewTimer(r.config.RetryInterval)
+	defer retry.Stop()
+
+	for {
+		r.mtx.Lock()
+		closed := r.closed
+		port := r.port
+		connected := r.connected
+		deadline := earliest(r.deadline[direction], limit)
+		changed := r.deadlineChanged
+		r.mtx.Unlock()
+
+		if closed {
+			return nil, ErrorClosed
+		} else if port != nil {
+			return port, nil
+		}
+
+		/* A timer that never fires is used without a deadline */
+		remaining := time.Duration(math.MaxInt64)
+		if !deadline.IsZero() {
+			remaining = time.Until(deadline)
+			if remaining <= 0 {
+				return nil, os.ErrDeadlineExceeded
+			}
+		}
+		expired := time.NewTimer(remaining)
+
+		select {
+		case <-connected:
+		case <-changed:
+		case <-expired.C:
+		case <-r.closeChan:
+		case <-retry.C:
+			expired.Stop()
+			return nil, ErrorDisconnected
+		}
+		expired.Stop()
+	}
+}
+
+func (r *ReconnectingPort) Read(p []byte) (int, error) {
+	r.mtx.Lock()
+	timeout := r.options.ReadTimeout
+	r.mtx.Unlock()
+
+	var limit time.Time
+	if timeout > 0 {
+		limit = time.Now().Add(timeout)
+	}
+
+	port, err := r.wait(0, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := port.Read(p)
+	return n, r.checkError(port, err)
+}
+
+func (r *ReconnectingPort) Write(p []byte) (int, error) {
+	port, err := r.wait(1, time.Time{})
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := port.Write(p)
+	return n, r.checkError(port, err)
+}
+
+func (r *ReconnectingPort) Close() error {
+	r.mtx.Lock()
+	if r.closed {
+		r.mtx.Unlock()
+		return nil
+	}
+	r.closed = true
+	close(r.closeChan)
+	port := r.port
+	r.mtx.Unlock()
+
+	<-r.done
+	if port != nil {
+		return port.Close()
+	}
+	return nil
+}
+
+/* update stores a setting so it is applied again after reconnecting, and applies it to the open device */
+func (r *ReconnectingPort) update(store func(), apply func(port Port) error) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if r.closed {
+		return ErrorClosed
+	}
+
+	if r.port != nil {
+		if err := apply(r.port); err != nil {
+			return err
+		}
+	}
+
+	store()
+	return nil
+}
+
+func (r *ReconnectingPort) SetInterfaceRate(rate uint32) error {
+	return r.update(func() { r.options.InterfaceRate = rate }, func(port Port) error {
+		return port.SetInterfaceRate(rate)
+	})
+}
+
+func (r *ReconnectingPort) SetFlowControl(enabled bool) error {
+	return r.update(func() { r.options.FlowControl = enabled }, func(port Port) error {
+		return port.SetFlowControl(enabled)
+	})
+}
+
+func (r *ReconnectingPort) SetDataBits(bits int) error {
+	return r.update(func() { r.options.DataBits = bits }, func(port Port) error {
+		return port.SetDataBits(bits)
+	})
+}
+
+func (r *ReconnectingPort) SetParity(parity Parity) error {
+	return r.update(func() { r.options.Parity = parity }, func(port Port) error {
+		return port.SetParity(parity)
+	})
+}
+
+func (r *ReconnectingPort) SetStopBits(stopBits StopBits) error {
+	return r.update(func() { r.options.StopBits = stopBits }, func(port Port) error {
+		return port.SetStopBits(stopBits)
+	})
+}
+
+func (r *ReconnectingPort) SetReadTimeout(timeout time.Duration) error {
+	return r.update(func() { r.options.ReadTimeout = timeout }, func(port Port) error {
+		return port.SetReadTimeout(timeout)
+	})
+}
+
+func (r *ReconnectingPort) SetInterByteTimeout(timeout time.Duration) error {
+	return r.update(func() { r.options.InterByteTimeout = timeout }, func(port Port) error {
+		return port.SetInterByteTimeout(timeout)
+	})
+}
+
+func (r *ReconnectingPort) SetDeadline(t time.Time) error {
+	if err := r.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return r.SetWriteDeadline(t)
+}
+
+/* setDeadline must be called with the lock held */
+func (r *ReconnectingPort) setDeadline(direction int, t time.Time) {
+	r.deadline[direction] = t
+	close(r.deadlineChanged)
+	r.deadlineChanged = make(chan (struct{}))
+}
+
+func (r *ReconnectingPort) SetReadDeadline(t time.Time) error {
+	return r.update(func() { r.setDeadline(0, t) }, func(port Port) error {
+		return port.SetReadDeadline(t)
+	})
+}
+
+func (r *ReconnectingPort) SetWriteDeadline(t time.Time) error {
+	return r.update(func() { r.setDeadline(1, t) }, func(port Port) error {
+		return port.SetWriteDeadline(t)
+	})
+}
+
+func (r *ReconnectingPort) SetRS485(config *RS485Config) error {
+	var c *RS485Config
+	if config != nil {
+		copied := *config
+		c = &copied
+	}
+
+	return r.update(func() { r.options.RS485 = c }, func(port Port) error {
+		return port.SetRS485(c)
+	})
+}
+
+func (r *ReconnectingPort) SetDTR(enabled bool) error {
+	return r.update(func() { r.dtr = &enabled }, func(port Port) error {
+		return port.SetDTR(enabled)
+	})
+}
+
+func (r *ReconnectingPort) SetRTS(enabled bool) error {
+	return r.update(func() { r.rts = &enabled }, func(port Port) error {
+		return port.SetRTS(enabled)
+	})
+}
+
+func (r *ReconnectingPort) GetPins() (PortPins, error) {
+	port, err := r.current()
+	if err != nil {
+		return PortPins{}, err
+	}
+
+	pins, err := port.GetPins()
+	return pins, r.checkError(port, err)
+}
+
+func (r *ReconnectingPort) DoBreak(duration time.Duration) error {
+	port, err := r.current()
+	if err != nil {
+		return err
+	}
+
+	return r.checkError(port, port.DoBreak(duration))
+}
@@ -0,0 +1,112 @@
+//go:build linux
+
+package serial
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestReconnect(t *testing.T) {
+	master, options := openPty(t)
+
+	events := make(chan (PortEvent), 10)
+	port := OpenReconnecting(options, &ReconnectConfig{
+		RetryInterval: 10 * time.Millisecond,
+		OnEvent: func(event PortEvent) {
+			events <- event
+		},
+	})
+	defer port.Close()
+
+	expect := func(eventType PortEventType) {
+		select {
+		case event := <-events:
+			if event.Type != eventType || event.PortName != options.PortName {
+				t.Error("Wrong event", event, "expected", eventType)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("Missing event", eventType)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err := port.WaitConnected(ctx); err != nil {
+		t.Fatal(err)
+	}
+	expect(PortConnected)
+
+	if err := port.SetInterfaceRate(9600); err != nil {
+		t.Fatal(err)
+	}
+	if err := port.SetStopBits(StopBits2); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 16)
+	master.Write([]byte("a"))
+	if n, err := port.Read(buf); string(buf[:n]) != "a" || err != nil {
+		t.Error("Read failed", string(buf[:n]), err)
+	}
+
+	/* Remove the device while a read is blocked */
+	go func(master *os.File) {
+		time.Sleep(20 * time.Millisecond)
+		master.Close()
+	}(master)
+	if _, err := port.Read(buf); err != ErrorDisconnected {
+		t.Error("Blocked read did not return ErrorDisconnected", err)
+	}
+	expect(PortDisconnected)
+
+	if _, err := port.Write([]byte("b")); err != ErrorDisconnected {
+		t.Error("Write while disconnected did not return ErrorDisconnected", err)
+	}
+
+	/* Calls wait for the device before failing, unless the deadline expires */
+	start := time.Now()
+	if _, err := port.Read(buf); err != ErrorDisconnected || time.Since(start) < 10*time.Millisecond {
+		t.Error("Read did not wait for the device", err, time.Since(start))
+	}
+	port.SetReadDeadline(time.Now())
+	if _, err := port.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Error("Read ignored the deadline while disconnected", err)
+	}
+	port.SetReadDeadline(time.Time{})
+
+	/* A new pseudo terminal gets the lowest free number, which is the one that was removed */
+	master, newOptions := openPty(t)
+	if newOptions.PortName != options.PortName {
+		t.Skip("Pseudo terminal was not reused")
+	}
+
+	if err := port.WaitConnected(ctx); err != nil {
+		t.Fatal(err)
+	}
+	expect(PortConnected)
+
+	/* The master side returns the settings of the slave side. Pseudo terminals ignore parity and data bits. */
+	termios, err := unix.IoctlGetTermios(int(master.Fd()), unix.TCGETS2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if termios.Ospeed != 9600 || termios.Cflag&unix.CSTOPB == 0 {
+		t.Error("Settings were not applied again", termios.Ospeed, termios.Cflag)
+	}
+
+	master.Write([]byte("c"))
+	if n, err := port.Read(buf); string(buf[:n]) != "c" || err != nil {
+		t.Error("Read failed after reconnecting", string(buf[:n]), err)
+	}
+
+	port.Close()
+	if _, err := port.Read(buf); err != ErrorClosed {
+		t.Error("Read after close did not return ErrorClosed", err)
+	}
+}
@@ -7,13 +7,27 @@ import (
 )
 
 // Port is an extended io.ReadWriteCloser that also allows changing
-// some serial port specific settings
+// some serial port specific settings. Read returns io.EOF after a hangup,
+// eg. when a USB adapter was removed.
 type Port interface {
 	io.ReadWriteCloser
 
 	/* Configuration */
 	SetInterfaceRate(rate uint32) error
 	SetFlowControl(enabled bool) error
+	SetDataBits(bits int) error
+	SetParity(parity Parity) error
+	SetStopBits(stopBits StopBits) error
+
+	/* Timeouts */
+	SetReadTimeout(timeout time.Duration) error
+	SetInterByteTimeout(timeout time.Duration) error
+	SetDeadline(t time.Time) error
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+
+	/* RS-485, nil disables it */
+	SetRS485(config *RS485Config) error
 
 	/* Pins */
 	SetDTR(enabled bool) error
@@ -26,11 +40,84 @@ type Port interface {
 
 // PortOptions is a parameter struct for Open
 type PortOptions struct {
-	PortName      string
+	PortName string
+
+	/* Match selects the port by its attributes, it is only used when PortName is empty */
+	Match *PortMatch
+
 	InterfaceRate uint32
 	FlowControl   bool
+
+	/* Line settings, zero values mean 8N1 */
+	DataBits int
+	Parity   Parity
+	StopBits StopBits
+
+	/* ReadTimeout limits the time a Read call waits for data, zero waits forever. When it expires
+	 * Read returns an error matching os.ErrDeadlineExceeded, like a deadline does. */
+	ReadTimeout time.Duration
+
+	/* InterByteTimeout makes Read wait for more data after the first byte was received, until the
+	 * line has been idle for this time or the buffer is full. Zero returns as soon as data is available. */
+	InterByteTimeout time.Duration
+
+	/* RS485 enables RS-485 mode if not nil */
+	RS485 *RS485Config
+}
+
+// RS485Config configures the driver enable of a half-duplex RS-485 transceiver, which is connected to RTS.
+// The kernel driver is used if it supports RS-485, otherwise RTS is toggled around every Write.
+type RS485Config struct {
+	Enabled bool
+
+	/* RTS level while sending and after sending */
+	RTSOnSend    bool
+	RTSAfterSend bool
+
+	/* Delays between changing RTS and sending, the kernel uses millisecond resolution */
+	DelayBeforeSend time.Duration
+	DelayAfterSend  time.Duration
+
+	/* ReceiveDuringTX keeps the receiver enabled while sending, so the transmitted data is echoed.
+	 * Without it software mode flushes the input after every Write, which also discards data that
+	 * was received before the Write and not read yet. */
+	ReceiveDuringTX bool
+
+	/* Software always uses RTS toggling, eg. for drivers that accept the ioctl but do not implement it.
+	 * The RS-485 mode of the driver is disabled. */
+	Software bool
 }
 
+// Parity is the parity mode of the port. When parity is enabled, received bytes with a parity error are dropped.
+type Parity int
+
+const (
+	// ParityNone disables the parity bit
+	ParityNone Parity = 0
+	// ParityOdd sets the parity bit so the number of ones is odd
+	ParityOdd Parity = 1
+	// ParityEven sets the parity bit so the number of ones is even
+	ParityEven Parity = 2
+	// ParityMark always sets the parity bit
+	ParityMark Parity = 3
+	// ParitySpace always clears the parity bit
+	ParitySpace Parity = 4
+)
+
+// StopBits is the number of stop bits used by the port
+type StopBits int
+
+const (
+	// StopBitsDefault is the same as StopBits1
+	StopBitsDefault StopBits = 0
+	// StopBits1 uses one stop bit
+	StopBits1 StopBits = 1
+	// StopBits1Half uses one and a half stop bits, this is only possible with 5 data bits
+	StopBits1Half StopBits = 3
+	// StopBits2 uses two stop bits, this is not possible with 5 data bits
+	StopBits2 StopBits = 2
+)
+
 // PortPins indicates the state of the modem control signals
 type PortPins struct {
 	DSR bool
@@ -43,7 +130,32 @@ type PortPins struct {
 
 // Open creates an object that implements the SerialPort interface
 func Open(options *PortOptions) (Port, error) {
+	if options.PortName == "" && options.Match != nil {
+		name, err := options.Match.Find()
+		if err != nil {
+			return nil, err
+		}
+
+		resolved := *options
+		resolved.PortName = name
+		options = &resolved
+	}
+
 	return openPortOs(options)
 }
 
 var ErrorClosed = errors.New("port has been closed")
+
+var (
+	ErrorDataBits = errors.New("unsupported number of data bits")
+	ErrorParity   = errors.New("unsupported parity")
+	ErrorStopBits = errors.New("unsupported number of stop bits")
+)
+
+/* earliest returns the earliest of two deadlines, the zero time means no deadline */
+func earliest(a time.Time, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+	return a
+}
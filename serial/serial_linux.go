@@ -3,7 +3,7 @@
 package serial
 
 import (
-	"io"
+	"errors"
 	"os"
 	"sync"
 	"syscall"
@@ -15,52 +15,214 @@ import (
 
 type serialPortLinux struct {
 	file *os.File
+	raw  syscall.RawConn
 
 	/* Mutex to protest the file descriptor against simultaneous close */
 	mtx    sync.Mutex
 	wg     sync.WaitGroup
 	closed bool
+
+	/* Timeouts, protected by mtx. readLimit is the timeout of the current read, the deadline of the
+	 * file is the earliest of readLimit and readDeadline. */
+	readTimeout      time.Duration
+	interByteTimeout time.Duration
+	readDeadline     time.Time
+	readLimit        time.Time
+
+	/* Software RS-485 configuration, nil if not used. Protected by mtx. */
+	rs485 *RS485Config
+
+	/* Serializes writes when RTS is toggled in software */
+	writeMtx sync.Mutex
+
+	/* Pin and drain operations of software RS-485, replaced in tests as pseudo terminals have no RTS */
+	setRTS      func(enabled bool) error
+	drainOutput func() error
+}
+
+/* control calls f with the file descriptor. Unlike Fd it does not put the file in blocking mode,
+ * which would break deadlines and unblocking reads by closing the port. */
+func (port *serialPortLinux) control(f func(fd int) error) error {
+	var ferr error
+	err := port.raw.Control(func(fd uintptr) {
+		ferr = f(int(fd))
+	})
+	if err != nil {
+		return err
+	}
+	return ferr
+}
+
+func (port *serialPortLinux) ioctl(req uint, arg unsafe.Pointer, name string) error {
+	return port.control(func(fd int) error {
+		_, _, err := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), uintptr(req), uintptr(arg))
+		if err != 0 {
+			return os.NewSyscallError(name, err)
+		}
+		return nil
+	})
 }
 
 func (port *serialPortLinux) SetFlowControl(enabled bool) error {
+	return port.modifyTermios(func(termios *unix.Termios) error {
+		if enabled {
+			termios.Cflag |= unix.CRTSCTS
+		} else {
+			termios.Cflag &= ^uint32(unix.CRTSCTS)
+		}
+		return nil
+	})
+}
+
+func (port *serialPortLinux) SetInterfaceRate(rate uint32) error {
+	return port.modifyTermios(func(termios *unix.Termios) error {
+		termios.Cflag &= ^uint32(unix.CBAUD)
+		termios.Cflag |= uint32(unix.BOTHER)
+		termios.Ispeed = rate
+		termios.Ospeed = rate
+		return nil
+	})
+}
+
+/* modifyTermios reads the termios of the port, lets modify change it and writes it back */
+func (port *serialPortLinux) modifyTermios(modify func(termios *unix.Termios) error) error {
 	port.mtx.Lock()
 	defer port.mtx.Unlock()
 	if port.closed {
 		return ErrorClosed
 	}
 
-	termios, err := unix.IoctlGetTermios(int(port.file.Fd()), unix.TCGETS2)
-	if err != nil {
-		return err
+	return port.control(func(fd int) error {
+		termios, err := unix.IoctlGetTermios(fd, unix.TCGETS2)
+		if err != nil {
+			return err
+		}
+
+		if err := modify(termios); err != nil {
+			return err
+		}
+
+		return unix.IoctlSetTermios(fd, unix.TCSETS2, termios)
+	})
+}
+
+type lineSettings struct {
+	dataBits int
+	parity   Parity
+	stopBits StopBits
+}
+
+var dataBitsFlags = map[int]uint32{5: unix.CS5, 6: unix.CS6, 7: unix.CS7, 8: unix.CS8}
+
+func getLineSettings(termios *unix.Termios) lineSettings {
+	var l lineSettings
+
+	for bits, flag := range dataBitsFlags {
+		if termios.Cflag&unix.CSIZE == flag {
+			l.dataBits = bits
+		}
 	}
 
-	if enabled {
-		termios.Cflag |= unix.CRTSCTS
-	} else {
-		termios.Cflag &= ^uint32(unix.CRTSCTS)
+	switch {
+	case termios.Cflag&unix.PARENB == 0:
+		l.parity = ParityNone
+	case termios.Cflag&unix.CMSPAR != 0 && termios.Cflag&unix.PARODD != 0:
+		l.parity = ParityMark
+	case termios.Cflag&unix.CMSPAR != 0:
+		l.parity = ParitySpace
+	case termios.Cflag&unix.PARODD != 0:
+		l.parity = ParityOdd
+	default:
+		l.parity = ParityEven
+	}
+
+	l.stopBits = StopBits1
+	if termios.Cflag&unix.CSTOPB != 0 {
+		/* The UART uses 1.5 stop bits instead of 2 when 5 data bits are used */
+		if l.dataBits == 5 {
+			l.stopBits = StopBits1Half
+		} else {
+			l.stopBits = StopBits2
+		}
 	}
 
-	return unix.IoctlSetTermios(int(port.file.Fd()), unix.TCSETS2, termios)
+	return l
 }
 
-func (port *serialPortLinux) SetInterfaceRate(rate uint32) error {
-	port.mtx.Lock()
-	defer port.mtx.Unlock()
-	if port.closed {
-		return ErrorClosed
+func (l lineSettings) apply(termios *unix.Termios) error {
+	csize, ok := dataBitsFlags[l.dataBits]
+	if !ok {
+		return ErrorDataBits
 	}
 
-	termios, err := unix.IoctlGetTermios(int(port.file.Fd()), unix.TCGETS2)
-	if err != nil {
-		return err
+	var cstopb uint32
+	switch l.stopBits {
+	case StopBitsDefault, StopBits1:
+	case StopBits1Half:
+		if l.dataBits != 5 {
+			return ErrorStopBits
+		}
+		cstopb = unix.CSTOPB
+	case StopBits2:
+		if l.dataBits == 5 {
+			return ErrorStopBits
+		}
+		cstopb = unix.CSTOPB
+	default:
+		return ErrorStopBits
+	}
+
+	var parity uint32
+	switch l.parity {
+	case ParityNone:
+	case ParityOdd:
+		parity = unix.PARENB | unix.PARODD
+	case ParityEven:
+		parity = unix.PARENB
+	case ParityMark:
+		parity = unix.PARENB | unix.CMSPAR | unix.PARODD
+	case ParitySpace:
+		parity = unix.PARENB | unix.CMSPAR
+	default:
+		return ErrorParity
+	}
+
+	termios.Cflag &= ^uint32(unix.CSIZE | unix.CSTOPB | unix.PARENB | unix.PARODD | unix.CMSPAR)
+	termios.Cflag |= csize | cstopb | parity
+
+	/* Bytes with a parity or framing error are dropped instead of being received as a zero byte */
+	termios.Iflag &= ^uint32(unix.INPCK | unix.IGNPAR | unix.PARMRK)
+	if parity != 0 {
+		termios.Iflag |= unix.INPCK | unix.IGNPAR
 	}
 
-	termios.Cflag &= ^uint32(unix.CBAUD)
-	termios.Cflag |= uint32(unix.BOTHER)
-	termios.Ispeed = rate
-	termios.Ospeed = rate
+	return nil
+}
+
+func (port *serialPortLinux) setLineSettings(update func(l *lineSettings)) error {
+	return port.modifyTermios(func(termios *unix.Termios) error {
+		l := getLineSettings(termios)
+		update(&l)
+		return l.apply(termios)
+	})
+}
+
+func (port *serialPortLinux) SetDataBits(bits int) error {
+	return port.setLineSettings(func(l *lineSettings) {
+		l.dataBits = bits
+	})
+}
+
+func (port *serialPortLinux) SetParity(parity Parity) error {
+	return port.setLineSettings(func(l *lineSettings) {
+		l.parity = parity
+	})
+}
 
-	return unix.IoctlSetTermios(int(port.file.Fd()), unix.TCSETS2, termios)
+func (port *serialPortLinux) SetStopBits(stopBits StopBits) error {
+	return port.setLineSettings(func(l *lineSettings) {
+		l.stopBits = stopBits
+	})
 }
 
 func (port *serialPortLinux) defaultPortConfig() error {
@@ -68,15 +230,15 @@ func (port *serialPortLinux) defaultPortConfig() error {
 	/* Most basic serial config possible */
 	termios.Cflag |= uint32(syscall.CS8 | syscall.CLOCAL | syscall.CREAD)
 
-	/* Calling close during read does not always seem to cancel it (usually does though)
-	 * Therefore we put a 1s timeout so reads always return.
-	 * According to the go documentation this should not be neccesary
-	 * (Although I don't know if a serial port counts as a normal linux file) */
-	termios.Cc[syscall.VTIME] = 10
-	termios.Cc[syscall.VMIN] = 0
+	/* The file stays in non-blocking mode so the runtime poller handles waiting, deadlines and
+	 * cancelling reads on close. A read without data then fails with EAGAIN instead of returning 0. */
+	termios.Cc[syscall.VTIME] = 0
+	termios.Cc[syscall.VMIN] = 1
 
 	/* Set it */
-	return unix.IoctlSetTermios(int(port.file.Fd()), unix.TCSETS2, termios)
+	return port.control(func(fd int) error {
+		return unix.IoctlSetTermios(fd, unix.TCSETS2, termios)
+	})
 }
 
 func openPortOs(options *PortOptions) (*serialPortLinux, error) {
@@ -87,6 +249,12 @@ func openPortOs(options *PortOptions) (*serialPortLinux, error) {
 
 	port := &serialPortLinux{}
 	port.file = file
+	port.setRTS = port.SetRTS
+	port.drainOutput = port.drain
+	port.raw, err = file.SyscallConn()
+	if err != nil {
+		goto failed
+	}
 
 	/* Set default termios */
 	err = port.defaultPortConfig()
@@ -104,11 +272,31 @@ func openPortOs(options *PortOptions) (*serialPortLinux, error) {
 		goto failed
 	}
 
-	err = unix.SetNonblock(int(port.file.Fd()), false)
+	/* All line settings are applied at once, as not every intermediate combination is valid */
+	err = port.setLineSettings(func(l *lineSettings) {
+		*l = lineSettings{
+			dataBits: options.DataBits,
+			parity:   options.Parity,
+			stopBits: options.StopBits,
+		}
+		if l.dataBits == 0 {
+			l.dataBits = 8
+		}
+	})
 	if err != nil {
 		goto failed
 	}
 
+	if options.RS485 != nil {
+		err = port.SetRS485(options.RS485)
+		if err != nil {
+			goto failed
+		}
+	}
+
+	port.readTimeout = options.ReadTimeout
+	port.interByteTimeout = options.InterByteTimeout
+
 	return port, nil
 
 failed:
@@ -123,19 +311,13 @@ func (port *serialPortLinux) DoBreak(duration time.Duration) error {
 		return ErrorClosed
 	}
 
-	_, _, err := syscall.Syscall(syscall.SYS_IOCTL, uintptr(port.file.Fd()), uintptr(unix.TIOCSBRK), 0)
-	if err != 0 {
-		return os.NewSyscallError("TIOCSBRK", err)
+	if err := port.ioctl(unix.TIOCSBRK, nil, "TIOCSBRK"); err != nil {
+		return err
 	}
 
 	time.Sleep(duration)
 
-	_, _, err = syscall.Syscall(syscall.SYS_IOCTL, uintptr(port.file.Fd()), uintptr(unix.TIOCCBRK), 0)
-	if err != 0 {
-		return os.NewSyscallError("TIOCCBRK", err)
-	}
-
-	return nil
+	return port.ioctl(unix.TIOCCBRK, nil, "TIOCCBRK")
 }
 
 func (port *serialPortLinux) setPinIoctl(enabled bool, pin int) error {
@@ -150,12 +332,7 @@ func (port *serialPortLinux) setPinIoctl(enabled bool, pin int) error {
 		req = unix.TIOCMBIS
 	}
 
-	_, _, err := syscall.Syscall(syscall.SYS_IOCTL, uintptr(port.file.Fd()), uintptr(req), uintptr(unsafe.Pointer(&pin)))
-
-	if err != 0 {
-		return os.NewSyscallError("TIOCMBIC/TIOCMBIS", err)
-	}
-	return nil
+	return port.ioctl(uint(req), unsafe.Pointer(&pin), "TIOCMBIC/TIOCMBIS")
 }
 
 func (port *serialPortLinux) SetDTR(enabled bool) error {
@@ -176,10 +353,8 @@ func (port *serialPortLinux) GetPins() (PortPins, error) {
 	}
 
 	var v int
-	_, _, err := syscall.Syscall(syscall.SYS_IOCTL, uintptr(port.file.Fd()), uintptr(unix.TIOCMGET), uintptr(unsafe.Pointer(&v)))
-
-	if err != 0 {
-		return pins, os.NewSyscallError("TIOCMBIC/TIOCMBIS", err)
+	if err := port.ioctl(unix.TIOCMGET, unsafe.Pointer(&v), "TIOCMGET"); err != nil {
+		return pins, err
 	}
 
 	/* Decode response */
@@ -193,6 +368,29 @@ func (port *serialPortLinux) GetPins() (PortPins, error) {
 	return pins, nil
 }
 
+/* mapError returns ErrorClosed if the file was closed */
+func mapError(err error) error {
+	if errors.Is(err, os.ErrClosed) {
+		return ErrorClosed
+	}
+	return err
+}
+
+func (port *serialPortLinux) readUntil(p []byte, limit time.Time) (int, error) {
+	/* The deadline of the file is set with the lock held, so a concurrent SetReadDeadline is never lost */
+	port.mtx.Lock()
+	port.readLimit = limit
+	err := port.file.SetReadDeadline(earliest(port.readDeadline, limit))
+	port.mtx.Unlock()
+	if err != nil {
+		return 0, mapError(err)
+	}
+
+	/* The port uses VMIN=1, so a read only returns 0 bytes after a hangup */
+	n, err := port.file.Read(p)
+	return n, mapError(err)
+}
+
 func (port *serialPortLinux) Read(p []byte) (int, error) {
 	if len(p) == 0 {
 		return 0, nil
@@ -201,31 +399,242 @@ func (port *serialPortLinux) Read(p []byte) (int, error) {
 	port.wg.Add(1)
 	defer port.wg.Done()
 
-	for {
-		if n, err := port.file.Read(p); err != io.EOF || n > 0 {
+	port.mtx.Lock()
+	timeout := port.readTimeout
+	interByte := port.interByteTimeout
+	port.mtx.Unlock()
+
+	var limit time.Time
+	if timeout > 0 {
+		limit = time.Now().Add(timeout)
+	}
+
+	n, err := port.readUntil(p, limit)
+	if n == 0 || err != nil || interByte <= 0 {
+		return n, err
+	}
+
+	/* Keep reading until the line is idle, the buffer is full or a deadline expires */
+	for n < len(p) {
+		m, err := port.readUntil(p[n:], earliest(limit, time.Now().Add(interByte)))
+		n += m
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			break
+		} else if err != nil {
 			return n, err
 		}
 	}
+
+	return n, nil
 }
 
 func (port *serialPortLinux) Write(p []byte) (int, error) {
 	port.wg.Add(1)
 	defer port.wg.Done()
 
-	return port.file.Write(p)
+	port.mtx.Lock()
+	rs485 := port.rs485
+	port.mtx.Unlock()
+
+	if rs485 != nil {
+		return port.writeRS485(p, rs485)
+	}
+
+	n, err := port.file.Write(p)
+	return n, mapError(err)
 }
 
-func (port *serialPortLinux) Close() error {
+func (port *serialPortLinux) SetReadTimeout(timeout time.Duration) error {
+	port.mtx.Lock()
+	defer port.mtx.Unlock()
+	if port.closed {
+		return ErrorClosed
+	}
+
+	port.readTimeout = timeout
+	return nil
+}
+
+func (port *serialPortLinux) SetInterByteTimeout(timeout time.Duration) error {
+	port.mtx.Lock()
+	defer port.mtx.Unlock()
+	if port.closed {
+		return ErrorClosed
+	}
+
+	port.interByteTimeout = timeout
+	return nil
+}
+
+func (port *serialPortLinux) SetReadDeadline(t time.Time) error {
 	port.mtx.Lock()
 	defer port.mtx.Unlock()
+	if port.closed {
+		return ErrorClosed
+	}
 
+	/* Also apply it to the file, so a blocked read is affected */
+	port.readDeadline = t
+	return mapError(port.file.SetReadDeadline(earliest(t, port.readLimit)))
+}
+
+func (port *serialPortLinux) SetWriteDeadline(t time.Time) error {
+	port.mtx.Lock()
+	defer port.mtx.Unlock()
+	if port.closed {
+		return ErrorClosed
+	}
+
+	return mapError(port.file.SetWriteDeadline(t))
+}
+
+func (port *serialPortLinux) SetDeadline(t time.Time) error {
+	if err := port.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return port.SetWriteDeadline(t)
+}
+
+func (port *serialPortLinux) Close() error {
+	port.mtx.Lock()
 	if !port.closed {
 		port.closed = true
 		port.file.Close()
 	}
+	port.mtx.Unlock()
 
-	/* Wait for blocking actions to have completed */
+	/* Wait for blocking actions to have completed. Read takes the mutex, so it must not be held here. */
 	port.wg.Wait()
 
 	return nil
 }
+
+/* serialRS485 is struct serial_rs485 of the kernel */
+type serialRS485 struct {
+	flags              uint32
+	delayRTSBeforeSend uint32
+	delayRTSAfterSend  uint32
+	padding            [5]uint32
+}
+
+const (
+	serRS485Enabled      = 1 << 0
+	serRS485RTSOnSend    = 1 << 1
+	serRS485RTSAfterSend = 1 << 2
+	serRS485RXDuringTX   = 1 << 4
+)
+
+func durationToMs(d time.Duration) uint32 {
+	return uint32((d + time.Millisecond - 1) / time.Millisecond)
+}
+
+func (c *RS485Config) kernelConfig() serialRS485 {
+	var result serialRS485
+	if !c.Enabled {
+		return result
+	}
+
+	result.flags = serRS485Enabled
+	if c.RTSOnSend {
+		result.flags |= serRS485RTSOnSend
+	}
+	if c.RTSAfterSend {
+		result.flags |= serRS485RTSAfterSend
+	}
+	if c.ReceiveDuringTX {
+		result.flags |= serRS485RXDuringTX
+	}
+	result.delayRTSBeforeSend = durationToMs(c.DelayBeforeSend)
+	result.delayRTSAfterSend = durationToMs(c.DelayAfterSend)
+
+	return result
+}
+
+/* rs485Unsupported returns true if the error indicates the driver does not implement TIOCSRS485 */
+func rs485Unsupported(err error) bool {
+	return errors.Is(err, syscall.ENOTTY) || errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.EOPNOTSUPP)
+}
+
+func (port *serialPortLinux) SetRS485(config *RS485Config) error {
+	c := RS485Config{}
+	if config != nil {
+		c = *config
+	}
+
+	port.mtx.Lock()
+	port.rs485 = nil
+	port.mtx.Unlock()
+
+	/* In software mode the kernel mode is disabled, it could still be enabled by an earlier call */
+	kernel := serialRS485{}
+	if !c.Software {
+		kernel = c.kernelConfig()
+	}
+
+	err := port.ioctl(unix.TIOCSRS485, unsafe.Pointer(&kernel), "TIOCSRS485")
+	if err != nil && !rs485Unsupported(err) {
+		return mapError(err)
+	}
+	if err == nil && !c.Software {
+		return nil
+	}
+
+	if !c.Enabled {
+		return nil
+	}
+
+	/* Fall back to toggling RTS in software, starting in the idle state */
+	if err := port.setRTS(c.RTSAfterSend); err != nil {
+		return err
+	}
+
+	port.mtx.Lock()
+	defer port.mtx.Unlock()
+	if port.closed {
+		return ErrorClosed
+	}
+
+	port.rs485 = &c
+	return nil
+}
+
+/* drain waits until all output has been transmitted (tcdrain) */
+func (port *serialPortLinux) drain() error {
+	return port.control(func(fd int) error {
+		return unix.IoctlSetInt(fd, unix.TCSBRK, 1)
+	})
+}
+
+func (port *serialPortLinux) flushInput() error {
+	return port.control(func(fd int) error {
+		return unix.IoctlSetInt(fd, unix.TCFLSH, unix.TCIFLUSH)
+	})
+}
+
+func (port *serialPortLinux) writeRS485(p []byte, c *RS485Config) (int, error) {
+	port.writeMtx.Lock()
+	defer port.writeMtx.Unlock()
+
+	if err := port.setRTS(c.RTSOnSend); err != nil {
+		return 0, err
+	}
+	time.Sleep(c.DelayBeforeSend)
+
+	n, err := port.file.Write(p)
+	if err == nil {
+		err = port.drainOutput()
+	}
+
+	/* The receiver can not be disabled in software, so the echo is removed by flushing the input.
+	 * This also drops anything that was received before or during the write. */
+	if err == nil && !c.ReceiveDuringTX {
+		err = port.flushInput()
+	}
+
+	time.Sleep(c.DelayAfterSend)
+	if rtsErr := port.setRTS(c.RTSAfterSend); err == nil {
+		err = rtsErr
+	}
+
+	return n, mapError(err)
+}
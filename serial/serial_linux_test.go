@@ -0,0 +1,299 @@
+//go:build linux
+
+package serial
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestLineSettings(t *testing.T) {
+	valid := []lineSettings{
+		{8, ParityNone, StopBits1},
+		{7, ParityEven, StopBits1},
+		{8, ParityEven, StopBits1},
+		{8, ParityOdd, StopBits2},
+		{7, ParityMark, StopBits1},
+		{6, ParitySpace, StopBits2},
+		{5, ParityNone, StopBits1Half},
+	}
+
+	for _, m := range valid {
+		termios := &unix.Termios{Cflag: unix.CLOCAL | unix.CREAD | unix.CRTSCTS, Iflag: unix.IXON | unix.INPCK | unix.PARMRK}
+		if err := m.apply(termios); err != nil {
+			t.Error("Failed to apply", m, err)
+			continue
+		}
+
+		if termios.Cflag&(unix.CLOCAL|unix.CREAD|unix.CRTSCTS) != unix.CLOCAL|unix.CREAD|unix.CRTSCTS {
+			t.Error("Other flags were changed", m)
+		}
+		if result := getLineSettings(termios); result != m {
+			t.Error("Wrong settings", result, "expected", m)
+		}
+
+		checked := termios.Iflag&(unix.INPCK|unix.IGNPAR) == unix.INPCK|unix.IGNPAR
+		if checked != (m.parity != ParityNone) || termios.Iflag&(unix.PARMRK|unix.IXON) != unix.IXON {
+			t.Error("Wrong input flags", m, termios.Iflag)
+		}
+	}
+
+	termios := &unix.Termios{}
+	if err := (lineSettings{8, ParityNone, StopBitsDefault}).apply(termios); err != nil || getLineSettings(termios).stopBits != StopBits1 {
+		t.Error("Default stop bits failed", err)
+	}
+
+	invalid := []struct {
+		settings lineSettings
+		err      error
+	}{
+		{lineSettings{9, ParityNone, StopBits1}, ErrorDataBits},
+		{lineSettings{0, ParityNone, StopBits1}, ErrorDataBits},
+		{lineSettings{8, Parity(5), StopBits1}, ErrorParity},
+		{lineSettings{8, ParityNone, StopBits(4)}, ErrorStopBits},
+		{lineSettings{5, ParityNone, StopBits2}, ErrorStopBits},
+		{lineSettings{8, ParityNone, StopBits1Half}, ErrorStopBits},
+	}
+
+	for _, m := range invalid {
+		if err := m.settings.apply(&unix.Termios{}); err != m.err {
+			t.Error("Wrong error for", m.settings, err)
+		}
+	}
+}
+
+/* openPty returns the master side of a pseudo terminal and the options to open the slave side */
+func openPty(t *testing.T) (*os.File, *PortOptions) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		t.Skip("No pseudo terminals available:", err)
+	}
+	t.Cleanup(func() { master.Close() })
+
+	fd := int(master.Fd())
+	if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+		t.Fatal(err)
+	}
+	n, err := unix.IoctlGetInt(fd, unix.TIOCGPTN)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return master, &PortOptions{
+		PortName:      fmt.Sprintf("/dev/pts/%d", n),
+		InterfaceRate: 115200,
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	master, options := openPty(t)
+	options.ReadTimeout = 50 * time.Millisecond
+
+	port, err := Open(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer port.Close()
+
+	buf := make([]byte, 16)
+	start := time.Now()
+	if n, err := port.Read(buf); n != 0 || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Error("Read did not time out", n, err)
+	}
+	if d := time.Since(start); d < 40*time.Millisecond || d > time.Second {
+		t.Error("Wrong timeout", d)
+	}
+
+	/* Data separated by less than the inter-byte timeout is returned by one call */
+	port.SetReadTimeout(0)
+	port.SetInterByteTimeout(100 * time.Millisecond)
+	go func() {
+		master.Write([]byte("ab"))
+		time.Sleep(20 * time.Millisecond)
+		master.Write([]byte("cd"))
+	}()
+	if n, err := port.Read(buf); string(buf[:n]) != "abcd" || err != nil {
+		t.Error("Wrong inter-byte read", string(buf[:n]), err)
+	}
+
+	/* A deadline unblocks a blocked read */
+	port.SetInterByteTimeout(0)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		port.SetReadDeadline(time.Now())
+	}()
+	if _, err := port.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Error("Deadline did not unblock read", err)
+	}
+
+	port.SetReadDeadline(time.Time{})
+	master.Write([]byte("e"))
+	if n, err := port.Read(buf); string(buf[:n]) != "e" || err != nil {
+		t.Error("Read failed after clearing deadline", string(buf[:n]), err)
+	}
+
+	/* Closing unblocks a blocked read */
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		port.Close()
+	}()
+	if _, err := port.Read(buf); err != ErrorClosed {
+		t.Error("Close did not unblock read", err)
+	}
+}
+
+/* A deadline set while Read is starting must not be overwritten by the read */
+func TestDeadlineRace(t *testing.T) {
+	master, options := openPty(t)
+
+	port, err := Open(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer port.Close()
+
+	buf := make([]byte, 16)
+
+	/* A deadline set during a blocked read also limits the wait for more data */
+	port.SetInterByteTimeout(10 * time.Second)
+	go func(master *os.File) {
+		time.Sleep(20 * time.Millisecond)
+		port.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		master.Write([]byte("a"))
+	}(master)
+	start := time.Now()
+	if n, err := port.Read(buf); n != 1 || err != nil || time.Since(start) > time.Second {
+		t.Error("Inter-byte wait ignored the deadline", n, err, time.Since(start))
+	}
+	port.SetReadDeadline(time.Time{})
+
+	for i := 0; i < 1000; i++ {
+		/* Half of the reads wait for more data after the first byte */
+		if i%2 == 1 {
+			port.SetInterByteTimeout(10 * time.Second)
+			master.Write([]byte("a"))
+		} else {
+			port.SetInterByteTimeout(0)
+		}
+
+		done := make(chan (error), 1)
+		go func() {
+			_, err := port.Read(buf)
+			done <- err
+		}()
+
+		/* Vary the delay to hit the start of Read */
+		for start := time.Now(); time.Since(start) < time.Duration(i%20)*time.Microsecond; {
+			runtime.Gosched()
+		}
+		port.SetReadDeadline(time.Now())
+
+		select {
+		case err := <-done:
+			/* The byte of the previous iteration may still be pending */
+			if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Fatal("Wrong error", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Read ignored the deadline in iteration", i)
+		}
+
+		port.SetReadDeadline(time.Time{})
+	}
+}
+
+func TestRS485(t *testing.T) {
+	c := &RS485Config{
+		Enabled:         true,
+		RTSOnSend:       true,
+		DelayBeforeSend: 1500 * time.Microsecond,
+		DelayAfterSend:  2 * time.Millisecond,
+	}
+	if k := c.kernelConfig(); k.flags != serRS485Enabled|serRS485RTSOnSend || k.delayRTSBeforeSend != 2 || k.delayRTSAfterSend != 2 {
+		t.Error("Wrong kernel configuration", k)
+	}
+	if k := (&RS485Config{RTSOnSend: true}).kernelConfig(); k != (serialRS485{}) {
+		t.Error("Disabled configuration is not empty", k)
+	}
+	if unsafe.Sizeof(serialRS485{}) != 32 {
+		t.Error("Wrong struct size")
+	}
+
+	/* Pseudo terminals support neither the ioctl nor RTS */
+	_, options := openPty(t)
+	port, err := Open(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer port.Close()
+
+	if err := port.SetRS485(nil); err != nil {
+		t.Error("Disabling failed", err)
+	}
+	if err := port.SetRS485(c); !errors.Is(err, syscall.ENOTTY) {
+		t.Error("Expected software fallback to fail", err)
+	}
+}
+
+/* The software fallback is tested with fake RTS and drain operations, which echo the sent data */
+func TestRS485Software(t *testing.T) {
+	for _, receive := range []bool{false, true} {
+		master, options := openPty(t)
+		port, err := openPortOs(options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer port.Close()
+
+		var rts []bool
+		port.setRTS = func(enabled bool) error {
+			rts = append(rts, enabled)
+			return nil
+		}
+		port.drainOutput = func() error {
+			buf := make([]byte, 16)
+			n, err := master.Read(buf)
+			if err != nil {
+				return err
+			}
+			master.Write(buf[:n])
+			time.Sleep(20 * time.Millisecond)
+			return nil
+		}
+
+		c := &RS485Config{Enabled: true, RTSOnSend: true, ReceiveDuringTX: receive, Software: true}
+		if err := port.SetRS485(c); err != nil {
+			t.Fatal(err)
+		}
+
+		master.Write([]byte("pending"))
+		time.Sleep(20 * time.Millisecond)
+		if n, err := port.Write([]byte("data")); n != 4 || err != nil {
+			t.Fatal("Write failed", n, err)
+		}
+		if len(rts) != 3 || rts[0] || !rts[1] || rts[2] {
+			t.Error("Wrong RTS sequence", rts)
+		}
+
+		/* Without ReceiveDuringTX the echo is dropped, together with the unread input */
+		expected := ""
+		if receive {
+			expected = "pendingdata"
+		}
+		port.SetReadTimeout(50 * time.Millisecond)
+		port.SetInterByteTimeout(20 * time.Millisecond)
+		buf := make([]byte, 32)
+		n, _ := port.Read(buf)
+		if string(buf[:n]) != expected {
+			t.Errorf("Wrong input with ReceiveDuringTX %v: %q", receive, buf[:n])
+		}
+	}
+}
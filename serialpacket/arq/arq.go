@@ -0,0 +1,569 @@
+package arq
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/BertoldVdb/go-misc/closeflag"
+	"github.com/BertoldVdb/go-misc/serialpacket/framer/framerinterface"
+)
+
+var (
+	// ErrorClosed is returned by SendPacket when the ARQ layer was closed
+	ErrorClosed = errors.New("ARQ has been closed")
+
+	// ErrorLinkFailed is returned when a packet was retransmitted more than MaxRetries times
+	ErrorLinkFailed = errors.New("Remote side stopped acknowledging packets")
+)
+
+const (
+	packetData = 0x01
+	packetAck  = 0x02
+
+	headerLenData = 3
+	headerLenAck  = 7
+
+	maxWindowSize = 32
+)
+
+// Config contains the parameters of the ARQ layer. Zero values are replaced by the defaults.
+type Config struct {
+	// WindowSize is the maximum amount of unacknowledged packets (1-32). Default: 8
+	WindowSize int
+
+	// InitialRTO is the retransmission timeout used before a round trip time was measured. Default: 500ms
+	InitialRTO time.Duration
+
+	// MinRTO is the lower bound of the retransmission timeout. Default: 20ms
+	MinRTO time.Duration
+
+	// MaxRTO is the upper bound of the retransmission timeout. Default: 5s
+	MaxRTO time.Duration
+
+	// MaxRetries is the amount of retransmissions of a packet before the link is considered failed. If <=0 it is unlimited.
+	MaxRetries int
+}
+
+// DefaultConfig returns the default ARQ configuration
+func DefaultConfig() *Config {
+	return &Config{
+		WindowSize: 8,
+		InitialRTO: 500 * time.Millisecond,
+		MinRTO:     20 * time.Millisecond,
+		MaxRTO:     5 * time.Second,
+	}
+}
+
+// Stats contains statistics about the ARQ layer, together with the statistics of the underlying framer
+type Stats struct {
+	framerinterface.BaseStats
+
+	PacketsSent        uint64
+	PacketsDelivered   uint64
+	Retransmissions    uint64
+	DuplicatesReceived uint64
+	OutOfWindow        uint64
+	InvalidReceived    uint64
+
+	AcksSent     uint64
+	AcksReceived uint64
+
+	SRTT time.Duration
+	RTO  time.Duration
+}
+
+type txPacket struct {
+	data          []byte
+	sentAt        time.Time
+	deadline      time.Time
+	retries       int
+	retransmitted bool
+}
+
+type rxPacket struct {
+	payload  []byte
+	metadata framerinterface.PacketMetadata
+}
+
+// ARQ wraps a framer and provides a reliable and ordered datagram service using selective repeat ARQ.
+// It implements the framerinterface.Framer interface itself, so it can be used in place of the wrapped framer.
+// Both sides need to be started at the same time, as sequence numbers are not negotiated.
+type ARQ struct {
+	framer framerinterface.Framer
+	config Config
+
+	closeflag closeflag.CloseFlag
+	kick      chan (struct{})
+
+	/* failed is closed when tx.err is set */
+	failed chan (struct{})
+
+	tx struct {
+		sync.Mutex
+		cond *sync.Cond
+
+		base        uint16
+		next        uint16
+		outstanding map[uint16]*txPacket
+		err         error
+
+		srtt      time.Duration
+		rttvar    time.Duration
+		rto       time.Duration
+		hasSample bool
+	}
+
+	rx struct {
+		sync.Mutex
+
+		expected   uint16
+		buffered   map[uint16]*rxPacket
+		ackPending bool
+	}
+
+	stats Stats
+}
+
+// NewARQ creates an ARQ layer on top of the given framer. Config may be nil to use the defaults.
+func NewARQ(framer framerinterface.Framer, config *Config) *ARQ {
+	a := &ARQ{
+		framer: framer,
+		kick:   make(chan (struct{}), 1),
+		failed: make(chan (struct{})),
+	}
+
+	def := DefaultConfig()
+	if config != nil {
+		a.config = *config
+	}
+	if a.config.WindowSize <= 0 {
+		a.config.WindowSize = def.WindowSize
+	}
+	if a.config.WindowSize > maxWindowSize {
+		a.config.WindowSize = maxWindowSize
+	}
+	if a.config.InitialRTO <= 0 {
+		a.config.InitialRTO = def.InitialRTO
+	}
+	if a.config.MinRTO <= 0 {
+		a.config.MinRTO = def.MinRTO
+	}
+	if a.config.MaxRTO <= 0 {
+		a.config.MaxRTO = def.MaxRTO
+	}
+
+	a.tx.cond = sync.NewCond(&a.tx.Mutex)
+	a.tx.outstanding = make(map[uint16]*txPacket)
+	a.tx.rto = a.clampRTO(a.config.InitialRTO)
+	a.rx.buffered = make(map[uint16]*rxPacket)
+
+	return a
+}
+
+func (a *ARQ) clampRTO(rto time.Duration) time.Duration {
+	if rto < a.config.MinRTO {
+		return a.config.MinRTO
+	}
+	if rto > a.config.MaxRTO {
+		return a.config.MaxRTO
+	}
+	return rto
+}
+
+func (a *ARQ) signalWorker() {
+	select {
+	case a.kick <- struct{}{}:
+	default:
+	}
+}
+
+/* failWithoutLock stops the ARQ and wakes up blocked senders. The tx lock must be held */
+func (a *ARQ) failWithoutLock(err error) {
+	if a.tx.err == nil {
+		a.tx.err = err
+		close(a.failed)
+	}
+	a.tx.cond.Broadcast()
+}
+
+// SendPacket queues a packet for reliable transmission. It blocks while the window is full.
+// The returned length is the amount of bytes written to the underlying framer for the first transmission.
+func (a *ARQ) SendPacket(payload []byte) (int64, error) {
+	a.tx.Lock()
+	for a.tx.err == nil && int(a.tx.next-a.tx.base) >= a.config.WindowSize {
+		a.tx.cond.Wait()
+	}
+
+	if a.tx.err != nil {
+		err := a.tx.err
+		a.tx.Unlock()
+		return 0, err
+	}
+
+	seq := a.tx.next
+	a.tx.next++
+
+	data := make([]byte, headerLenData+len(payload))
+	data[0] = packetData
+	binary.BigEndian.PutUint16(data[1:], seq)
+	copy(data[headerLenData:], payload)
+
+	now := time.Now()
+	a.tx.outstanding[seq] = &txPacket{
+		data:     data,
+		sentAt:   now,
+		deadline: now.Add(a.tx.rto),
+	}
+	a.tx.Unlock()
+
+	atomic.AddUint64(&a.stats.PacketsSent, 1)
+	a.signalWorker()
+
+	return a.framer.SendPacket(data)
+}
+
+/* sampleRTT updates the RTO estimation as described in RFC 6298. The tx lock must be held */
+func (a *ARQ) sampleRTT(rtt time.Duration) {
+	if !a.tx.hasSample {
+		a.tx.srtt = rtt
+		a.tx.rttvar = rtt / 2
+		a.tx.hasSample = true
+	} else {
+		delta := a.tx.srtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		a.tx.rttvar = (3*a.tx.rttvar + delta) / 4
+		a.tx.srtt = (7*a.tx.srtt + rtt) / 8
+	}
+
+	a.tx.rto = a.clampRTO(a.tx.srtt + 4*a.tx.rttvar)
+}
+
+/* ackPacket removes a packet from the retransmission queue. The tx lock must be held */
+func (a *ARQ) ackPacket(seq uint16, now time.Time) {
+	p, ok := a.tx.outstanding[seq]
+	if !ok {
+		return
+	}
+
+	/* Karn's algorithm: ambiguous samples of retransmitted packets are not used */
+	if !p.retransmitted {
+		a.sampleRTT(now.Sub(p.sentAt))
+	}
+
+	delete(a.tx.outstanding, seq)
+}
+
+func (a *ARQ) handleAck(payload []byte) {
+	atomic.AddUint64(&a.stats.AcksReceived, 1)
+
+	next := binary.BigEndian.Uint16(payload[1:])
+	sack := binary.BigEndian.Uint32(payload[3:])
+	now := time.Now()
+
+	a.tx.Lock()
+	defer a.tx.Unlock()
+
+	/* Ignore acknowledgements for packets that were never sent */
+	if next-a.tx.base > a.tx.next-a.tx.base {
+		return
+	}
+
+	for seq := a.tx.base; seq != next; seq++ {
+		a.ackPacket(seq, now)
+	}
+	a.tx.base = next
+
+	for i := uint16(0); i < maxWindowSize; i++ {
+		if sack&(1<<i) != 0 {
+			a.ackPacket(next+1+i, now)
+		}
+	}
+
+	a.tx.cond.Broadcast()
+}
+
+func (a *ARQ) handleData(payload []byte, metadata *framerinterface.PacketMetadata, receivedPacket framerinterface.FramerReceivedPacketHandler) error {
+	seq := binary.BigEndian.Uint16(payload[1:])
+	payload = payload[headerLenData:]
+
+	a.rx.Lock()
+	a.rx.ackPending = true
+
+	diff := seq - a.rx.expected
+	if diff >= 0x8000 {
+		/* Packet before the window, our acknowledgement was lost */
+		a.rx.Unlock()
+		atomic.AddUint64(&a.stats.DuplicatesReceived, 1)
+		a.signalWorker()
+		return nil
+	}
+
+	if int(diff) >= a.config.WindowSize {
+		a.rx.Unlock()
+		atomic.AddUint64(&a.stats.OutOfWindow, 1)
+		a.signalWorker()
+		return nil
+	}
+
+	if _, ok := a.rx.buffered[seq]; ok {
+		a.rx.Unlock()
+		atomic.AddUint64(&a.stats.DuplicatesReceived, 1)
+		a.signalWorker()
+		return nil
+	}
+
+	if diff > 0 {
+		/* Out of order, keep it until the missing packets arrive */
+		p := &rxPacket{
+			payload:  make([]byte, len(payload)),
+			metadata: *metadata,
+		}
+		copy(p.payload, payload)
+		a.rx.buffered[seq] = p
+		a.rx.Unlock()
+		a.signalWorker()
+		return nil
+	}
+
+	a.rx.expected++
+	a.rx.Unlock()
+	a.signalWorker()
+
+	/* Only this goroutine modifies expected, so delivery remains in order */
+	for {
+		atomic.AddUint64(&a.stats.PacketsDelivered, 1)
+		err := receivedPacket(payload, metadata)
+		if err != nil {
+			return err
+		}
+
+		a.rx.Lock()
+		p, ok := a.rx.buffered[a.rx.expected]
+		if ok {
+			delete(a.rx.buffered, a.rx.expected)
+			a.rx.expected++
+		}
+		a.rx.Unlock()
+
+		if !ok {
+			return nil
+		}
+
+		payload = p.payload
+		metadata = &p.metadata
+	}
+}
+
+func (a *ARQ) buildAck() []byte {
+	a.rx.Lock()
+	defer a.rx.Unlock()
+
+	if !a.rx.ackPending {
+		return nil
+	}
+	a.rx.ackPending = false
+
+	var sack uint32
+	for seq := range a.rx.buffered {
+		sack |= 1 << (seq - a.rx.expected - 1)
+	}
+
+	ack := make([]byte, headerLenAck)
+	ack[0] = packetAck
+	binary.BigEndian.PutUint16(ack[1:], a.rx.expected)
+	binary.BigEndian.PutUint32(ack[3:], sack)
+
+	return ack
+}
+
+/* collectRetransmissions returns the packets whose retransmission timer expired, and the time
+ * until the next one expires */
+func (a *ARQ) collectRetransmissions(now time.Time) ([][]byte, time.Duration) {
+	a.tx.Lock()
+	defer a.tx.Unlock()
+
+	var seqs []uint16
+	wait := time.Duration(-1)
+	for seq, p := range a.tx.outstanding {
+		if !now.Before(p.deadline) {
+			seqs = append(seqs, seq)
+		} else if d := p.deadline.Sub(now); wait < 0 || d < wait {
+			wait = d
+		}
+	}
+
+	if len(seqs) == 0 {
+		return nil, wait
+	}
+
+	/* Back off once per expiry, as described in RFC 6298 */
+	a.tx.rto = a.clampRTO(2 * a.tx.rto)
+
+	sort.Slice(seqs, func(i, j int) bool {
+		return seqs[i]-a.tx.base < seqs[j]-a.tx.base
+	})
+
+	resend := make([][]byte, 0, len(seqs))
+	for _, seq := range seqs {
+		p := a.tx.outstanding[seq]
+		if a.config.MaxRetries > 0 && p.retries >= a.config.MaxRetries {
+			a.failWithoutLock(ErrorLinkFailed)
+			return nil, -1
+		}
+
+		p.retries++
+		p.retransmitted = true
+		p.deadline = now.Add(a.tx.rto)
+		resend = append(resend, p.data)
+
+		if d := a.tx.rto; wait < 0 || d < wait {
+			wait = d
+		}
+	}
+
+	return resend, wait
+}
+
+func (a *ARQ) worker(done <-chan (struct{})) {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		if ack := a.buildAck(); ack != nil {
+			if _, err := a.framer.SendPacket(ack); err == nil {
+				atomic.AddUint64(&a.stats.AcksSent, 1)
+			}
+		}
+
+		resend, wait := a.collectRetransmissions(time.Now())
+		for _, m := range resend {
+			atomic.AddUint64(&a.stats.Retransmissions, 1)
+			a.framer.SendPacket(m)
+		}
+
+		var timerChan <-chan (time.Time)
+		if wait >= 0 {
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(wait)
+			timerChan = timer.C
+		}
+
+		select {
+		case <-done:
+			return
+		case <-a.closeflag.Chan():
+			return
+		case <-a.kick:
+		case <-timerChan:
+		}
+	}
+}
+
+// Run starts the receiver and the retransmission logic. It returns when the underlying framer returns, when
+// the link fails or when Close is called. In the last two cases a framer implementing FramerContext is
+// cancelled, other framers keep running in the background until their port is closed or they receive a packet.
+func (a *ARQ) Run(receivedPacket framerinterface.FramerReceivedPacketHandler) error {
+	done := make(chan (struct{}))
+	go a.worker(done)
+	defer close(done)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	handler := func(payload []byte, metadata *framerinterface.PacketMetadata) error {
+		a.tx.Lock()
+		err := a.tx.err
+		a.tx.Unlock()
+		if err != nil {
+			return err
+		}
+
+		if len(payload) >= headerLenData && payload[0] == packetData {
+			return a.handleData(payload, metadata, receivedPacket)
+		} else if len(payload) >= headerLenAck && payload[0] == packetAck {
+			a.handleAck(payload)
+		} else {
+			atomic.AddUint64(&a.stats.InvalidReceived, 1)
+		}
+
+		return nil
+	}
+
+	result := make(chan (error), 1)
+	go func() {
+		if framer, ok := a.framer.(framerinterface.FramerContext); ok {
+			result <- framer.RunContext(ctx, nil, handler)
+		} else {
+			result <- a.framer.Run(handler)
+		}
+	}()
+
+	var err error
+	select {
+	case err = <-result:
+	case <-a.failed:
+		a.tx.Lock()
+		err = a.tx.err
+		a.tx.Unlock()
+	}
+
+	a.tx.Lock()
+	a.failWithoutLock(ErrorClosed)
+	a.tx.Unlock()
+
+	return err
+}
+
+// Close stops the ARQ layer, wakes up blocked senders and makes Run return.
+func (a *ARQ) Close() error {
+	a.tx.Lock()
+	a.failWithoutLock(ErrorClosed)
+	a.tx.Unlock()
+
+	return a.closeflag.Close()
+}
+
+// SetPort changes the port of the underlying framer
+func (a *ARQ) SetPort(port io.ReadWriter) error {
+	return a.framer.SetPort(port)
+}
+
+// GetStats returns the statistics of the underlying framer
+func (a *ARQ) GetStats() framerinterface.BaseStats {
+	return a.framer.GetStats()
+}
+
+// GetARQStats returns a safely accessed snapshot of the ARQ statistics
+func (a *ARQ) GetARQStats() Stats {
+	r := Stats{
+		BaseStats:          a.framer.GetStats(),
+		PacketsSent:        atomic.LoadUint64(&a.stats.PacketsSent),
+		PacketsDelivered:   atomic.LoadUint64(&a.stats.PacketsDelivered),
+		Retransmissions:    atomic.LoadUint64(&a.stats.Retransmissions),
+		DuplicatesReceived: atomic.LoadUint64(&a.stats.DuplicatesReceived),
+		OutOfWindow:        atomic.LoadUint64(&a.stats.OutOfWindow),
+		InvalidReceived:    atomic.LoadUint64(&a.stats.InvalidReceived),
+		AcksSent:           atomic.LoadUint64(&a.stats.AcksSent),
+		AcksReceived:       atomic.LoadUint64(&a.stats.AcksReceived),
+	}
+
+	a.tx.Lock()
+	r.SRTT = a.tx.srtt
+	r.RTO = a.tx.rto
+	a.tx.Unlock()
+
+	return r
+}
@@ -0,0 +1,166 @@
+package arq
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BertoldVdb/go-misc/bidirpipe"
+	"github.com/BertoldVdb/go-misc/multicrc"
+	"github.com/BertoldVdb/go-misc/serialpacket/framer/framerinterface"
+	"github.com/BertoldVdb/go-misc/serialpacket/framer/hdlc"
+	"github.com/BertoldVdb/go-misc/serialpacket/framer/testutil"
+)
+
+type lossyPort struct {
+	io.ReadWriteCloser
+
+	sync.Mutex
+	lossRate float64
+}
+
+func (l *lossyPort) Write(p []byte) (int, error) {
+	l.Lock()
+	drop := rand.Float64() < l.lossRate
+	l.Unlock()
+
+	if drop {
+		return len(p), nil
+	}
+	return l.ReadWriteCloser.Write(p)
+}
+
+func createARQ(t *testing.T, port io.ReadWriteCloser) (*ARQ, chan ([]byte), chan (error)) {
+	options := framerinterface.DefaultFramerOptions().
+		Set(framerinterface.OptionCRCParam, multicrc.Crc16CCITTFALSE).
+		Set(framerinterface.OptionMaxPacketLen, 1024)
+
+	framer, err := hdlc.NewHDLCFramer(&lossyPort{ReadWriteCloser: port, lossRate: 0.2}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := NewARQ(framer, &Config{
+		WindowSize: 8,
+		InitialRTO: 50 * time.Millisecond,
+		MinRTO:     10 * time.Millisecond,
+	})
+
+	rxChan := make(chan ([]byte), 1000)
+	done := make(chan (error), 1)
+	go func() {
+		done <- a.Run(func(payload []byte, metadata *framerinterface.PacketMetadata) error {
+			rxChan <- append([]byte(nil), payload...)
+			return nil
+		})
+	}()
+
+	return a, rxChan, done
+}
+
+func sendAll(a *ARQ, packets [][]byte, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	for _, m := range packets {
+		a.SendPacket(m)
+	}
+}
+
+func checkReceived(t *testing.T, rxChan chan ([]byte), packets [][]byte) {
+	for i, m := range packets {
+		select {
+		case rx := <-rxChan:
+			if !bytes.Equal(rx, m) {
+				t.Errorf("Packet %d was received out of order", i)
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("Packet %d was not received", i)
+			return
+		}
+	}
+}
+
+func TestLossyLink(t *testing.T) {
+	p1, p2 := bidirpipe.CreateBidirPipe()
+
+	a1, rx1, done1 := createARQ(t, p1)
+	a2, rx2, done2 := createARQ(t, p2)
+
+	var packets1, packets2 [][]byte
+	for i := 0; i < 300; i++ {
+		packets1 = append(packets1, testutil.RandomBytes(1+rand.Intn(128)))
+		packets2 = append(packets2, testutil.RandomBytes(1+rand.Intn(128)))
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go sendAll(a1, packets1, &wg)
+	go sendAll(a2, packets2, &wg)
+
+	checkReceived(t, rx2, packets1)
+	checkReceived(t, rx1, packets2)
+	wg.Wait()
+
+	stats := a1.GetARQStats()
+	if stats.PacketsSent != 300 || stats.PacketsDelivered != 300 {
+		t.Error("Packet counters are wrong", stats.PacketsSent, stats.PacketsDelivered)
+	}
+	if stats.Retransmissions == 0 {
+		t.Error("Lossy link did not cause retransmissions")
+	}
+	if stats.RTO < 10*time.Millisecond {
+		t.Error("RTO is below minimum")
+	}
+
+	a1.Close()
+	a2.Close()
+	p1.Close()
+	p2.Close()
+	<-done1
+	<-done2
+
+	if _, err := a1.SendPacket([]byte{1}); err != ErrorClosed {
+		t.Error("Wrong error after closing", err)
+	}
+}
+
+func TestLinkFailed(t *testing.T) {
+	/* The link drops everything and the port is never closed */
+	p1, p2 := bidirpipe.CreateBidirPipe()
+	defer p1.Close()
+	defer p2.Close()
+
+	framer, _ := hdlc.NewHDLCFramer(&lossyPort{ReadWriteCloser: p1, lossRate: 1}, nil)
+	a := NewARQ(framer, &Config{
+		InitialRTO: 5 * time.Millisecond,
+		MinRTO:     5 * time.Millisecond,
+		MaxRTO:     10 * time.Millisecond,
+		MaxRetries: 3,
+	})
+
+	done := make(chan (error), 1)
+	go func() {
+		done <- a.Run(func(payload []byte, metadata *framerinterface.PacketMetadata) error {
+			return nil
+		})
+	}()
+
+	a.SendPacket([]byte{1, 2, 3})
+
+	select {
+	case err := <-done:
+		if err != ErrorLinkFailed {
+			t.Error("Run returned wrong error", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Run did not return after link failure")
+	}
+
+	if _, err := a.SendPacket([]byte{1}); err != ErrorLinkFailed {
+		t.Error("Wrong error after link failure", err)
+	}
+}
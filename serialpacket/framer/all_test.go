@@ -1,22 +1,102 @@
 package framer
 
 import (
+	"io"
+	"net"
 	"testing"
+	"time"
 
+	"github.com/BertoldVdb/go-misc/multicrc"
+	"github.com/BertoldVdb/go-misc/multirun"
+	"github.com/BertoldVdb/go-misc/serialpacket/framer/framerinterface"
 	"github.com/BertoldVdb/go-misc/serialpacket/framer/testutil"
 )
 
 func testType(t *testing.T, ft string) {
-	framer, err := NewFramer(ft, nil, nil)
+	/* The legacy framer has no delimiter and a CRC-8 by default, so the random garbage sent by the test
+	 * would sometimes form a valid frame that hides the real packet */
+	var options *framerinterface.FramerOptions
+	if ft == "LEGACY" {
+		options = options.Set(framerinterface.OptionCRCParam, multicrc.Crc32MPEG2)
+	}
+
+	framer, err := NewFramer(ft, nil, options)
 	if err != nil {
 		t.Errorf("Undesired error returned: %s", err)
 		return
 	}
 	testutil.FramerRunTests(t, framer)
+
+	testRunnable(t, ft)
+}
+
+func testRunnable(t *testing.T, ft string) {
+	/* net.Pipe supports read deadlines, so the receiver can be interrupted */
+	port, remote := net.Pipe()
+	defer port.Close()
+	defer remote.Close()
+
+	framer, _ := NewFramer(ft, port, nil)
+	runnable := NewRunnable(framer.(framerinterface.FramerContext), func(payload []byte, metadata *framerinterface.PacketMetadata) error {
+		return nil
+	})
+
+	var mr multirun.MultiRun
+	mr.RegisterRunnableReady(runnable)
+
+	readyChan := make(chan (struct{}))
+	done := make(chan (error), 1)
+	go func() {
+		done <- mr.Run(func() {
+			close(readyChan)
+		})
+	}()
+
+	select {
+	case <-readyChan:
+	case <-time.After(time.Second):
+		t.Fatal("Framer did not become ready")
+	}
+
+	/* Send the start of a frame that will never be completed */
+	remote.Write([]byte{0xC0, 0x7E, 0x00, 'B', 0x05, 'a', 'b', 0xAA, 0x55, 0x05})
+
+	mr.Close()
+	select {
+	case err := <-done:
+		if err != multirun.ErrorClosed {
+			t.Error("Wrong error returned", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Framer did not stop")
+	}
+
+	if framer.GetStats().FramesReceivedIncomplete != 1 {
+		t.Error("Partial frame was not counted", ft)
+	}
+
+	/* The port must still be usable */
+	go remote.Read(make([]byte, 512))
+	if _, err := framer.SendPacket([]byte{1, 2, 3}); err != nil {
+		t.Error("Port was closed", err)
+	}
 }
 
 func TestAll(t *testing.T) {
-	testType(t, "hdlc")
+	for _, ft := range Types() {
+		testType(t, ft)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	for _, ft := range Types() {
+		ft := ft
+		t.Run(ft, func(t *testing.T) {
+			testutil.FramerConformance(t, func(port io.ReadWriter, options *framerinterface.FramerOptions) (framerinterface.Framer, error) {
+				return NewFramer(ft, port, options)
+			})
+		})
+	}
 }
 
 func TestBadType(t *testing.T) {
@@ -28,3 +108,22 @@ func TestBadType(t *testing.T) {
 		t.Error("Invalid error returned")
 	}
 }
+
+func TestFromConfig(t *testing.T) {
+	size := 1
+	framer, err := NewFramerFromConfig(nil, &framerinterface.FramerConfig{Type: "lengthprefix", CRC: "Crc16MODBUS", LengthFieldSize: &size})
+	if err != nil || framer == nil {
+		t.Error("Valid config rejected", err)
+	}
+
+	if _, err := NewFramerFromConfig(nil, &framerinterface.FramerConfig{Type: "hdlc", CRC: "Crc99"}); err == nil {
+		t.Error("Invalid config accepted")
+	}
+
+	/* Options with the wrong type must return an error instead of panicking */
+	for _, ft := range Types() {
+		if _, err := NewFramer(ft, nil, framerinterface.DefaultFramerOptions().Set(framerinterface.OptionMaxPacketLen, "256")); err == nil {
+			t.Error("Wrong option type accepted", ft)
+		}
+	}
+}
@@ -0,0 +1,333 @@
+package cobs
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/BertoldVdb/go-misc/multicrc"
+	"github.com/BertoldVdb/go-misc/serialpacket/framer/framerinterface"
+)
+
+// COBS is a packet framer that implements Consistent Overhead Byte Stuffing. When reduced is set
+// the COBS/R variant is used, which often saves the final length byte.
+type COBS struct {
+	port         io.ReadWriter
+	maxPacketLen int
+	reduced      bool
+
+	sendBuffer struct {
+		sync.Mutex
+		raw  []byte
+		data bytes.Buffer
+		crc  *multicrc.CRC
+	}
+
+	stats framerinterface.BaseStats
+
+	crcParams *multicrc.Params
+
+	frameDelimiter byte
+
+	monitor framerinterface.FrameMonitor
+}
+
+// NewCOBSFramer is used to create a COBS framer
+func NewCOBSFramer(port io.ReadWriter, options *framerinterface.FramerOptions) (*COBS, error) {
+	return newFramer(port, options, false)
+}
+
+// NewCOBSRFramer is used to create a COBS/R framer
+func NewCOBSRFramer(port io.ReadWriter, options *framerinterface.FramerOptions) (*COBS, error) {
+	return newFramer(port, options, true)
+}
+
+func newFramer(port io.ReadWriter, options *framerinterface.FramerOptions, reduced bool) (*COBS, error) {
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+
+	s := &COBS{
+		port:           port,
+		reduced:        reduced,
+		crcParams:      options.GetDefault(framerinterface.OptionCRCParam, multicrc.CrcNone).(*multicrc.Params),
+		maxPacketLen:   options.GetInt(framerinterface.OptionMaxPacketLen, 256),
+		frameDelimiter: byte(options.GetInt(framerinterface.OptionByteFrameEnd, 0x00)),
+	}
+
+	/* Create CRC module for sender */
+	s.sendBuffer.crc = multicrc.NewCRC(s.crcParams)
+
+	return s, nil
+}
+
+/* encode writes the COBS encoded version of src to dst. The delimiter is XORed into every
+ * output byte so that a non-zero delimiter can be used */
+func encode(dst *bytes.Buffer, src []byte, reduced bool, delimiter byte) {
+	codeIndex := dst.Len()
+	code := byte(1)
+	dst.WriteByte(0)
+
+	finishBlock := func() {
+		dst.Bytes()[codeIndex] = code ^ delimiter
+	}
+
+	nextBlock := func() {
+		finishBlock()
+		codeIndex = dst.Len()
+		code = 1
+		dst.WriteByte(0)
+	}
+
+	for _, m := range src {
+		/* A block of maximum length does not imply a zero, only start a new one if there is more data */
+		if code == 0xFF {
+			nextBlock()
+		}
+
+		if m == 0 {
+			nextBlock()
+			continue
+		}
+
+		dst.WriteByte(m ^ delimiter)
+		code++
+	}
+
+	if reduced && code > 1 {
+		/* COBS/R: The last data byte replaces the length code if this is unambiguous */
+		last := dst.Bytes()[dst.Len()-1] ^ delimiter
+		if last >= code {
+			dst.Truncate(dst.Len() - 1)
+			code = last
+		}
+	}
+
+	finishBlock()
+}
+
+// SendPacket is used to send a packet to the port using COBS framing
+func (s *COBS) SendPacket(payload []byte) (int64, error) {
+	s.sendBuffer.Lock()
+	defer s.sendBuffer.Unlock()
+	defer s.sendBuffer.data.Reset()
+
+	var crcBuf [8]byte
+	s.sendBuffer.raw = append(s.sendBuffer.raw[:0], payload...)
+	s.sendBuffer.raw = append(s.sendBuffer.raw, s.sendBuffer.crc.Reset().AddBytes(payload).ResultBytes(crcBuf[:], false)...)
+
+	s.sendBuffer.data.WriteByte(s.frameDelimiter)
+	encode(&s.sendBuffer.data, s.sendBuffer.raw, s.reduced, s.frameDelimiter)
+	s.sendBuffer.data.WriteByte(s.frameDelimiter)
+
+	n, err := s.sendBuffer.data.WriteTo(s.port)
+
+	if n > 0 {
+		nu := uint64(n)
+		iu := uint64(len(payload))
+		if iu > nu {
+			iu = nu
+		}
+
+		atomic.AddUint64(&s.stats.FramesSent, 1)
+		atomic.AddUint64(&s.stats.BytesSent, iu)
+		atomic.AddUint64(&s.stats.BytesSentEscaped, nu)
+	}
+
+	return n, err
+}
+
+// SetPort can be used to change the port used by the framer. It may not be executed concurrently
+// with Run
+func (s *COBS) SetPort(port io.ReadWriter) error {
+	s.sendBuffer.Lock()
+	defer s.sendBuffer.Unlock()
+
+	s.port = port
+
+	return nil
+}
+
+// SetMonitor sets a function that is called for every received frame that is dropped. It may not be
+// executed concurrently with Run
+func (s *COBS) SetMonitor(monitor framerinterface.FrameMonitor) {
+	s.monitor = monitor
+}
+
+func (s *COBS) monitorFrame(frame []byte, status framerinterface.FrameStatus, metadata *framerinterface.PacketMetadata) {
+	if s.monitor != nil {
+		metadata.Status = status
+		s.monitor(frame, status, metadata)
+	}
+}
+
+// Run should be called to start the receiver process. It will only return
+// on read errors (eg, port closed)
+func (s *COBS) Run(receivedPacket framerinterface.FramerReceivedPacketHandler) error {
+	return s.RunContext(context.Background(), nil, receivedPacket)
+}
+
+// RunContext is like Run, but it also returns when ctx is cancelled. A partially received frame is
+// counted in FramesReceivedIncomplete. Ready is called when the receiver has started.
+func (s *COBS) RunContext(ctx context.Context, ready func(), receivedPacket framerinterface.FramerReceivedPacketHandler) error {
+	var tmpBuf [512]byte
+	var rxBuffer bytes.Buffer
+
+	isValid := true
+	isOversized := false
+	isFirst := true
+	escapedLen := 0
+
+	/* blockCode is the length code of the current block, 0 if no block was started */
+	blockCode := byte(0)
+	blockRemaining := 0
+
+	reset := func() {
+		isValid = true
+		isOversized = false
+		isFirst = true
+		escapedLen = 0
+		blockCode = 0
+		blockRemaining = 0
+
+		rxBuffer.Reset()
+	}
+
+	var firstByteTimestamp time.Time
+	var lastFrameEnd time.Time
+
+	crc := multicrc.NewCRC(s.crcParams)
+
+	defer framerinterface.WatchContext(ctx, s.port)()
+
+	if ready != nil {
+		ready()
+	}
+
+	for {
+		n, err := s.port.Read(tmpBuf[:])
+		now := time.Now()
+
+		for _, m := range tmpBuf[:n] {
+			atomic.AddUint64(&s.stats.BytesReceivedEscaped, 1)
+			escapedLen++
+
+			if isFirst {
+				firstByteTimestamp = now
+				isFirst = false
+			}
+
+			if m == s.frameDelimiter {
+				if blockRemaining > 0 {
+					if s.reduced {
+						/* COBS/R: The length code was the last data byte */
+						if isValid {
+							rxBuffer.WriteByte(blockCode)
+						}
+					} else {
+						isValid = false
+					}
+				}
+
+				if isValid && s.maxPacketLen > 0 && rxBuffer.Len() > s.maxPacketLen {
+					atomic.AddUint64(&s.stats.FramesReceivedOversized, 1)
+					isValid = false
+					isOversized = true
+				}
+
+				if rxBuffer.Len() > 0 {
+					atomic.AddUint64(&s.stats.BytesReceived, uint64(rxBuffer.Len()))
+
+					frame := rxBuffer.Bytes()
+					pkt := framerinterface.PacketMetadata{
+						RxTime:        firstByteTimestamp,
+						RxTimeEnd:     now,
+						LengthEscaped: escapedLen,
+					}
+					if !lastFrameEnd.IsZero() {
+						pkt.Gap = firstByteTimestamp.Sub(lastFrameEnd)
+					}
+					lastFrameEnd = now
+
+					if isValid {
+						atomic.AddUint64(&s.stats.FramesReceivedValid, 1)
+
+						if len(frame) < crc.ResultLenBytes() {
+							atomic.AddUint64(&s.stats.FramesReceivedWrongChecksum, 1)
+							s.monitorFrame(frame, framerinterface.FrameWrongChecksum, &pkt)
+						} else {
+							crcIndex := len(frame) - crc.ResultLenBytes()
+							pkt.CRC = framerinterface.CRCValue(frame[crcIndex:], false)
+
+							var crcCalcBuf [8]byte
+							if bytes.Equal(crc.Reset().AddBytes(frame[:crcIndex]).ResultBytes(crcCalcBuf[:], false), frame[crcIndex:]) {
+								err := receivedPacket(frame[:crcIndex], &pkt)
+								if err != nil {
+									return err
+								}
+							} else {
+								atomic.AddUint64(&s.stats.FramesReceivedWrongChecksum, 1)
+								s.monitorFrame(frame, framerinterface.FrameWrongChecksum, &pkt)
+							}
+						}
+					} else if isOversized {
+						s.monitorFrame(frame, framerinterface.FrameOversized, &pkt)
+					} else {
+						atomic.AddUint64(&s.stats.FramesReceivedInvalid, 1)
+						s.monitorFrame(frame, framerinterface.FrameInvalid, &pkt)
+					}
+				} else if isValid {
+					atomic.AddUint64(&s.stats.FramesReceivedZeroLength, 1)
+				}
+
+				reset()
+				continue
+			}
+
+			v := m ^ s.frameDelimiter
+
+			if blockRemaining == 0 {
+				/* Every block except one of maximum length implies a zero byte before the next block */
+				if blockCode != 0 && blockCode != 0xFF && isValid {
+					rxBuffer.WriteByte(0)
+				}
+
+				blockCode = v
+				blockRemaining = int(v) - 1
+
+			} else {
+				blockRemaining--
+
+				if isValid {
+					rxBuffer.WriteByte(v)
+				}
+			}
+
+			if isValid && s.maxPacketLen > 0 && rxBuffer.Len() > s.maxPacketLen {
+				atomic.AddUint64(&s.stats.FramesReceivedOversized, 1)
+				isValid = false
+				isOversized = true
+			}
+		}
+
+		if ctx.Err() != nil {
+			if rxBuffer.Len() > 0 {
+				atomic.AddUint64(&s.stats.BytesReceived, uint64(rxBuffer.Len()))
+				atomic.AddUint64(&s.stats.FramesReceivedIncomplete, 1)
+			}
+			return ctx.Err()
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// GetStats returns a safely accessed snapshot of the statistics
+func (s *COBS) GetStats() framerinterface.BaseStats {
+	return s.stats.CopyBaseStatsAtomic()
+}
@@ -0,0 +1,69 @@
+package cobs
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/BertoldVdb/go-misc/multicrc"
+	"github.com/BertoldVdb/go-misc/serialpacket/framer/framerinterface"
+
+	"github.com/BertoldVdb/go-misc/serialpacket/framer/testutil"
+)
+
+func testWithOptions(t *testing.T, options *framerinterface.FramerOptions, reduced bool) {
+	/* Use testutil to run the test */
+	framer, err := newFramer(nil, options, reduced)
+	if err != nil {
+		t.Error(err)
+	} else {
+		testutil.FramerRunTests(t, framer)
+	}
+}
+
+func TestCOBS(t *testing.T) {
+	for _, reduced := range []bool{false, true} {
+		testWithOptions(t, nil, reduced)
+		testWithOptions(t, framerinterface.DefaultFramerOptions().Set(framerinterface.OptionCRCParam, multicrc.Crc32MPEG2), reduced)
+		testWithOptions(t, framerinterface.DefaultFramerOptions().Set(framerinterface.OptionByteFrameEnd, 0x7E), reduced)
+	}
+}
+
+func sequence(from int, to int) []byte {
+	var result []byte
+	for i := from; i <= to; i++ {
+		result = append(result, byte(i))
+	}
+	return result
+}
+
+func TestEncode(t *testing.T) {
+	vectors := []struct {
+		input   []byte
+		cobs    []byte
+		reduced []byte
+	}{
+		{[]byte{0x00}, []byte{0x01, 0x01}, []byte{0x01, 0x01}},
+		{[]byte{0x00, 0x11, 0x00}, []byte{0x01, 0x02, 0x11, 0x01}, []byte{0x01, 0x02, 0x11, 0x01}},
+		{[]byte{0x11, 0x22, 0x00, 0x33}, []byte{0x03, 0x11, 0x22, 0x02, 0x33}, []byte{0x03, 0x11, 0x22, 0x33}},
+		{[]byte{0x11, 0x00, 0x00, 0x00}, []byte{0x02, 0x11, 0x01, 0x01, 0x01}, []byte{0x02, 0x11, 0x01, 0x01, 0x01}},
+		{[]byte{0x2F, 0xA2, 0x00, 0x92, 0x73, 0x02}, []byte{0x03, 0x2F, 0xA2, 0x04, 0x92, 0x73, 0x02}, []byte{0x03, 0x2F, 0xA2, 0x04, 0x92, 0x73, 0x02}},
+		{[]byte{0x2F, 0xA2, 0x00, 0x92, 0x73, 0x26}, []byte{0x03, 0x2F, 0xA2, 0x04, 0x92, 0x73, 0x26}, []byte{0x03, 0x2F, 0xA2, 0x26, 0x92, 0x73}},
+		{sequence(0x01, 0xFE), append([]byte{0xFF}, sequence(0x01, 0xFE)...), append([]byte{0xFF}, sequence(0x01, 0xFE)...)},
+		{sequence(0x01, 0xFF), append(append([]byte{0xFF}, sequence(0x01, 0xFE)...), 0x02, 0xFF), append(append([]byte{0xFF}, sequence(0x01, 0xFE)...), 0xFF)},
+	}
+
+	for i, m := range vectors {
+		var buf bytes.Buffer
+
+		encode(&buf, m.input, false, 0)
+		if !bytes.Equal(buf.Bytes(), m.cobs) {
+			t.Errorf("Vector %d: COBS result is wrong: %x", i, buf.Bytes())
+		}
+
+		buf.Reset()
+		encode(&buf, m.input, true, 0)
+		if !bytes.Equal(buf.Bytes(), m.reduced) {
+			t.Errorf("Vector %d: COBS/R result is wrong: %x", i, buf.Bytes())
+		}
+	}
+}
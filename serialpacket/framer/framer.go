@@ -5,8 +5,12 @@ import (
 	"io"
 	"strings"
 
+	"github.com/BertoldVdb/go-misc/serialpacket/framer/cobs"
 	"github.com/BertoldVdb/go-misc/serialpacket/framer/framerinterface"
 	"github.com/BertoldVdb/go-misc/serialpacket/framer/hdlc"
+	"github.com/BertoldVdb/go-misc/serialpacket/framer/legacy"
+	"github.com/BertoldVdb/go-misc/serialpacket/framer/lengthprefix"
+	"github.com/BertoldVdb/go-misc/serialpacket/framer/slip"
 )
 
 var (
@@ -14,13 +18,39 @@ var (
 	ErrorUnknown = errors.New("Framer type is not supported")
 )
 
+// Types returns the framer types supported by NewFramer
+func Types() []string {
+	return []string{"HDLC", "COBS", "COBSR", "SLIP", "LENGTHPREFIX", "LEGACY"}
+}
+
 // NewFramer creates a framer with the specified type and options. You need to pass the io.ReadWriter that will be used to transfer data.
-// Current supported types are: HDLC
+// Current supported types are: HDLC, COBS, COBSR, SLIP, LENGTHPREFIX, LEGACY
 func NewFramer(framerType string, port io.ReadWriter, options *framerinterface.FramerOptions) (framerinterface.Framer, error) {
 	switch strings.ToUpper(framerType) {
 	case "HDLC":
 		return hdlc.NewHDLCFramer(port, options)
+	case "COBS":
+		return cobs.NewCOBSFramer(port, options)
+	case "COBSR":
+		return cobs.NewCOBSRFramer(port, options)
+	case "SLIP":
+		return slip.NewSLIPFramer(port, options)
+	case "LENGTHPREFIX":
+		return lengthprefix.NewLengthPrefixFramer(port, options)
+	case "LEGACY":
+		return legacy.NewLegacyFramer(port, options)
 	default:
 		return nil, ErrorUnknown
 	}
 }
+
+// NewFramerFromConfig creates a framer from a configuration, eg. loaded from a JSON or YAML file. The
+// configuration is validated first.
+func NewFramerFromConfig(port io.ReadWriter, config *framerinterface.FramerConfig) (framerinterface.Framer, error) {
+	options, err := config.Options()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewFramer(config.Type, port, options)
+}
@@ -0,0 +1,328 @@
+package framerinterface
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/BertoldVdb/go-misc/multicrc"
+)
+
+// ByteRange is an inclusive range of byte values
+type ByteRange struct {
+	First byte
+	Last  byte
+}
+
+// ByteRanges is a set of byte values. It is stored as text, eg "0x00-0x1F,0x7F".
+type ByteRanges []ByteRange
+
+// ByteRangesFromMap converts a map as used by OptionRxIgnore and OptionTxEscape to the smallest list of ranges
+func ByteRangesFromMap(m [256]bool) ByteRanges {
+	result := ByteRanges{}
+
+	for i := 0; i < len(m); i++ {
+		if !m[i] {
+			continue
+		}
+
+		start := i
+		for i+1 < len(m) && m[i+1] {
+			i++
+		}
+		result = append(result, ByteRange{First: byte(start), Last: byte(i)})
+	}
+
+	return result
+}
+
+// Map converts the ranges to a map as used by OptionRxIgnore and OptionTxEscape
+func (r ByteRanges) Map() [256]bool {
+	var result [256]bool
+
+	for _, m := range r {
+		for i := int(m.First); i <= int(m.Last); i++ {
+			result[i] = true
+		}
+	}
+
+	return result
+}
+
+// MarshalText converts the ranges to text
+func (r ByteRanges) MarshalText() ([]byte, error) {
+	parts := make([]string, len(r))
+
+	for i, m := range r {
+		if m.First == m.Last {
+			parts[i] = fmt.Sprintf("0x%02X", m.First)
+		} else {
+			parts[i] = fmt.Sprintf("0x%02X-0x%02X", m.First, m.Last)
+		}
+	}
+
+	return []byte(strings.Join(parts, ",")), nil
+}
+
+func parseByte(s string) (byte, error) {
+	value, err := strconv.ParseUint(strings.TrimSpace(s), 0, 8)
+	return byte(value), err
+}
+
+// UnmarshalText parses ranges in the format produced by MarshalText. Decimal values are also accepted.
+func (r *ByteRanges) UnmarshalText(text []byte) error {
+	result := ByteRanges{}
+
+	for _, part := range strings.Split(string(text), ",") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+
+		first, last, isRange := strings.Cut(part, "-")
+
+		var m ByteRange
+		var err error
+		if m.First, err = parseByte(first); err != nil {
+			return fmt.Errorf("Invalid byte range '%s': %w", part, err)
+		}
+		m.Last = m.First
+
+		if isRange {
+			if m.Last, err = parseByte(last); err != nil {
+				return fmt.Errorf("Invalid byte range '%s': %w", part, err)
+			}
+			if m.Last < m.First {
+				return fmt.Errorf("Invalid byte range '%s': end is before start", part)
+			}
+		}
+
+		result = append(result, m)
+	}
+
+	*r = result
+	return nil
+}
+
+// HexBytes is a byte slice that is stored as a hexadecimal string
+type HexBytes []byte
+
+// MarshalText converts the bytes to a hexadecimal string
+func (h HexBytes) MarshalText() ([]byte, error) {
+	return []byte(strings.ToUpper(hex.EncodeToString(h))), nil
+}
+
+// UnmarshalText parses a hexadecimal string. Spaces are ignored.
+func (h *HexBytes) UnmarshalText(text []byte) error {
+	result, err := hex.DecodeString(strings.ReplaceAll(string(text), " ", ""))
+	if err != nil {
+		return err
+	}
+
+	*h = result
+	return nil
+}
+
+// FramerConfig is a typed version of FramerOptions that can be stored in JSON or YAML files. Fields that
+// are not set use the default of the framer. CRCs are named using multicrc.ParamsByName.
+type FramerConfig struct {
+	// Type is the framer type passed to framer.NewFramer
+	Type string `json:"type,omitempty" yaml:"type,omitempty"`
+
+	CRC       string `json:"crc,omitempty" yaml:"crc,omitempty"`
+	HeaderCRC string `json:"headerCrc,omitempty" yaml:"headerCrc,omitempty"`
+
+	MaxPacketLen *int `json:"maxPacketLen,omitempty" yaml:"maxPacketLen,omitempty"`
+
+	SyncPattern     HexBytes `json:"syncPattern,omitempty" yaml:"syncPattern,omitempty"`
+	LengthFieldSize *int     `json:"lengthFieldSize,omitempty" yaml:"lengthFieldSize,omitempty"`
+	BigEndian       *bool    `json:"bigEndian,omitempty" yaml:"bigEndian,omitempty"`
+
+	FrameStart      *uint8 `json:"frameStart,omitempty" yaml:"frameStart,omitempty"`
+	FrameEnd        *uint8 `json:"frameEnd,omitempty" yaml:"frameEnd,omitempty"`
+	Escape          *uint8 `json:"escape,omitempty" yaml:"escape,omitempty"`
+	EscapeXOR       *uint8 `json:"escapeXor,omitempty" yaml:"escapeXor,omitempty"`
+	EscapedFrameEnd *uint8 `json:"escapedFrameEnd,omitempty" yaml:"escapedFrameEnd,omitempty"`
+	EscapedEscape   *uint8 `json:"escapedEscape,omitempty" yaml:"escapedEscape,omitempty"`
+
+	RxIgnore     *ByteRanges `json:"rxIgnore,omitempty" yaml:"rxIgnore,omitempty"`
+	TxEscape     *ByteRanges `json:"txEscape,omitempty" yaml:"txEscape,omitempty"`
+	TxRxAreEqual *bool       `json:"txRxAreEqual,omitempty" yaml:"txRxAreEqual,omitempty"`
+
+	DeliverInvalid *bool `json:"deliverInvalid,omitempty" yaml:"deliverInvalid,omitempty"`
+	Addressed      *bool `json:"addressed,omitempty" yaml:"addressed,omitempty"`
+}
+
+func crcByName(field string, name string) (*multicrc.Params, error) {
+	params, ok := multicrc.ParamsByName(name)
+	if !ok {
+		return nil, fmt.Errorf("%s: Unknown CRC '%s'", field, name)
+	}
+	return params, nil
+}
+
+// Options validates the configuration and converts it to FramerOptions
+func (c *FramerConfig) Options() (*FramerOptions, error) {
+	o := DefaultFramerOptions()
+
+	if c.CRC != "" {
+		params, err := crcByName("crc", c.CRC)
+		if err != nil {
+			return nil, err
+		}
+		o = o.Set(OptionCRCParam, params)
+	}
+
+	if c.HeaderCRC != "" {
+		params, err := crcByName("headerCrc", c.HeaderCRC)
+		if err != nil {
+			return nil, err
+		}
+		o = o.Set(OptionHeaderCRCParam, params)
+	}
+
+	if c.MaxPacketLen != nil {
+		o = o.Set(OptionMaxPacketLen, *c.MaxPacketLen)
+	}
+
+	if c.SyncPattern != nil {
+		if len(c.SyncPattern) == 0 {
+			return nil, fmt.Errorf("syncPattern: Sync pattern may not be empty")
+		}
+		o = o.Set(OptionSyncPattern, []byte(c.SyncPattern))
+	}
+
+	if c.LengthFieldSize != nil {
+		o = o.Set(OptionLengthFieldSize, *c.LengthFieldSize)
+	}
+
+	if c.BigEndian != nil {
+		o = o.Set(OptionLengthBigEndian, *c.BigEndian)
+	}
+
+	for _, m := range []struct {
+		option FramerOption
+		value  *uint8
+	}{
+		{OptionByteFrameStart, c.FrameStart},
+		{OptionByteFrameEnd, c.FrameEnd},
+		{OptionByteEscape, c.Escape},
+		{OptionByteEscapeXOR, c.EscapeXOR},
+		{OptionByteEscapedFrameEnd, c.EscapedFrameEnd},
+		{OptionByteEscapedEscape, c.EscapedEscape},
+	} {
+		if m.value != nil {
+			o = o.Set(m.option, int(*m.value))
+		}
+	}
+
+	if c.RxIgnore != nil {
+		o = o.Set(OptionRxIgnore, c.RxIgnore.Map())
+	}
+
+	if c.TxEscape != nil {
+		o = o.Set(OptionTxEscape, c.TxEscape.Map())
+	}
+
+	if c.TxRxAreEqual != nil {
+		o = o.Set(OptionTxRxAreEqual, *c.TxRxAreEqual)
+	}
+
+	if c.DeliverInvalid != nil {
+		o = o.Set(OptionDeliverInvalid, *c.DeliverInvalid)
+	}
+
+	if c.Addressed != nil {
+		o = o.Set(OptionAddressed, *c.Addressed)
+	}
+
+	return o, o.Validate()
+}
+
+// Config converts the options to a FramerConfig. An error is returned if an option has the wrong type or
+// uses a CRC that is not predefined in multicrc.
+func (o *FramerOptions) Config() (*FramerConfig, error) {
+	if err := o.Validate(); err != nil {
+		return nil, err
+	}
+
+	c := &FramerConfig{}
+	if o == nil {
+		return c, nil
+	}
+
+	for option, value := range o.configMap {
+		switch option {
+		case OptionCRCParam, OptionHeaderCRCParam:
+			params := value.(*multicrc.Params)
+			if found, ok := multicrc.ParamsByName(params.Name); !ok || found != params {
+				return nil, fmt.Errorf("%s: CRC '%s' is not predefined", option, params.Name)
+			}
+
+			if option == OptionCRCParam {
+				c.CRC = params.Name
+			} else {
+				c.HeaderCRC = params.Name
+			}
+
+		case OptionMaxPacketLen:
+			v := value.(int)
+			c.MaxPacketLen = &v
+
+		case OptionSyncPattern:
+			c.SyncPattern = append(HexBytes(nil), value.([]byte)...)
+
+		case OptionLengthFieldSize:
+			v := value.(int)
+			c.LengthFieldSize = &v
+
+		case OptionLengthBigEndian:
+			v := value.(bool)
+			c.BigEndian = &v
+
+		case OptionTxRxAreEqual:
+			v := value.(bool)
+			c.TxRxAreEqual = &v
+
+		case OptionDeliverInvalid:
+			v := value.(bool)
+			c.DeliverInvalid = &v
+
+		case OptionAddressed:
+			v := value.(bool)
+			c.Addressed = &v
+
+		case OptionRxIgnore:
+			v := ByteRangesFromMap(value.([256]bool))
+			c.RxIgnore = &v
+
+		case OptionTxEscape:
+			v := ByteRangesFromMap(value.([256]bool))
+			c.TxEscape = &v
+
+		case OptionByteFrameStart, OptionByteFrameEnd, OptionByteEscape, OptionByteEscapeXOR,
+			OptionByteEscapedFrameEnd, OptionByteEscapedEscape:
+			v := uint8(value.(int))
+
+			switch option {
+			case OptionByteFrameStart:
+				c.FrameStart = &v
+			case OptionByteFrameEnd:
+				c.FrameEnd = &v
+			case OptionByteEscape:
+				c.Escape = &v
+			case OptionByteEscapeXOR:
+				c.EscapeXOR = &v
+			case OptionByteEscapedFrameEnd:
+				c.EscapedFrameEnd = &v
+			default:
+				c.EscapedEscape = &v
+			}
+
+		default:
+			return nil, fmt.Errorf("%s: Option cannot be stored", option)
+		}
+	}
+
+	return c, nil
+}
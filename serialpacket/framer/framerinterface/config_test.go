@@ -0,0 +1,133 @@
+package framerinterface
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/BertoldVdb/go-misc/multicrc"
+)
+
+func TestByteRanges(t *testing.T) {
+	var m [256]bool
+	for i := 0; i < 0x20; i++ {
+		m[i] = true
+	}
+	m[0x7F] = true
+	m[0xFF] = true
+
+	ranges := ByteRangesFromMap(m)
+	text, _ := ranges.MarshalText()
+	if string(text) != "0x00-0x1F,0x7F,0xFF" {
+		t.Error("Wrong text", string(text))
+	}
+
+	var parsed ByteRanges
+	if err := parsed.UnmarshalText([]byte("0-31, 0x7F,0xFF")); err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Map() != m {
+		t.Error("Parsed ranges are wrong")
+	}
+
+	for _, invalid := range []string{"0x20-0x10", "0x100", "a-b", "1-2-3"} {
+		if parsed.UnmarshalText([]byte(invalid)) == nil {
+			t.Error("Invalid range accepted", invalid)
+		}
+	}
+}
+
+func TestConfigJSON(t *testing.T) {
+	input := `{
+		"type": "hdlc",
+		"crc": "Crc16CCITT_FALSE",
+		"maxPacketLen": 512,
+		"syncPattern": "AA 55",
+		"frameEnd": 126,
+		"rxIgnore": "0x00-0x1F",
+		"txEscape": "0x00-0x1F,0x7E"
+	}`
+
+	var config FramerConfig
+	if err := json.Unmarshal([]byte(input), &config); err != nil {
+		t.Fatal(err)
+	}
+
+	options, err := config.Options()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if options.GetDefault(OptionCRCParam, nil) != multicrc.Crc16CCITTFALSE {
+		t.Error("CRC is wrong")
+	}
+	if options.GetInt(OptionMaxPacketLen, 0) != 512 || options.GetInt(OptionByteFrameEnd, 0) != 0x7E {
+		t.Error("Integer options are wrong")
+	}
+	if !bytes.Equal(options.GetDefault(OptionSyncPattern, nil).([]byte), []byte{0xAA, 0x55}) {
+		t.Error("Sync pattern is wrong")
+	}
+	if ignore := options.GetDefault(OptionRxIgnore, nil).([256]bool); !ignore[0x1F] || ignore[0x20] {
+		t.Error("RxIgnore is wrong")
+	}
+
+	/* Converting back must give the same config */
+	back, err := options.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	back.Type = config.Type
+	if !reflect.DeepEqual(back, &config) {
+		t.Error("Config did not survive round trip")
+	}
+
+	encoded, _ := json.Marshal(back)
+	var decoded FramerConfig
+	json.Unmarshal(encoded, &decoded)
+	if !reflect.DeepEqual(&decoded, back) {
+		t.Error("JSON did not survive round trip", string(encoded))
+	}
+}
+
+func TestConfigInvalid(t *testing.T) {
+	for _, input := range []string{
+		`{"crc": "Crc99"}`,
+		`{"headerCrc": "nope"}`,
+		`{"lengthFieldSize": 3}`,
+		`{"syncPattern": ""}`,
+		`{"syncPattern": "XY"}`,
+		`{"frameEnd": 256}`,
+		`{"rxIgnore": "0x40-0x20"}`,
+	} {
+		var config FramerConfig
+		if json.Unmarshal([]byte(input), &config) != nil {
+			continue
+		}
+		if _, err := config.Options(); err == nil {
+			t.Error("Invalid config accepted", input)
+		}
+	}
+}
+
+func TestOptionsValidate(t *testing.T) {
+	for _, options := range []*FramerOptions{
+		DefaultFramerOptions().Set(OptionMaxPacketLen, "long"),
+		DefaultFramerOptions().Set(OptionCRCParam, "Crc8"),
+		DefaultFramerOptions().Set(OptionByteFrameEnd, 0x100),
+		DefaultFramerOptions().Set(OptionRxIgnore, []byte{1}),
+	} {
+		if options.Validate() == nil {
+			t.Error("Invalid options accepted")
+		}
+	}
+
+	if DefaultFramerOptions().Validate() != nil {
+		t.Error("Default options rejected")
+	}
+
+	custom := DefaultFramerOptions().Set(OptionCRCParam, &multicrc.Params{Len: 8, Name: "Custom"})
+	if _, err := custom.Config(); err == nil {
+		t.Error("Custom CRC cannot be stored by name")
+	}
+}
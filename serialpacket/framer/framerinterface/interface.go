@@ -1,9 +1,14 @@
 package framerinterface
 
 import (
+	"context"
+	"fmt"
 	"io"
 	"sync/atomic"
 	"time"
+
+	"github.com/BertoldVdb/go-misc/multicrc"
+	pdu "github.com/BertoldVdb/go-misc/pdubuf"
 )
 
 // BaseStats contains statistics about the framer operating performance.
@@ -15,6 +20,12 @@ type BaseStats struct {
 	FramesReceivedWrongChecksum uint64
 	FramesReceivedValid         uint64
 
+	// FramesReceivedInvalid counts frames that were not correctly encoded (eg, an escape character before the end of frame)
+	FramesReceivedInvalid uint64
+
+	// FramesReceivedIncomplete counts frames that were partially received when RunContext was cancelled
+	FramesReceivedIncomplete uint64
+
 	FramesSent uint64
 
 	BytesSent        uint64
@@ -28,6 +39,37 @@ type BaseStats struct {
 type PacketMetadata struct {
 	//RxTime is a timestamp when the first byte was received
 	RxTime time.Time
+
+	//RxTimeEnd is a timestamp when the last byte was received
+	RxTimeEnd time.Time
+
+	//Gap is the time between the end of the previous frame and RxTime, zero for the first frame
+	Gap time.Duration
+
+	//LengthEscaped is the amount of bytes the frame occupied on the wire, including overhead such as
+	//escape characters, headers and the closing delimiter
+	LengthEscaped int
+
+	//CRC is the value of the received CRC, zero if the framer does not use a CRC
+	CRC uint64
+
+	//Status is FrameValid, unless OptionDeliverInvalid is used to receive frames that would be dropped
+	Status FrameStatus
+}
+
+// CRCValue converts a received CRC to an integer, so it can be compared with multicrc.CRC.Result64
+func CRCValue(crc []byte, bigEndian bool) uint64 {
+	var result uint64
+
+	for i := range crc {
+		if bigEndian {
+			result = result<<8 | uint64(crc[i])
+		} else {
+			result = result<<8 | uint64(crc[len(crc)-1-i])
+		}
+	}
+
+	return result
 }
 
 // FramerReceivedPacketHandler is the type of callback function invoked when a packet is received
@@ -41,6 +83,85 @@ type Framer interface {
 	Run(receivedPacket FramerReceivedPacketHandler) error
 }
 
+// FramerPDU is implemented by framers that can add the framing in place, using the head- and tailroom of the PDU.
+// The PDU contents are restored when SendPDU returns.
+type FramerPDU interface {
+	Framer
+	SendPDU(p *pdu.PDU) (int64, error)
+}
+
+// FramerContext is implemented by framers that can be stopped without closing the port. RunContext
+// calls ready once the receiver is started and returns ctx.Err() when the context is cancelled.
+// Blocking reads can only be interrupted if the port has a SetReadDeadline method. The read deadline of
+// the port is owned by RunContext, it is cleared when a cancelled RunContext returns.
+type FramerContext interface {
+	Framer
+	RunContext(ctx context.Context, ready func(), receivedPacket FramerReceivedPacketHandler) error
+}
+
+// FrameStatus indicates why a received frame was not delivered to the handler
+type FrameStatus int
+
+const (
+	// FrameValid means the frame was received correctly
+	FrameValid FrameStatus = 0
+
+	// FrameWrongChecksum means the CRC of the frame did not match
+	FrameWrongChecksum FrameStatus = 1
+
+	// FrameOversized means the frame was longer than the maximum packet length. The frame is truncated.
+	FrameOversized FrameStatus = 2
+
+	// FrameInvalid means the frame was not correctly encoded (eg, an escape character before the end of frame)
+	FrameInvalid FrameStatus = 3
+)
+
+// FrameMonitor is called for received frames that are dropped by the framer. The frame contains the
+// unescaped data including the CRC and is only valid during the call.
+type FrameMonitor func(frame []byte, status FrameStatus, metadata *PacketMetadata)
+
+// FramerMonitor is implemented by framers that can report the frames they drop. SetMonitor may not be
+// executed concurrently with Run, a nil monitor disables reporting.
+type FramerMonitor interface {
+	Framer
+	SetMonitor(monitor FrameMonitor)
+}
+
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// WatchContext interrupts blocking reads on port when ctx is cancelled, if the port has a SetReadDeadline
+// method. The returned function must be called when the receiver stops. If the context was cancelled it
+// clears the read deadline, a deadline set by the caller is not restored, so callers must not use read
+// deadlines on a port while a receiver is watching it.
+func WatchContext(ctx context.Context, port io.Reader) func() {
+	deadliner, ok := port.(readDeadliner)
+	if !ok || ctx.Done() == nil {
+		return func() {}
+	}
+
+	stop := make(chan (struct{}))
+	done := make(chan (bool))
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			deadliner.SetReadDeadline(time.Now())
+			done <- true
+		case <-stop:
+			done <- false
+		}
+	}()
+
+	return func() {
+		close(stop)
+		if <-done {
+			deadliner.SetReadDeadline(time.Time{})
+		}
+	}
+}
+
 // CopyBaseStatsAtomic makes a copy of BaseStats using atomic access
 func (s *BaseStats) CopyBaseStatsAtomic() BaseStats {
 	r := BaseStats{
@@ -48,6 +169,8 @@ func (s *BaseStats) CopyBaseStatsAtomic() BaseStats {
 		FramesReceivedZeroLength:    atomic.LoadUint64(&s.FramesReceivedZeroLength),
 		FramesReceivedWrongChecksum: atomic.LoadUint64(&s.FramesReceivedWrongChecksum),
 		FramesReceivedValid:         atomic.LoadUint64(&s.FramesReceivedValid),
+		FramesReceivedInvalid:       atomic.LoadUint64(&s.FramesReceivedInvalid),
+		FramesReceivedIncomplete:    atomic.LoadUint64(&s.FramesReceivedIncomplete),
 		FramesSent:                  atomic.LoadUint64(&s.FramesSent),
 		BytesSent:                   atomic.LoadUint64(&s.BytesSent),
 		BytesSentEscaped:            atomic.LoadUint64(&s.BytesSentEscaped),
@@ -78,6 +201,26 @@ const (
 	// OptionMaxPacketLen contains an integer which specifies the maximum packet length. If <=0 the length is unlimited.
 	OptionMaxPacketLen FramerOption = 0x3
 
+	// OptionHeaderCRCParam contains a *multicrc.Params indicating the CRC type that protects the frame header
+	OptionHeaderCRCParam FramerOption = 0x5
+
+	// OptionSyncPattern contains a []byte that is sent at the start of every frame
+	OptionSyncPattern FramerOption = 0x6
+
+	// OptionLengthFieldSize contains an integer indicating the size of the length field in bytes (1, 2 or 4)
+	OptionLengthFieldSize FramerOption = 0x7
+
+	// OptionLengthBigEndian contains a boolean that is true if multi-byte header fields and CRCs are big endian
+	OptionLengthBigEndian FramerOption = 0x8
+
+	// OptionDeliverInvalid contains a boolean. If true, frames that would be dropped are passed to the receive
+	// handler with PacketMetadata.Status set, the handler must check it. Only the HDLC framer supports this.
+	OptionDeliverInvalid FramerOption = 0x9
+
+	// OptionAddressed contains a boolean. If true, the first byte of every payload is an address that is sent in
+	// the frame header. Only the LEGACY framer supports this.
+	OptionAddressed FramerOption = 0xA
+
 	// OptionByteFrameStart contains a byte indicating the start of frame delimited
 	OptionByteFrameStart FramerOption = 0x100
 
@@ -89,8 +232,42 @@ const (
 
 	// OptionByteEscapeXOR contains a byte indicating the escape XOR value
 	OptionByteEscapeXOR FramerOption = 0x103
+
+	// OptionByteEscapedFrameEnd contains a byte that follows the escape symbol to encode the frame termination symbol
+	OptionByteEscapedFrameEnd FramerOption = 0x104
+
+	// OptionByteEscapedEscape contains a byte that follows the escape symbol to encode the escape symbol
+	OptionByteEscapedEscape FramerOption = 0x105
 )
 
+var optionNames = map[FramerOption]string{
+	OptionRxIgnore:            "rxIgnore",
+	OptionTxEscape:            "txEscape",
+	OptionTxRxAreEqual:        "txRxAreEqual",
+	OptionCRCParam:            "crc",
+	OptionMaxPacketLen:        "maxPacketLen",
+	OptionHeaderCRCParam:      "headerCrc",
+	OptionSyncPattern:         "syncPattern",
+	OptionLengthFieldSize:     "lengthFieldSize",
+	OptionLengthBigEndian:     "bigEndian",
+	OptionDeliverInvalid:      "deliverInvalid",
+	OptionAddressed:           "addressed",
+	OptionByteFrameStart:      "frameStart",
+	OptionByteFrameEnd:        "frameEnd",
+	OptionByteEscape:          "escape",
+	OptionByteEscapeXOR:       "escapeXor",
+	OptionByteEscapedFrameEnd: "escapedFrameEnd",
+	OptionByteEscapedEscape:   "escapedEscape",
+}
+
+// String returns the name of the option as used in FramerConfig
+func (o FramerOption) String() string {
+	if name, ok := optionNames[o]; ok {
+		return name
+	}
+	return fmt.Sprintf("option 0x%x", int(o))
+}
+
 // FramerOptions contains options passed to the framer constructor
 type FramerOptions struct {
 	configMap map[FramerOption]interface{}
@@ -139,11 +316,73 @@ func (o *FramerOptions) GetBool(t FramerOption, defVal bool) bool {
 	return value.(bool)
 }
 
+// Validate checks that all options have the correct type and a valid value. The framer constructors call it
+// so they return an error instead of panicking.
+func (o *FramerOptions) Validate() error {
+	if o == nil {
+		return nil
+	}
+
+	for option, value := range o.configMap {
+		ok := true
+
+		switch option {
+		case OptionRxIgnore, OptionTxEscape:
+			_, ok = value.([256]bool)
+
+		case OptionTxRxAreEqual, OptionLengthBigEndian, OptionDeliverInvalid, OptionAddressed:
+			_, ok = value.(bool)
+
+		case OptionCRCParam, OptionHeaderCRCParam:
+			params, isParams := value.(*multicrc.Params)
+			ok = isParams && params != nil
+
+		case OptionMaxPacketLen:
+			_, ok = value.(int)
+
+		case OptionLengthFieldSize:
+			size, isInt := value.(int)
+			ok = isInt && (size == 1 || size == 2 || size == 4)
+
+		case OptionSyncPattern:
+			pattern, isBytes := value.([]byte)
+			ok = isBytes && len(pattern) > 0
+
+		case OptionByteFrameStart, OptionByteFrameEnd, OptionByteEscape, OptionByteEscapeXOR,
+			OptionByteEscapedFrameEnd, OptionByteEscapedEscape:
+			m, isInt := value.(int)
+			ok = isInt && m >= 0 && m <= 0xFF
+		}
+
+		if !ok {
+			return fmt.Errorf("%s: Invalid value %v (%T)", option, value, value)
+		}
+	}
+
+	return nil
+}
+
 // DefaultFramerOptions returns the default framer options (note that this is currently a nil value)
 func DefaultFramerOptions() *FramerOptions {
 	return nil
 }
 
+// Clone returns a copy of the options that can be modified without changing the original
+func (o *FramerOptions) Clone() *FramerOptions {
+	if o == nil {
+		return nil
+	}
+
+	result := &FramerOptions{
+		configMap: make(map[FramerOption]interface{}, len(o.configMap)),
+	}
+	for option, value := range o.configMap {
+		result.configMap[option] = value
+	}
+
+	return result
+}
+
 // Set modifies the specified option with the given value
 func (o *FramerOptions) Set(t FramerOption, value interface{}) *FramerOptions {
 	if o == nil {
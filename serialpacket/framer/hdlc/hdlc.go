@@ -2,6 +2,7 @@ package hdlc
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"sync"
@@ -9,6 +10,7 @@ import (
 	"time"
 
 	"github.com/BertoldVdb/go-misc/multicrc"
+	pdu "github.com/BertoldVdb/go-misc/pdubuf"
 	"github.com/BertoldVdb/go-misc/serialpacket/framer/framerinterface"
 )
 
@@ -34,10 +36,17 @@ type HDLC struct {
 	frameEnd       byte
 	frameEscape    byte
 	frameEscapeXOR byte
+
+	monitor        framerinterface.FrameMonitor
+	deliverInvalid bool
 }
 
 // NewHDLCFramer is used to create a HDLC framer
 func NewHDLCFramer(port io.ReadWriter, options *framerinterface.FramerOptions) (*HDLC, error) {
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+
 	s := &HDLC{
 		port:           port,
 		crcParams:      options.GetDefault(framerinterface.OptionCRCParam, multicrc.CrcNone).(*multicrc.Params),
@@ -46,6 +55,7 @@ func NewHDLCFramer(port io.ReadWriter, options *framerinterface.FramerOptions) (
 		frameEnd:       byte(options.GetInt(framerinterface.OptionByteFrameEnd, 0x7E)),
 		frameEscape:    byte(options.GetInt(framerinterface.OptionByteEscape, 0x7D)),
 		frameEscapeXOR: byte(options.GetInt(framerinterface.OptionByteEscapeXOR, 0x20)),
+		deliverInvalid: options.GetBool(framerinterface.OptionDeliverInvalid, false),
 	}
 
 	for i := 0; i < 0x20; i++ {
@@ -110,10 +120,15 @@ func (s *HDLC) SendPacket(payload []byte) (int64, error) {
 	s.sendBuffer.data.WriteByte(s.frameEnd)
 
 	n, err := s.sendBuffer.data.WriteTo(s.port)
+	s.updateSendStats(n, len(payload))
 
+	return n, err
+}
+
+func (s *HDLC) updateSendStats(n int64, payloadLen int) {
 	if n > 0 {
 		nu := uint64(n)
-		iu := uint64(len(payload))
+		iu := uint64(payloadLen)
 		if iu > nu {
 			iu = nu
 		}
@@ -122,8 +137,56 @@ func (s *HDLC) SendPacket(payload []byte) (int64, error) {
 		atomic.AddUint64(&s.stats.BytesSent, iu)
 		atomic.AddUint64(&s.stats.BytesSentEscaped, nu)
 	}
+}
 
-	return n, err
+func (s *HDLC) needsEscaping(payload []byte) bool {
+	for _, m := range payload {
+		if s.TxCharsEscape[m] {
+			return true
+		}
+	}
+	return false
+}
+
+// SendPDU sends the PDU using HDLC framing. If nothing needs to be escaped, the framing is added in place
+// so no copy is made. This is fastest if the PDU has at least 1 byte headroom and enough tailroom for the
+// CRC and the end of frame byte. The PDU contents are restored before returning.
+func (s *HDLC) SendPDU(p *pdu.PDU) (int64, error) {
+	s.sendBuffer.Lock()
+	defer s.sendBuffer.Unlock()
+
+	var crcBuf [8]byte
+	payload := p.Buf()
+	crc := s.sendBuffer.crc.Reset().AddBytes(payload).ResultBytes(crcBuf[:], false)
+
+	if s.needsEscaping(payload) || s.needsEscaping(crc) {
+		defer s.sendBuffer.data.Reset()
+
+		s.sendBuffer.data.WriteByte(s.frameStart)
+		s.writeEscaped(payload)
+		s.writeEscaped(crc)
+		s.sendBuffer.data.WriteByte(s.frameEnd)
+
+		n, err := s.sendBuffer.data.WriteTo(s.port)
+		s.updateSendStats(n, len(payload))
+
+		return n, err
+	}
+
+	payloadLen := len(payload)
+
+	p.ExtendLeft(1)[0] = s.frameStart
+	tail := p.ExtendRight(len(crc) + 1)
+	copy(tail, crc)
+	tail[len(crc)] = s.frameEnd
+
+	n, err := s.port.Write(p.Buf())
+	s.updateSendStats(int64(n), payloadLen)
+
+	p.DropLeft(1)
+	p.DropRight(len(crc) + 1)
+
+	return int64(n), err
 }
 
 // SetPort can be used to change the port used by the framer. It may not be executed concurrently
@@ -137,39 +200,59 @@ func (s *HDLC) SetPort(port io.ReadWriter) error {
 	return nil
 }
 
+// SetMonitor sets a function that is called for every received frame that is dropped. It may not be
+// executed concurrently with Run
+func (s *HDLC) SetMonitor(monitor framerinterface.FrameMonitor) {
+	s.monitor = monitor
+}
+
 // Run should be called to start the receiver process. It will only return
 // on read errors (eg, port closed)
 func (s *HDLC) Run(receivedPacket framerinterface.FramerReceivedPacketHandler) error {
+	return s.RunContext(context.Background(), nil, receivedPacket)
+}
+
+// RunContext is like Run, but it also returns when ctx is cancelled. A partially received frame is
+// counted in FramesReceivedIncomplete. Ready is called when the receiver has started.
+func (s *HDLC) RunContext(ctx context.Context, ready func(), receivedPacket framerinterface.FramerReceivedPacketHandler) error {
 	var tmpBuf [512]byte
 	var rxBuffer bytes.Buffer
 
 	isEscaped := false
 	isValid := true
 	isFirst := true
+	escapedLen := 0
 
 	reset := func() {
 		isValid = true
 		isEscaped = false
 		isFirst = true
+		escapedLen = 0
 
 		rxBuffer.Reset()
 	}
 
 	var firstByteTimestamp time.Time
+	var lastFrameEnd time.Time
 
 	crc := multicrc.NewCRC(s.crcParams)
 
+	defer framerinterface.WatchContext(ctx, s.port)()
+
+	if ready != nil {
+		ready()
+	}
+
 	for {
 		n, err := s.port.Read(tmpBuf[:])
-		if err != nil {
-			return err
-		}
+		now := time.Now()
 
 		for _, m := range tmpBuf[:n] {
 			atomic.AddUint64(&s.stats.BytesReceivedEscaped, 1)
+			escapedLen++
 
 			if isFirst {
-				firstByteTimestamp = time.Now()
+				firstByteTimestamp = now
 				isFirst = false
 			}
 
@@ -177,29 +260,49 @@ func (s *HDLC) Run(receivedPacket framerinterface.FramerReceivedPacketHandler) e
 				if rxBuffer.Len() > 0 {
 					atomic.AddUint64(&s.stats.BytesReceived, uint64(rxBuffer.Len()))
 
+					frame := rxBuffer.Bytes()
+					payload := frame
+					pkt := framerinterface.PacketMetadata{
+						RxTime:        firstByteTimestamp,
+						RxTimeEnd:     now,
+						LengthEscaped: escapedLen,
+					}
+					if !lastFrameEnd.IsZero() {
+						pkt.Gap = firstByteTimestamp.Sub(lastFrameEnd)
+					}
+					lastFrameEnd = now
+
 					if isValid && !isEscaped {
 						atomic.AddUint64(&s.stats.FramesReceivedValid, 1)
 
-						message := rxBuffer.Bytes()
-						if len(message) < crc.ResultLenBytes() {
+						if len(frame) < crc.ResultLenBytes() {
 							atomic.AddUint64(&s.stats.FramesReceivedWrongChecksum, 1)
+							pkt.Status = framerinterface.FrameWrongChecksum
 						} else {
-							crcIndex := len(message) - crc.ResultLenBytes()
+							crcIndex := len(frame) - crc.ResultLenBytes()
+							payload = frame[:crcIndex]
+							pkt.CRC = framerinterface.CRCValue(frame[crcIndex:], false)
 
 							var crcCalcBuf [8]byte
-							if bytes.Equal(crc.Reset().AddBytes(message[:crcIndex]).ResultBytes(crcCalcBuf[:], false), message[crcIndex:]) {
-								pkt := framerinterface.PacketMetadata{
-									RxTime: firstByteTimestamp,
-								}
-
-								err := receivedPacket(message[:crcIndex], &pkt)
-								if err != nil {
-									return err
-								}
-							} else {
+							if !bytes.Equal(crc.Reset().AddBytes(payload).ResultBytes(crcCalcBuf[:], false), frame[crcIndex:]) {
 								atomic.AddUint64(&s.stats.FramesReceivedWrongChecksum, 1)
+								pkt.Status = framerinterface.FrameWrongChecksum
 							}
 						}
+					} else if !isValid {
+						pkt.Status = framerinterface.FrameOversized
+					} else {
+						atomic.AddUint64(&s.stats.FramesReceivedInvalid, 1)
+						pkt.Status = framerinterface.FrameInvalid
+					}
+
+					if pkt.Status == framerinterface.FrameValid || s.deliverInvalid {
+						err := receivedPacket(payload, &pkt)
+						if err != nil {
+							return err
+						}
+					} else if s.monitor != nil {
+						s.monitor(frame, pkt.Status, &pkt)
 					}
 				} else {
 					atomic.AddUint64(&s.stats.FramesReceivedZeroLength, 1)
@@ -230,6 +333,18 @@ func (s *HDLC) Run(receivedPacket framerinterface.FramerReceivedPacketHandler) e
 				isValid = false
 			}
 		}
+
+		if ctx.Err() != nil {
+			if rxBuffer.Len() > 0 {
+				atomic.AddUint64(&s.stats.BytesReceived, uint64(rxBuffer.Len()))
+				atomic.AddUint64(&s.stats.FramesReceivedIncomplete, 1)
+			}
+			return ctx.Err()
+		}
+
+		if err != nil {
+			return err
+		}
 	}
 }
 
@@ -1,9 +1,12 @@
 package hdlc
 
 import (
+	"bytes"
+	"io"
 	"testing"
 
 	"github.com/BertoldVdb/go-misc/multicrc"
+	pdu "github.com/BertoldVdb/go-misc/pdubuf"
 	"github.com/BertoldVdb/go-misc/serialpacket/framer/framerinterface"
 
 	"github.com/BertoldVdb/go-misc/serialpacket/framer/testutil"
@@ -33,3 +36,140 @@ func TestHDLC(t *testing.T) {
 
 	testWithOptions(t, framerinterface.DefaultFramerOptions().Set(framerinterface.OptionByteFrameStart, 0x20), true)
 }
+
+type captureWriter struct {
+	writes [][]byte
+}
+
+func (c *captureWriter) Read(p []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (c *captureWriter) Write(p []byte) (int, error) {
+	c.writes = append(c.writes, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+func TestSendPDU(t *testing.T) {
+	options := framerinterface.DefaultFramerOptions().Set(framerinterface.OptionCRCParam, multicrc.Crc16CCITTFALSE)
+
+	for _, payload := range [][]byte{[]byte("No escaping"), {0x7E, 0x01, 0x7D}} {
+		port := &captureWriter{}
+		framer, _ := NewHDLCFramer(port, options)
+		framer.SendPacket(payload)
+
+		p := pdu.Alloc(1, 0, len(payload)+3)
+		p.Append(payload...)
+		framer.SendPDU(p)
+
+		if len(port.writes) != 2 || !bytes.Equal(port.writes[0], port.writes[1]) {
+			t.Error("SendPDU result differs from SendPacket")
+		}
+		if !bytes.Equal(p.Buf(), payload) {
+			t.Error("PDU was not restored")
+		}
+	}
+}
+
+func TestSendPDUAllocs(t *testing.T) {
+	port := struct {
+		io.Reader
+		io.Writer
+	}{nil, io.Discard}
+	framer, _ := NewHDLCFramer(port, framerinterface.DefaultFramerOptions().Set(framerinterface.OptionCRCParam, multicrc.Crc32MPEG2))
+
+	p := pdu.Alloc(1, 0, 64+5)
+	p.Append([]byte("Telemetry data that does not contain any special bytes")...)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		framer.SendPDU(p)
+	})
+	if allocs > 0 {
+		t.Error("SendPDU allocated", allocs)
+	}
+}
+
+type testPort struct {
+	io.Reader
+	io.Writer
+}
+
+func TestDeliverInvalid(t *testing.T) {
+	options := framerinterface.DefaultFramerOptions().
+		Set(framerinterface.OptionCRCParam, multicrc.Crc16CCITTFALSE).
+		Set(framerinterface.OptionMaxPacketLen, 16)
+
+	var input bytes.Buffer
+	sender, _ := NewHDLCFramer(&testPort{Writer: &input}, options)
+	sender.SendPacket([]byte("Valid"))
+	validLen := input.Len()
+	sender.SendPacket([]byte("Broken"))
+	input.Bytes()[input.Len()-2] ^= 0x01
+	sender.SendPacket([]byte("This frame is too long"))
+	sender.SendPacket([]byte("Valid"))
+
+	type received struct {
+		payload  []byte
+		metadata framerinterface.PacketMetadata
+	}
+
+	receive := func(deliverInvalid bool) ([]received, framerinterface.BaseStats) {
+		framer, _ := NewHDLCFramer(&testPort{Reader: bytes.NewReader(input.Bytes())}, options.Clone().Set(framerinterface.OptionDeliverInvalid, deliverInvalid))
+
+		var result []received
+		framer.Run(func(payload []byte, metadata *framerinterface.PacketMetadata) error {
+			result = append(result, received{append([]byte(nil), payload...), *metadata})
+			return nil
+		})
+
+		return result, framer.GetStats()
+	}
+
+	normal, normalStats := receive(false)
+	all, allStats := receive(true)
+
+	if normalStats != allStats {
+		t.Error("Statistics depend on OptionDeliverInvalid")
+	}
+
+	if len(normal) != 2 {
+		t.Fatal("Invalid frames were delivered")
+	}
+
+	if len(all) != 4 {
+		t.Fatal("Invalid frames were not delivered")
+	}
+
+	expected := []framerinterface.FrameStatus{framerinterface.FrameValid, framerinterface.FrameWrongChecksum, framerinterface.FrameOversized, framerinterface.FrameValid}
+	for i, r := range all {
+		if r.metadata.Status != expected[i] {
+			t.Error("Frame", i, "has status", r.metadata.Status)
+		}
+		if r.metadata.RxTimeEnd.Before(r.metadata.RxTime) {
+			t.Error("End timestamp is before start")
+		}
+		if i > 0 && r.metadata.Gap < 0 {
+			t.Error("Negative gap")
+		}
+	}
+
+	if !bytes.Equal(all[1].payload, []byte("Broken")) {
+		t.Error("Payload of frame with wrong CRC is wrong", all[1].payload)
+	}
+	if len(all[2].payload) != 17 {
+		t.Error("Oversized frame was not truncated", len(all[2].payload))
+	}
+
+	crc := multicrc.NewCRC(multicrc.Crc16CCITTFALSE).AddBytes([]byte("Valid"))
+	if all[0].metadata.CRC != crc.Result64() {
+		t.Error("Received CRC is wrong")
+	}
+	if all[1].metadata.CRC == multicrc.NewCRC(multicrc.Crc16CCITTFALSE).AddBytes([]byte("Broken")).Result64() {
+		t.Error("Received CRC was not corrupted")
+	}
+
+	/* The start flag is not part of the frame */
+	if all[0].metadata.LengthEscaped != validLen-1 {
+		t.Error("Escaped length is wrong", all[0].metadata.LengthEscaped, validLen-1)
+	}
+}
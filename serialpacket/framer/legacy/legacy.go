@@ -0,0 +1,356 @@
+package legacy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/BertoldVdb/go-misc/multicrc"
+	"github.com/BertoldVdb/go-misc/serialpacket/framer/framerinterface"
+)
+
+// AddressNone is the address of frames that are sent without address byte
+const AddressNone = 0xFF
+
+var (
+	// ErrorPacketLength is returned by SendPacket when the payload is empty or does not fit in the length field
+	ErrorPacketLength = errors.New("Payload too long or too short")
+)
+
+// CRCParams describes the CRC-8 used by legacy devices
+var CRCParams = &multicrc.Params{
+	Len:          8,
+	Name:         "Crc8Legacy",
+	Polynomial:   0x9B,
+	InitialValue: 0x12,
+}
+
+// Legacy is a packet framer for the format used by older devices: a sync byte ('B'), an optional address,
+// a one byte length, the payload and a CRC-8. A CRC of zero is sent as 0xAA.
+type Legacy struct {
+	port         io.ReadWriter
+	maxPacketLen int
+
+	sendBuffer struct {
+		sync.Mutex
+		data bytes.Buffer
+		crc  *multicrc.CRC
+	}
+
+	stats framerinterface.BaseStats
+
+	crcParams *multicrc.Params
+	sync      byte
+	addressed bool
+
+	monitor framerinterface.FrameMonitor
+	rxXOR   func(payload []byte) uint8
+}
+
+// NewLegacyFramer is used to create a legacy framer. The default CRC is CRCParams. If OptionAddressed is
+// set, the first byte of every payload is the address.
+func NewLegacyFramer(port io.ReadWriter, options *framerinterface.FramerOptions) (*Legacy, error) {
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+
+	s := &Legacy{
+		port:         port,
+		crcParams:    options.GetDefault(framerinterface.OptionCRCParam, CRCParams).(*multicrc.Params),
+		maxPacketLen: options.GetInt(framerinterface.OptionMaxPacketLen, 255),
+		sync:         byte(options.GetInt(framerinterface.OptionByteFrameStart, 'B')),
+		addressed:    options.GetBool(framerinterface.OptionAddressed, false),
+	}
+
+	if s.maxPacketLen <= 0 || s.maxPacketLen > 255 {
+		s.maxPacketLen = 255
+	}
+
+	s.sendBuffer.crc = multicrc.NewCRC(s.crcParams)
+
+	return s, nil
+}
+
+/* writeCRC appends the CRC of payload, XORed with xor */
+func (s *Legacy) writeCRC(buf *bytes.Buffer, crc *multicrc.CRC, payload []byte, xor uint8) []byte {
+	var crcBuf [8]byte
+
+	crcLen := crc.ResultLenBytes()
+	if crcLen == 0 {
+		return nil
+	}
+
+	value := crc.Reset().AddBytes(payload).Result64() ^ uint64(xor)
+	if value == 0 {
+		value = 0xAA
+	}
+
+	for i := 0; i < crcLen; i++ {
+		crcBuf[i] = byte(value >> (8 * i))
+	}
+
+	if buf != nil {
+		buf.Write(crcBuf[:crcLen])
+	}
+	return crcBuf[:crcLen]
+}
+
+// SendPacket is used to send a packet to the port. In addressed mode the first byte of the payload is the address.
+func (s *Legacy) SendPacket(payload []byte) (int64, error) {
+	if !s.addressed {
+		return s.send(-1, payload, 0)
+	}
+
+	if len(payload) == 0 {
+		return 0, ErrorPacketLength
+	}
+	return s.send(int(payload[0]), payload[1:], 0)
+}
+
+// SendFrame sends a frame to a device. If the address is AddressNone, the address byte is omitted. The CRC is
+// XORed with crcXOR, legacy devices use this to bind commands to their serial number.
+func (s *Legacy) SendFrame(address uint8, payload []byte, crcXOR uint8) (int64, error) {
+	if address == AddressNone {
+		return s.send(-1, payload, crcXOR)
+	}
+	return s.send(int(address), payload, crcXOR)
+}
+
+func (s *Legacy) send(address int, payload []byte, crcXOR uint8) (int64, error) {
+	if len(payload) < 1 || len(payload) > 255 {
+		return 0, ErrorPacketLength
+	}
+
+	s.sendBuffer.Lock()
+	defer s.sendBuffer.Unlock()
+	defer s.sendBuffer.data.Reset()
+
+	payloadLen := len(payload)
+
+	s.sendBuffer.data.WriteByte(s.sync)
+	if address >= 0 {
+		s.sendBuffer.data.WriteByte(byte(address))
+		payloadLen++
+	}
+	s.sendBuffer.data.WriteByte(byte(len(payload)))
+	s.sendBuffer.data.Write(payload)
+	s.writeCRC(&s.sendBuffer.data, s.sendBuffer.crc, payload, crcXOR)
+
+	n, err := s.sendBuffer.data.WriteTo(s.port)
+
+	if n > 0 {
+		nu := uint64(n)
+		iu := uint64(payloadLen)
+		if iu > nu {
+			iu = nu
+		}
+
+		atomic.AddUint64(&s.stats.FramesSent, 1)
+		atomic.AddUint64(&s.stats.BytesSent, iu)
+		atomic.AddUint64(&s.stats.BytesSentEscaped, nu)
+	}
+
+	return n, err
+}
+
+// SetPort can be used to change the port used by the framer. It may not be executed concurrently
+// with Run
+func (s *Legacy) SetPort(port io.ReadWriter) error {
+	s.sendBuffer.Lock()
+	defer s.sendBuffer.Unlock()
+
+	s.port = port
+
+	return nil
+}
+
+// SetMonitor sets a function that is called for every received frame that is dropped. For frames with an
+// invalid length only the header is reported. It may not be executed concurrently with Run
+func (s *Legacy) SetMonitor(monitor framerinterface.FrameMonitor) {
+	s.monitor = monitor
+}
+
+// SetReceiveCRCXOR sets a function that returns the value XORed with the CRC of a received payload, this is
+// needed to receive commands that are bound to a serial number. In addressed mode the payload starts with
+// the address. It may not be executed concurrently with Run
+func (s *Legacy) SetReceiveCRCXOR(xor func(payload []byte) uint8) {
+	s.rxXOR = xor
+}
+
+func (s *Legacy) monitorFrame(frame []byte, status framerinterface.FrameStatus, metadata framerinterface.PacketMetadata) {
+	if s.monitor != nil {
+		metadata.Status = status
+		s.monitor(frame, status, &metadata)
+	}
+}
+
+/* rxChunk remembers when the bytes up to end in the receive buffer were received */
+type rxChunk struct {
+	end       int
+	timestamp time.Time
+}
+
+// Run should be called to start the receiver process. It will only return
+// on read errors (eg, port closed)
+func (s *Legacy) Run(receivedPacket framerinterface.FramerReceivedPacketHandler) error {
+	return s.RunContext(context.Background(), nil, receivedPacket)
+}
+
+// RunContext is like Run, but it also returns when ctx is cancelled. A partially received frame is
+// counted in FramesReceivedIncomplete. Ready is called when the receiver has started.
+func (s *Legacy) RunContext(ctx context.Context, ready func(), receivedPacket framerinterface.FramerReceivedPacketHandler) error {
+	var tmpBuf [512]byte
+	var rxBuffer bytes.Buffer
+	var chunks []rxChunk
+	var addressBuf []byte
+
+	crc := multicrc.NewCRC(s.crcParams)
+	crcLen := crc.ResultLenBytes()
+
+	headerLen := 2
+	if s.addressed {
+		headerLen++
+	}
+
+	drop := func(n int) {
+		rxBuffer.Next(n)
+
+		i := 0
+		for i < len(chunks) && chunks[i].end <= n {
+			i++
+		}
+		chunks = append(chunks[:0], chunks[i:]...)
+		for j := range chunks {
+			chunks[j].end -= n
+		}
+	}
+
+	/* metadata describes the frame of length bytes at the start of the buffer */
+	var lastFrameEnd time.Time
+	metadata := func(length int) framerinterface.PacketMetadata {
+		pkt := framerinterface.PacketMetadata{
+			RxTime:        chunks[0].timestamp,
+			LengthEscaped: length,
+		}
+
+		for _, chunk := range chunks {
+			if chunk.end >= length {
+				pkt.RxTimeEnd = chunk.timestamp
+				break
+			}
+		}
+
+		if !lastFrameEnd.IsZero() {
+			pkt.Gap = pkt.RxTime.Sub(lastFrameEnd)
+		}
+
+		return pkt
+	}
+
+	defer framerinterface.WatchContext(ctx, s.port)()
+
+	if ready != nil {
+		ready()
+	}
+
+	for {
+		n, err := s.port.Read(tmpBuf[:])
+
+		atomic.AddUint64(&s.stats.BytesReceivedEscaped, uint64(n))
+		rxBuffer.Write(tmpBuf[:n])
+		chunks = append(chunks, rxChunk{end: rxBuffer.Len(), timestamp: time.Now()})
+
+		for {
+			index := bytes.IndexByte(rxBuffer.Bytes(), s.sync)
+			if index < 0 {
+				drop(rxBuffer.Len())
+				break
+			}
+			drop(index)
+
+			if rxBuffer.Len() < headerLen {
+				break
+			}
+
+			message := rxBuffer.Bytes()
+			length := int(message[headerLen-1])
+
+			if length == 0 {
+				atomic.AddUint64(&s.stats.FramesReceivedInvalid, 1)
+				s.monitorFrame(message[:headerLen], framerinterface.FrameInvalid, metadata(headerLen))
+				drop(1)
+				continue
+			}
+
+			if length > s.maxPacketLen {
+				atomic.AddUint64(&s.stats.FramesReceivedOversized, 1)
+				s.monitorFrame(message[:headerLen], framerinterface.FrameOversized, metadata(headerLen))
+				drop(1)
+				continue
+			}
+
+			frameLen := headerLen + length + crcLen
+			if rxBuffer.Len() < frameLen {
+				break
+			}
+
+			/* In addressed mode the address is passed as the first byte of the payload */
+			data := message[headerLen : headerLen+length]
+			payload := data
+			if s.addressed {
+				addressBuf = append(append(addressBuf[:0], message[1]), data...)
+				payload = addressBuf
+			}
+
+			atomic.AddUint64(&s.stats.BytesReceived, uint64(len(payload)))
+			atomic.AddUint64(&s.stats.FramesReceivedValid, 1)
+
+			receivedCRC := message[headerLen+length : frameLen]
+
+			pkt := metadata(frameLen)
+			pkt.CRC = framerinterface.CRCValue(receivedCRC, false)
+
+			var xor uint8
+			if s.rxXOR != nil {
+				xor = s.rxXOR(payload)
+			}
+
+			if !bytes.Equal(s.writeCRC(nil, crc, data, xor), receivedCRC) {
+				atomic.AddUint64(&s.stats.FramesReceivedWrongChecksum, 1)
+				s.monitorFrame(message[headerLen:frameLen], framerinterface.FrameWrongChecksum, pkt)
+				drop(1)
+				continue
+			}
+
+			lastFrameEnd = pkt.RxTimeEnd
+
+			err := receivedPacket(payload, &pkt)
+			if err != nil {
+				return err
+			}
+
+			drop(frameLen)
+		}
+
+		if ctx.Err() != nil {
+			if rxBuffer.Len() > 0 {
+				atomic.AddUint64(&s.stats.BytesReceived, uint64(rxBuffer.Len()-1))
+				atomic.AddUint64(&s.stats.FramesReceivedIncomplete, 1)
+			}
+			return ctx.Err()
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// GetStats returns a safely accessed snapshot of the statistics
+func (s *Legacy) GetStats() framerinterface.BaseStats {
+	return s.stats.CopyBaseStatsAtomic()
+}
@@ -0,0 +1,77 @@
+package legacy
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/BertoldVdb/go-misc/multicrc"
+	"github.com/BertoldVdb/go-misc/serialpacket/framer/framerinterface"
+	"github.com/BertoldVdb/go-misc/serialpacket/framer/testutil"
+)
+
+type readWriter struct {
+	io.Reader
+	io.Writer
+}
+
+func TestLegacy(t *testing.T) {
+	/* Use a long CRC, the random garbage sent by the test would otherwise sometimes match */
+	options := framerinterface.DefaultFramerOptions().Set(framerinterface.OptionCRCParam, multicrc.Crc32MPEG2)
+
+	framer, _ := NewLegacyFramer(nil, options)
+	testutil.FramerRunTests(t, framer)
+
+	framer, _ = NewLegacyFramer(nil, options.Clone().Set(framerinterface.OptionAddressed, true))
+	testutil.FramerRunTests(t, framer)
+}
+
+func TestWireFormat(t *testing.T) {
+	var out bytes.Buffer
+	framer, _ := NewLegacyFramer(&out, nil)
+
+	framer.SendFrame(AddressNone, []byte{0x01, 'a', 'b'}, 0)
+	/* The CRC is XORed with the serial number, a result of zero is sent as 0xAA */
+	framer.SendFrame(0x10, []byte{0x03}, 0xA9)
+
+	expected := []byte{'B', 3, 0x01, 'a', 'b', 0xF8, 'B', 0x10, 1, 0x03, 0xAA}
+	if !bytes.Equal(out.Bytes(), expected) {
+		t.Errorf("Wrong frames sent: %x", out.Bytes())
+	}
+
+	if _, err := framer.SendPacket(nil); err != ErrorPacketLength {
+		t.Error("Empty packet accepted")
+	}
+	if _, err := framer.SendPacket(make([]byte, 256)); err != ErrorPacketLength {
+		t.Error("Long packet accepted")
+	}
+
+	/* A device receives the addressed frame, the zero length frame is invalid */
+	input := append([]byte{'B', 0x10, 0}, expected[6:]...)
+	receiver, _ := NewLegacyFramer(readWriter{bytes.NewReader(input), nil},
+		framerinterface.DefaultFramerOptions().Set(framerinterface.OptionAddressed, true))
+	receiver.SetReceiveCRCXOR(func(payload []byte) uint8 {
+		if payload[0] != 0x10 {
+			t.Error("Address is missing")
+		}
+		return 0xA9
+	})
+
+	var received [][]byte
+	receiver.Run(func(payload []byte, metadata *framerinterface.PacketMetadata) error {
+		received = append(received, append([]byte(nil), payload...))
+		if metadata.CRC != 0xAA || metadata.LengthEscaped != 5 {
+			t.Error("Wrong metadata", metadata)
+		}
+		return nil
+	})
+
+	if len(received) != 1 || !bytes.Equal(received[0], []byte{0x10, 0x03}) {
+		t.Error("Wrong packets received", received)
+	}
+
+	stats := receiver.GetStats()
+	if stats.FramesReceivedInvalid != 1 || stats.FramesReceivedWrongChecksum != 0 {
+		t.Error("Wrong statistics", stats)
+	}
+}
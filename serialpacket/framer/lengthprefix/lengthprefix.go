@@ -0,0 +1,342 @@
+package lengthprefix
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/BertoldVdb/go-misc/multicrc"
+	"github.com/BertoldVdb/go-misc/serialpacket/framer/framerinterface"
+)
+
+var (
+	// ErrorPacketTooLong is returned by SendPacket when the payload does not fit in the length field
+	ErrorPacketTooLong = errors.New("Packet is too long for length field")
+)
+
+// LengthPrefix is a packet framer that sends a sync pattern, a length field and an optional header
+// CRC before the payload. The payload is followed by an optional CRC.
+type LengthPrefix struct {
+	port         io.ReadWriter
+	maxPacketLen int
+
+	sendBuffer struct {
+		sync.Mutex
+		data      bytes.Buffer
+		crc       *multicrc.CRC
+		headerCRC *multicrc.CRC
+	}
+
+	stats framerinterface.BaseStats
+
+	crcParams       *multicrc.Params
+	headerCRCParams *multicrc.Params
+
+	syncPattern     []byte
+	lengthFieldSize int
+	bigEndian       bool
+
+	monitor framerinterface.FrameMonitor
+}
+
+// NewLengthPrefixFramer is used to create a length prefixed framer. By default the header is protected by
+// Crc8, as a false sync in the data would otherwise swallow the following frame.
+func NewLengthPrefixFramer(port io.ReadWriter, options *framerinterface.FramerOptions) (*LengthPrefix, error) {
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+
+	s := &LengthPrefix{
+		port:            port,
+		crcParams:       options.GetDefault(framerinterface.OptionCRCParam, multicrc.CrcNone).(*multicrc.Params),
+		headerCRCParams: options.GetDefault(framerinterface.OptionHeaderCRCParam, multicrc.Crc8).(*multicrc.Params),
+		maxPacketLen:    options.GetInt(framerinterface.OptionMaxPacketLen, 256),
+		lengthFieldSize: options.GetInt(framerinterface.OptionLengthFieldSize, 2),
+		bigEndian:       options.GetBool(framerinterface.OptionLengthBigEndian, false),
+	}
+
+	syncPattern := options.GetDefault(framerinterface.OptionSyncPattern, []byte{0xAA, 0x55}).([]byte)
+	if len(syncPattern) == 0 {
+		return nil, errors.New("Sync pattern may not be empty")
+	}
+	s.syncPattern = make([]byte, len(syncPattern))
+	copy(s.syncPattern, syncPattern)
+
+	if s.lengthFieldSize != 1 && s.lengthFieldSize != 2 && s.lengthFieldSize != 4 {
+		return nil, fmt.Errorf("Unsupported length field size: %d", s.lengthFieldSize)
+	}
+
+	/* Create CRC modules for sender */
+	s.sendBuffer.crc = multicrc.NewCRC(s.crcParams)
+	s.sendBuffer.headerCRC = multicrc.NewCRC(s.headerCRCParams)
+
+	return s, nil
+}
+
+func (s *LengthPrefix) byteOrder() binary.ByteOrder {
+	if s.bigEndian {
+		return binary.BigEndian
+	}
+	return binary.LittleEndian
+}
+
+func (s *LengthPrefix) maxLengthField() uint64 {
+	return uint64(1)<<(8*uint(s.lengthFieldSize)) - 1
+}
+
+func (s *LengthPrefix) putLength(buf []byte, length uint32) []byte {
+	buf = buf[:s.lengthFieldSize]
+
+	switch s.lengthFieldSize {
+	case 1:
+		buf[0] = byte(length)
+	case 2:
+		s.byteOrder().PutUint16(buf, uint16(length))
+	case 4:
+		s.byteOrder().PutUint32(buf, length)
+	}
+
+	return buf
+}
+
+func (s *LengthPrefix) getLength(buf []byte) uint32 {
+	switch s.lengthFieldSize {
+	case 1:
+		return uint32(buf[0])
+	case 2:
+		return uint32(s.byteOrder().Uint16(buf))
+	default:
+		return s.byteOrder().Uint32(buf)
+	}
+}
+
+func (s *LengthPrefix) headerLen(headerCRC *multicrc.CRC) int {
+	return len(s.syncPattern) + s.lengthFieldSize + headerCRC.ResultLenBytes()
+}
+
+// SendPacket is used to send a packet to the port using length prefixed framing
+func (s *LengthPrefix) SendPacket(payload []byte) (int64, error) {
+	if uint64(len(payload)) > s.maxLengthField() {
+		return 0, ErrorPacketTooLong
+	}
+
+	s.sendBuffer.Lock()
+	defer s.sendBuffer.Unlock()
+	defer s.sendBuffer.data.Reset()
+
+	var lenBuf [4]byte
+	var crcBuf [8]byte
+
+	s.sendBuffer.data.Write(s.syncPattern)
+	s.sendBuffer.data.Write(s.putLength(lenBuf[:], uint32(len(payload))))
+	s.sendBuffer.data.Write(s.sendBuffer.headerCRC.Reset().AddBytes(s.sendBuffer.data.Bytes()).ResultBytes(crcBuf[:], s.bigEndian))
+	s.sendBuffer.data.Write(payload)
+	s.sendBuffer.data.Write(s.sendBuffer.crc.Reset().AddBytes(payload).ResultBytes(crcBuf[:], s.bigEndian))
+
+	n, err := s.sendBuffer.data.WriteTo(s.port)
+
+	if n > 0 {
+		nu := uint64(n)
+		iu := uint64(len(payload))
+		if iu > nu {
+			iu = nu
+		}
+
+		atomic.AddUint64(&s.stats.FramesSent, 1)
+		atomic.AddUint64(&s.stats.BytesSent, iu)
+		atomic.AddUint64(&s.stats.BytesSentEscaped, nu)
+	}
+
+	return n, err
+}
+
+// SetPort can be used to change the port used by the framer. It may not be executed concurrently
+// with Run
+func (s *LengthPrefix) SetPort(port io.ReadWriter) error {
+	s.sendBuffer.Lock()
+	defer s.sendBuffer.Unlock()
+
+	s.port = port
+
+	return nil
+}
+
+// SetMonitor sets a function that is called for every received frame that is dropped. For frames with a
+// corrupt or oversized header only the header is reported. It may not be executed concurrently with Run
+func (s *LengthPrefix) SetMonitor(monitor framerinterface.FrameMonitor) {
+	s.monitor = monitor
+}
+
+func (s *LengthPrefix) monitorFrame(frame []byte, status framerinterface.FrameStatus, metadata framerinterface.PacketMetadata) {
+	if s.monitor != nil {
+		metadata.Status = status
+		s.monitor(frame, status, &metadata)
+	}
+}
+
+/* rxChunk remembers when the bytes up to end in the receive buffer were received */
+type rxChunk struct {
+	end       int
+	timestamp time.Time
+}
+
+// Run should be called to start the receiver process. It will only return
+// on read errors (eg, port closed)
+func (s *LengthPrefix) Run(receivedPacket framerinterface.FramerReceivedPacketHandler) error {
+	return s.RunContext(context.Background(), nil, receivedPacket)
+}
+
+// RunContext is like Run, but it also returns when ctx is cancelled. A partially received frame is
+// counted in FramesReceivedIncomplete. Ready is called when the receiver has started.
+func (s *LengthPrefix) RunContext(ctx context.Context, ready func(), receivedPacket framerinterface.FramerReceivedPacketHandler) error {
+	var tmpBuf [512]byte
+	var rxBuffer bytes.Buffer
+	var chunks []rxChunk
+
+	crc := multicrc.NewCRC(s.crcParams)
+	headerCRC := multicrc.NewCRC(s.headerCRCParams)
+	headerLen := s.headerLen(headerCRC)
+
+	drop := func(n int) {
+		rxBuffer.Next(n)
+
+		i := 0
+		for i < len(chunks) && chunks[i].end <= n {
+			i++
+		}
+		chunks = append(chunks[:0], chunks[i:]...)
+		for j := range chunks {
+			chunks[j].end -= n
+		}
+	}
+
+	/* metadata describes the frame of length bytes at the start of the buffer */
+	var lastFrameEnd time.Time
+	metadata := func(length int) framerinterface.PacketMetadata {
+		pkt := framerinterface.PacketMetadata{
+			RxTime:        chunks[0].timestamp,
+			LengthEscaped: length,
+		}
+
+		for _, chunk := range chunks {
+			if chunk.end >= length {
+				pkt.RxTimeEnd = chunk.timestamp
+				break
+			}
+		}
+
+		if !lastFrameEnd.IsZero() {
+			pkt.Gap = pkt.RxTime.Sub(lastFrameEnd)
+		}
+
+		return pkt
+	}
+
+	defer framerinterface.WatchContext(ctx, s.port)()
+
+	if ready != nil {
+		ready()
+	}
+
+	for {
+		n, err := s.port.Read(tmpBuf[:])
+
+		atomic.AddUint64(&s.stats.BytesReceivedEscaped, uint64(n))
+		rxBuffer.Write(tmpBuf[:n])
+		chunks = append(chunks, rxChunk{end: rxBuffer.Len(), timestamp: time.Now()})
+
+		for {
+			/* Search for the sync pattern, keep a partial match at the end */
+			index := bytes.Index(rxBuffer.Bytes(), s.syncPattern)
+			if index < 0 {
+				keep := len(s.syncPattern) - 1
+				if rxBuffer.Len() > keep {
+					drop(rxBuffer.Len() - keep)
+				}
+				break
+			}
+			drop(index)
+
+			if rxBuffer.Len() < headerLen {
+				break
+			}
+
+			message := rxBuffer.Bytes()
+			crcIndex := len(s.syncPattern) + s.lengthFieldSize
+
+			var crcCalcBuf [8]byte
+			if !bytes.Equal(headerCRC.Reset().AddBytes(message[:crcIndex]).ResultBytes(crcCalcBuf[:], s.bigEndian), message[crcIndex:headerLen]) {
+				/* Corrupt header, try again at the next byte */
+				atomic.AddUint64(&s.stats.FramesReceivedWrongChecksum, 1)
+				s.monitorFrame(message[:headerLen], framerinterface.FrameWrongChecksum, metadata(headerLen))
+				drop(1)
+				continue
+			}
+
+			length := s.getLength(message[len(s.syncPattern):])
+			if s.maxPacketLen > 0 && uint64(length) > uint64(s.maxPacketLen) {
+				atomic.AddUint64(&s.stats.FramesReceivedOversized, 1)
+				s.monitorFrame(message[:headerLen], framerinterface.FrameOversized, metadata(headerLen))
+				drop(1)
+				continue
+			}
+
+			frameLen := headerLen + int(length) + crc.ResultLenBytes()
+			if rxBuffer.Len() < frameLen {
+				break
+			}
+
+			atomic.AddUint64(&s.stats.BytesReceived, uint64(frameLen-headerLen))
+			atomic.AddUint64(&s.stats.FramesReceivedValid, 1)
+
+			payload := message[headerLen : headerLen+int(length)]
+			receivedCRC := message[headerLen+int(length) : frameLen]
+
+			pkt := metadata(frameLen)
+			pkt.CRC = framerinterface.CRCValue(receivedCRC, s.bigEndian)
+
+			if !bytes.Equal(crc.Reset().AddBytes(payload).ResultBytes(crcCalcBuf[:], s.bigEndian), receivedCRC) {
+				atomic.AddUint64(&s.stats.FramesReceivedWrongChecksum, 1)
+				s.monitorFrame(message[headerLen:frameLen], framerinterface.FrameWrongChecksum, pkt)
+				drop(1)
+				continue
+			}
+
+			lastFrameEnd = pkt.RxTimeEnd
+
+			if length == 0 {
+				atomic.AddUint64(&s.stats.FramesReceivedZeroLength, 1)
+			} else {
+				err := receivedPacket(payload, &pkt)
+				if err != nil {
+					return err
+				}
+			}
+
+			drop(frameLen)
+		}
+
+		if ctx.Err() != nil {
+			if bytes.HasPrefix(rxBuffer.Bytes(), s.syncPattern) {
+				atomic.AddUint64(&s.stats.BytesReceived, uint64(rxBuffer.Len()-len(s.syncPattern)))
+				atomic.AddUint64(&s.stats.FramesReceivedIncomplete, 1)
+			}
+			return ctx.Err()
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// GetStats returns a safely accessed snapshot of the statistics
+func (s *LengthPrefix) GetStats() framerinterface.BaseStats {
+	return s.stats.CopyBaseStatsAtomic()
+}
@@ -0,0 +1,82 @@
+package lengthprefix
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/BertoldVdb/go-misc/multicrc"
+	"github.com/BertoldVdb/go-misc/serialpacket/framer/framerinterface"
+
+	"github.com/BertoldVdb/go-misc/serialpacket/framer/testutil"
+)
+
+func testWithOptions(t *testing.T, options *framerinterface.FramerOptions, expectError bool) {
+	/* Use testutil to run the test */
+	framer, err := NewLengthPrefixFramer(nil, options)
+	if err != nil {
+		if !expectError {
+			t.Error(err)
+		}
+	} else {
+		testutil.FramerRunTests(t, framer)
+	}
+}
+
+func TestLengthPrefix(t *testing.T) {
+	testWithOptions(t, nil, false)
+	testWithOptions(t, framerinterface.DefaultFramerOptions().
+		Set(framerinterface.OptionCRCParam, multicrc.Crc32MPEG2).
+		Set(framerinterface.OptionHeaderCRCParam, multicrc.Crc8CDMA2000), false)
+	testWithOptions(t, framerinterface.DefaultFramerOptions().
+		Set(framerinterface.OptionSyncPattern, []byte{'B'}).
+		Set(framerinterface.OptionLengthFieldSize, 1).
+		Set(framerinterface.OptionCRCParam, multicrc.Crc16CCITTFALSE), false)
+	testWithOptions(t, framerinterface.DefaultFramerOptions().
+		Set(framerinterface.OptionLengthFieldSize, 4).
+		Set(framerinterface.OptionLengthBigEndian, true).
+		Set(framerinterface.OptionHeaderCRCParam, multicrc.Crc16CCITTFALSE), false)
+
+	testWithOptions(t, framerinterface.DefaultFramerOptions().Set(framerinterface.OptionLengthFieldSize, 3), true)
+	testWithOptions(t, framerinterface.DefaultFramerOptions().Set(framerinterface.OptionSyncPattern, []byte{}), true)
+}
+
+func TestResync(t *testing.T) {
+	options := framerinterface.DefaultFramerOptions().
+		Set(framerinterface.OptionSyncPattern, []byte{'B'}).
+		Set(framerinterface.OptionLengthFieldSize, 1).
+		Set(framerinterface.OptionHeaderCRCParam, multicrc.Crc8CDMA2000).
+		Set(framerinterface.OptionCRCParam, multicrc.Crc16CCITTFALSE)
+
+	loopback := testutil.NewLoopback()
+	framer, err := NewLengthPrefixFramer(loopback, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rxChan := make(chan ([]byte), 1)
+	go framer.Run(func(payload []byte, metadata *framerinterface.PacketMetadata) error {
+		rxChan <- append([]byte(nil), payload...)
+		return nil
+	})
+
+	/* A sync byte followed by a corrupt header must not swallow the real frame */
+	loopback.Write([]byte{'B', 0x10, 0x00})
+	packet := []byte("Resync works")
+	framer.SendPacket(packet)
+
+	select {
+	case rx := <-rxChan:
+		if !bytes.Equal(rx, packet) {
+			t.Error("Received wrong packet")
+		}
+	case <-time.After(time.Second):
+		t.Error("Did not receive packet")
+	}
+
+	loopback.Close()
+
+	if framer.GetStats().FramesReceivedWrongChecksum != 1 {
+		t.Error("Corrupt header was not counted")
+	}
+}
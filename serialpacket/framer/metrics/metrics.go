@@ -0,0 +1,241 @@
+package metrics
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/BertoldVdb/go-misc/serialpacket/framer/framerinterface"
+)
+
+var (
+	// ErrorNameInUse is returned by Register when a framer with the same name was already registered
+	ErrorNameInUse = errors.New("Framer name is already registered")
+)
+
+// Metrics contains the statistics of a framer together with values computed from them
+type Metrics struct {
+	framerinterface.BaseStats
+
+	// TxOverhead is the amount of extra bytes sent per payload byte
+	TxOverhead float64
+
+	// RxOverhead is the amount of extra bytes received per payload byte
+	RxOverhead float64
+
+	// ErrorRate is the fraction of received frames that was dropped because of an error
+	ErrorRate float64
+
+	// ChecksumErrorRate is the fraction of received frames that was dropped because of a wrong CRC
+	ChecksumErrorRate float64
+}
+
+func ratio(a uint64, b uint64) float64 {
+	if b == 0 {
+		return 0
+	}
+	return float64(a) / float64(b)
+}
+
+// Compute calculates the derived values from the statistics
+func Compute(stats framerinterface.BaseStats) Metrics {
+	m := Metrics{
+		BaseStats: stats,
+	}
+
+	if stats.BytesSentEscaped > stats.BytesSent {
+		m.TxOverhead = ratio(stats.BytesSentEscaped-stats.BytesSent, stats.BytesSent)
+	}
+	if stats.BytesReceivedEscaped > stats.BytesReceived {
+		m.RxOverhead = ratio(stats.BytesReceivedEscaped-stats.BytesReceived, stats.BytesReceived)
+	}
+
+	/* FramesReceivedValid counts all delimited frames, including the ones with a wrong CRC */
+	received := stats.FramesReceivedValid + stats.FramesReceivedOversized + stats.FramesReceivedInvalid
+	errorCount := stats.FramesReceivedWrongChecksum + stats.FramesReceivedOversized + stats.FramesReceivedInvalid
+	if errorCount > received {
+		received = errorCount
+	}
+
+	m.ErrorRate = ratio(errorCount, received)
+	m.ChecksumErrorRate = ratio(stats.FramesReceivedWrongChecksum, received)
+
+	return m
+}
+
+// Exporter exposes the statistics of named framers in the Prometheus text format and using expvar
+type Exporter struct {
+	sync.Mutex
+
+	prefix  string
+	framers map[string]framerinterface.Framer
+}
+
+// NewExporter creates an exporter. All Prometheus metric names start with prefix, if it is empty "framer" is used.
+func NewExporter(prefix string) *Exporter {
+	if prefix == "" {
+		prefix = "framer"
+	}
+
+	return &Exporter{
+		prefix:  prefix,
+		framers: make(map[string]framerinterface.Framer),
+	}
+}
+
+// Register adds a framer. The name is used as the value of the framer label.
+func (e *Exporter) Register(name string, framer framerinterface.Framer) error {
+	e.Lock()
+	defer e.Unlock()
+
+	if _, ok := e.framers[name]; ok {
+		return ErrorNameInUse
+	}
+
+	e.framers[name] = framer
+	return nil
+}
+
+// Unregister removes a framer
+func (e *Exporter) Unregister(name string) {
+	e.Lock()
+	defer e.Unlock()
+
+	delete(e.framers, name)
+}
+
+type namedMetrics struct {
+	name    string
+	metrics Metrics
+}
+
+func (e *Exporter) collect() []namedMetrics {
+	e.Lock()
+	result := make([]namedMetrics, 0, len(e.framers))
+	for name, framer := range e.framers {
+		result = append(result, namedMetrics{name: name, metrics: Compute(framer.GetStats())})
+	}
+	e.Unlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].name < result[j].name
+	})
+
+	return result
+}
+
+// Snapshot returns the current metrics of all registered framers
+func (e *Exporter) Snapshot() map[string]Metrics {
+	result := make(map[string]Metrics)
+	for _, m := range e.collect() {
+		result[m.name] = m.metrics
+	}
+	return result
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+type metricValue struct {
+	labels string
+	value  func(m *Metrics) float64
+}
+
+type metricFamily struct {
+	name       string
+	metricType string
+	help       string
+	values     []metricValue
+}
+
+func counter(value func(m *Metrics) uint64) func(m *Metrics) float64 {
+	return func(m *Metrics) float64 {
+		return float64(value(m))
+	}
+}
+
+var families = []metricFamily{
+	{"frames_received_total", "counter", "Received frames by status. Valid frames are correctly delimited, but can have a wrong CRC.", []metricValue{
+		{`status="valid"`, counter(func(m *Metrics) uint64 { return m.FramesReceivedValid })},
+		{`status="wrong_checksum"`, counter(func(m *Metrics) uint64 { return m.FramesReceivedWrongChecksum })},
+		{`status="oversized"`, counter(func(m *Metrics) uint64 { return m.FramesReceivedOversized })},
+		{`status="zero_length"`, counter(func(m *Metrics) uint64 { return m.FramesReceivedZeroLength })},
+		{`status="invalid"`, counter(func(m *Metrics) uint64 { return m.FramesReceivedInvalid })},
+		{`status="incomplete"`, counter(func(m *Metrics) uint64 { return m.FramesReceivedIncomplete })},
+	}},
+	{"frames_sent_total", "counter", "Sent frames.", []metricValue{
+		{"", counter(func(m *Metrics) uint64 { return m.FramesSent })},
+	}},
+	{"bytes_sent_total", "counter", "Sent bytes, before (payload) and after (escaped) framing.", []metricValue{
+		{`encoding="payload"`, counter(func(m *Metrics) uint64 { return m.BytesSent })},
+		{`encoding="escaped"`, counter(func(m *Metrics) uint64 { return m.BytesSentEscaped })},
+	}},
+	{"bytes_received_total", "counter", "Received bytes, before (payload) and after (escaped) framing.", []metricValue{
+		{`encoding="payload"`, counter(func(m *Metrics) uint64 { return m.BytesReceived })},
+		{`encoding="escaped"`, counter(func(m *Metrics) uint64 { return m.BytesReceivedEscaped })},
+	}},
+	{"overhead_ratio", "gauge", "Extra bytes per payload byte caused by framing.", []metricValue{
+		{`direction="tx"`, func(m *Metrics) float64 { return m.TxOverhead }},
+		{`direction="rx"`, func(m *Metrics) float64 { return m.RxOverhead }},
+	}},
+	{"receive_error_ratio", "gauge", "Fraction of received frames that was dropped.", []metricValue{
+		{`reason="any"`, func(m *Metrics) float64 { return m.ErrorRate }},
+		{`reason="wrong_checksum"`, func(m *Metrics) float64 { return m.ChecksumErrorRate }},
+	}},
+}
+
+// WritePrometheus writes the metrics of all framers in the Prometheus text exposition format
+func (e *Exporter) WritePrometheus(w io.Writer) error {
+	metrics := e.collect()
+
+	bw := bufio.NewWriter(w)
+	for _, family := range families {
+		name := e.prefix + "_" + family.name
+
+		fmt.Fprintf(bw, "# HELP %s %s\n", name, family.help)
+		fmt.Fprintf(bw, "# TYPE %s %s\n", name, family.metricType)
+
+		for i := range metrics {
+			m := &metrics[i]
+			labels := `framer="` + labelEscaper.Replace(m.name) + `"`
+
+			for _, value := range family.values {
+				if value.labels != "" {
+					fmt.Fprintf(bw, "%s{%s,%s} %g\n", name, labels, value.labels, value.value(&m.metrics))
+				} else {
+					fmt.Fprintf(bw, "%s{%s} %g\n", name, labels, value.value(&m.metrics))
+				}
+			}
+		}
+	}
+
+	return bw.Flush()
+}
+
+// ServeHTTP serves the metrics in the Prometheus text format. The exporter can be added to the mux used by
+// multirunhttp, eg: http.Handle("/metrics", exporter)
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	e.WritePrometheus(w)
+}
+
+// String returns the metrics as JSON, so the exporter can be used as an expvar.Var
+func (e *Exporter) String() string {
+	result, err := json.Marshal(e.Snapshot())
+	if err != nil {
+		return "{}"
+	}
+	return string(result)
+}
+
+// PublishExpvar publishes the metrics using expvar, they can then be read from /debug/vars. Like
+// expvar.Publish it panics if the name is already in use.
+func (e *Exporter) PublishExpvar(name string) {
+	expvar.Publish(name, e)
+}
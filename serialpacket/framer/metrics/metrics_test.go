@@ -0,0 +1,87 @@
+package metrics
+
+import (
+	"encoding/json"
+	"expvar"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/BertoldVdb/go-misc/serialpacket/framer/framerinterface"
+)
+
+type fakeFramer struct {
+	stats framerinterface.BaseStats
+}
+
+func (f *fakeFramer) SendPacket(payload []byte) (int64, error) { return 0, nil }
+func (f *fakeFramer) SetPort(port io.ReadWriter) error         { return nil }
+func (f *fakeFramer) GetStats() framerinterface.BaseStats      { return f.stats }
+func (f *fakeFramer) Run(receivedPacket framerinterface.FramerReceivedPacketHandler) error {
+	return nil
+}
+
+func TestCompute(t *testing.T) {
+	m := Compute(framerinterface.BaseStats{
+		BytesSent:                   100,
+		BytesSentEscaped:            125,
+		BytesReceived:               200,
+		BytesReceivedEscaped:        220,
+		FramesReceivedValid:         8,
+		FramesReceivedWrongChecksum: 2,
+		FramesReceivedOversized:     1,
+		FramesReceivedInvalid:       1,
+	})
+
+	if m.TxOverhead != 0.25 || m.RxOverhead != 0.1 {
+		t.Error("Overhead is wrong", m.TxOverhead, m.RxOverhead)
+	}
+	if m.ErrorRate != 0.4 || m.ChecksumErrorRate != 0.2 {
+		t.Error("Error rate is wrong", m.ErrorRate, m.ChecksumErrorRate)
+	}
+
+	if Compute(framerinterface.BaseStats{}) != (Metrics{}) {
+		t.Error("Empty statistics must not divide by zero")
+	}
+}
+
+func TestExporter(t *testing.T) {
+	e := NewExporter("")
+	e.Register("uart0", &fakeFramer{framerinterface.BaseStats{FramesSent: 3, BytesSent: 10, BytesSentEscaped: 15}})
+	e.Register(`odd"name`, &fakeFramer{})
+
+	if e.Register("uart0", &fakeFramer{}) != ErrorNameInUse {
+		t.Error("Duplicate name accepted")
+	}
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+
+	for _, line := range []string{
+		"# TYPE framer_frames_sent_total counter",
+		`framer_frames_sent_total{framer="uart0"} 3`,
+		`framer_bytes_sent_total{framer="uart0",encoding="escaped"} 15`,
+		`framer_overhead_ratio{framer="uart0",direction="tx"} 0.5`,
+		`framer_frames_sent_total{framer="odd\"name"} 0`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Error("Missing line", line)
+		}
+	}
+
+	e.Unregister(`odd"name`)
+	if len(e.Snapshot()) != 1 {
+		t.Error("Framer was not unregistered")
+	}
+
+	e.PublishExpvar("framer_metrics_test")
+	var decoded map[string]Metrics
+	if err := json.Unmarshal([]byte(expvar.Get("framer_metrics_test").String()), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded["uart0"].FramesSent != 3 || decoded["uart0"].TxOverhead != 0.5 {
+		t.Error("Expvar value is wrong", decoded)
+	}
+}
@@ -0,0 +1,320 @@
+package probe
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/BertoldVdb/go-misc/multicrc"
+	"github.com/BertoldVdb/go-misc/serialpacket/framer"
+	"github.com/BertoldVdb/go-misc/serialpacket/framer/framerinterface"
+)
+
+var (
+	// ErrorNotDetected is returned by Detect when no candidate decoded enough frames with a valid CRC
+	ErrorNotDetected = errors.New("Framing could not be detected")
+)
+
+// Config contains the parameters of the probe. Zero values are replaced by the defaults.
+type Config struct {
+	// Duration is the maximum time spent reading from the port. Default: 2s
+	Duration time.Duration
+
+	// MaxBytes is the maximum amount of bytes that is captured. Default: 65536
+	MaxBytes int
+
+	// Types are the framer types that are tried. Only delimiter based framers are supported.
+	// Default: HDLC, SLIP, COBS, COBSR
+	Types []string
+
+	// Delimiters are the frame delimiter candidates. Default: 0x7E, 0xC0, 0x00
+	Delimiters []byte
+
+	// Escapes are the escape byte candidates (HDLC and SLIP). Default: 0x7D, 0xDB
+	Escapes []byte
+
+	// EscapeXORs are the escape XOR candidates (HDLC). Default: 0x20, 0x40
+	EscapeXORs []byte
+
+	// CRCs are the CRC candidates. Default: all predefined multicrc types
+	CRCs []*multicrc.Params
+
+	// MaxPacketLen is the maximum frame length used while decoding. Default: 4096
+	MaxPacketLen int
+
+	// MinFrames is the minimum amount of frames with a valid CRC that is needed to report a candidate. Default: 3
+	MinFrames int
+}
+
+// DefaultConfig returns the default probe configuration
+func DefaultConfig() *Config {
+	var crcs []*multicrc.Params
+	for _, params := range multicrc.PredefinedParams() {
+		if params.Len > 0 {
+			crcs = append(crcs, params)
+		}
+	}
+
+	return &Config{
+		Duration:     2 * time.Second,
+		MaxBytes:     65536,
+		Types:        []string{"HDLC", "SLIP", "COBS", "COBSR"},
+		Delimiters:   []byte{0x7E, 0xC0, 0x00},
+		Escapes:      []byte{0x7D, 0xDB},
+		EscapeXORs:   []byte{0x20, 0x40},
+		CRCs:         crcs,
+		MaxPacketLen: 4096,
+		MinFrames:    3,
+	}
+}
+
+func (c *Config) withDefaults() *Config {
+	def := DefaultConfig()
+	if c == nil {
+		return def
+	}
+
+	result := *c
+	if result.Duration <= 0 {
+		result.Duration = def.Duration
+	}
+	if result.MaxBytes <= 0 {
+		result.MaxBytes = def.MaxBytes
+	}
+	if len(result.Types) == 0 {
+		result.Types = def.Types
+	}
+	if len(result.Delimiters) == 0 {
+		result.Delimiters = def.Delimiters
+	}
+	if len(result.Escapes) == 0 {
+		result.Escapes = def.Escapes
+	}
+	if len(result.EscapeXORs) == 0 {
+		result.EscapeXORs = def.EscapeXORs
+	}
+	if len(result.CRCs) == 0 {
+		result.CRCs = def.CRCs
+	}
+	if result.MaxPacketLen <= 0 {
+		result.MaxPacketLen = def.MaxPacketLen
+	}
+	if result.MinFrames <= 0 {
+		result.MinFrames = def.MinFrames
+	}
+
+	return &result
+}
+
+// Result describes a candidate framing and how well it matched the captured data
+type Result struct {
+	// Type and Options can be passed to framer.NewFramer
+	Type    string
+	Options *framerinterface.FramerOptions
+
+	// Frames is the amount of non-empty frames that were decoded
+	Frames int
+
+	// FramesValid is the amount of frames with a valid CRC
+	FramesValid int
+
+	crcLen uint
+}
+
+// Rate returns the fraction of frames with a valid CRC
+func (r *Result) Rate() float64 {
+	if r.Frames == 0 {
+		return 0
+	}
+	return float64(r.FramesValid) / float64(r.Frames)
+}
+
+/* candidates returns all framings to try, without CRC */
+func (c *Config) candidates() []Result {
+	var result []Result
+
+	add := func(ft string, options *framerinterface.FramerOptions) {
+		result = append(result, Result{Type: ft, Options: options})
+	}
+
+	var noIgnore [256]bool
+
+	for _, ft := range c.Types {
+		for _, delimiter := range c.Delimiters {
+			base := func() *framerinterface.FramerOptions {
+				return framerinterface.DefaultFramerOptions().
+					Set(framerinterface.OptionMaxPacketLen, c.MaxPacketLen).
+					Set(framerinterface.OptionByteFrameEnd, int(delimiter))
+			}
+
+			switch ft {
+			case "HDLC":
+				for _, escape := range c.Escapes {
+					for _, xor := range c.EscapeXORs {
+						options := func() *framerinterface.FramerOptions {
+							return base().
+								Set(framerinterface.OptionByteFrameStart, int(delimiter)).
+								Set(framerinterface.OptionByteEscape, int(escape)).
+								Set(framerinterface.OptionByteEscapeXOR, int(xor))
+						}
+
+						/* Try the default set of ignored characters first, and also without */
+						add(ft, options())
+						add(ft, options().Set(framerinterface.OptionRxIgnore, noIgnore).Set(framerinterface.OptionTxRxAreEqual, false))
+					}
+				}
+
+			case "SLIP":
+				for _, escape := range c.Escapes {
+					add(ft, base().Set(framerinterface.OptionByteEscape, int(escape)))
+				}
+
+			default:
+				add(ft, base())
+			}
+		}
+	}
+
+	return result
+}
+
+type readWriter struct {
+	io.Reader
+	io.Writer
+}
+
+/* decode returns all non-empty frames found in data, or nil if the framer cannot be created */
+func decode(ft string, options *framerinterface.FramerOptions, data []byte) [][]byte {
+	f, err := framer.NewFramer(ft, readWriter{bytes.NewReader(data), io.Discard}, options)
+	if err != nil {
+		return nil
+	}
+
+	var frames [][]byte
+	f.Run(func(payload []byte, metadata *framerinterface.PacketMetadata) error {
+		frames = append(frames, append([]byte(nil), payload...))
+		return nil
+	})
+
+	return frames
+}
+
+func countValid(frames [][]byte, params *multicrc.Params) int {
+	crc := multicrc.NewCRC(params)
+	crcLen := crc.ResultLenBytes()
+
+	var crcBuf [8]byte
+	valid := 0
+	for _, frame := range frames {
+		if len(frame) <= crcLen {
+			continue
+		}
+
+		crcIndex := len(frame) - crcLen
+		if bytes.Equal(crc.Reset().AddBytes(frame[:crcIndex]).ResultBytes(crcBuf[:], false), frame[crcIndex:]) {
+			valid++
+		}
+	}
+
+	return valid
+}
+
+// ProbeBytes tries all candidate framings on the captured data. The results are sorted by the rate of frames
+// with a valid CRC, best first. Candidates with less than MinFrames valid frames are not returned.
+func ProbeBytes(data []byte, config *Config) []Result {
+	config = config.withDefaults()
+
+	var results []Result
+	for _, candidate := range config.candidates() {
+		frames := decode(candidate.Type, candidate.Options, data)
+		if len(frames) < config.MinFrames {
+			continue
+		}
+
+		for _, params := range config.CRCs {
+			valid := countValid(frames, params)
+			if valid < config.MinFrames {
+				continue
+			}
+
+			result := candidate
+			result.Options = candidate.Options.Clone().Set(framerinterface.OptionCRCParam, params)
+			result.Frames = len(frames)
+			result.FramesValid = valid
+			result.crcLen = params.Len
+			results = append(results, result)
+		}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := &results[i], &results[j]
+		if a.Rate() != b.Rate() {
+			return a.Rate() > b.Rate()
+		}
+		if a.FramesValid != b.FramesValid {
+			return a.FramesValid > b.FramesValid
+		}
+		/* A longer CRC is less likely to match by accident */
+		return a.crcLen > b.crcLen
+	})
+
+	return results
+}
+
+// Capture reads from the port until Duration has passed, MaxBytes were read or the port returns an error.
+// Blocking reads can only be interrupted if the port has a SetReadDeadline method.
+func Capture(port io.Reader, config *Config) ([]byte, error) {
+	config = config.withDefaults()
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.Duration)
+	defer cancel()
+	defer framerinterface.WatchContext(ctx, port)()
+
+	var data bytes.Buffer
+	var tmpBuf [512]byte
+	for data.Len() < config.MaxBytes && ctx.Err() == nil {
+		n, err := port.Read(tmpBuf[:])
+		data.Write(tmpBuf[:n])
+
+		if err != nil {
+			if err == io.EOF || errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			}
+			return data.Bytes(), err
+		}
+	}
+
+	if data.Len() > config.MaxBytes {
+		data.Truncate(config.MaxBytes)
+	}
+
+	return data.Bytes(), nil
+}
+
+// Probe captures data from the port and returns all matching candidates, best first
+func Probe(port io.Reader, config *Config) ([]Result, error) {
+	data, err := Capture(port, config)
+	if err != nil {
+		return nil, err
+	}
+
+	return ProbeBytes(data, config), nil
+}
+
+// Detect captures data from the port and returns the best matching framing
+func Detect(port io.Reader, config *Config) (*Result, error) {
+	results, err := Probe(port, config)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(results) == 0 {
+		return nil, ErrorNotDetected
+	}
+
+	return &results[0], nil
+}
@@ -0,0 +1,121 @@
+package probe
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/BertoldVdb/go-misc/multicrc"
+	"github.com/BertoldVdb/go-misc/serialpacket/framer"
+	"github.com/BertoldVdb/go-misc/serialpacket/framer/framerinterface"
+	"github.com/BertoldVdb/go-misc/serialpacket/framer/testutil"
+)
+
+func generate(t *testing.T, ft string, options *framerinterface.FramerOptions) []byte {
+	var data bytes.Buffer
+	f, err := framer.NewFramer(ft, readWriter{nil, &data}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 20; i++ {
+		f.SendPacket(testutil.RandomBytes(10 + i*5))
+		if i%5 == 0 {
+			data.Write(testutil.RandomBytes(7))
+		}
+	}
+
+	return data.Bytes()
+}
+
+func testDetect(t *testing.T, ft string, options *framerinterface.FramerOptions, expected map[framerinterface.FramerOption]interface{}) {
+	data := generate(t, ft, options)
+
+	result, err := Detect(bytes.NewReader(data), nil)
+	if err != nil {
+		t.Fatal(ft, err)
+	}
+
+	if result.Type != ft {
+		t.Error("Wrong type detected", result.Type, "expected", ft)
+	}
+	/* Every block of garbage causes a frame with a wrong CRC */
+	if result.Rate() < 0.75 {
+		t.Error("Rate is too low", result.Rate())
+	}
+
+	expected[framerinterface.OptionCRCParam], _ = options.Get(framerinterface.OptionCRCParam)
+	for option, value := range expected {
+		if actual, _ := result.Options.Get(option); actual != value {
+			t.Error(ft, option, "detected", actual, "expected", value)
+		}
+	}
+
+	/* The options must be usable to receive the data */
+	f, err := framer.NewFramer(result.Type, readWriter{bytes.NewReader(data), nil}, result.Options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Run(func(payload []byte, metadata *framerinterface.PacketMetadata) error {
+		return nil
+	})
+	if f.GetStats().FramesReceivedValid < 20 {
+		t.Error("Detected options do not decode the data")
+	}
+}
+
+func TestDetect(t *testing.T) {
+	testDetect(t, "HDLC", framerinterface.DefaultFramerOptions().
+		Set(framerinterface.OptionCRCParam, multicrc.Crc16CCITTFALSE),
+		map[framerinterface.FramerOption]interface{}{
+			framerinterface.OptionByteFrameEnd:  0x7E,
+			framerinterface.OptionByteEscape:    0x7D,
+			framerinterface.OptionByteEscapeXOR: 0x20,
+		})
+
+	testDetect(t, "HDLC", framerinterface.DefaultFramerOptions().
+		Set(framerinterface.OptionCRCParam, multicrc.Crc32MPEG2).
+		Set(framerinterface.OptionByteEscapeXOR, 0x40),
+		map[framerinterface.FramerOption]interface{}{
+			framerinterface.OptionByteEscapeXOR: 0x40,
+		})
+
+	testDetect(t, "SLIP", framerinterface.DefaultFramerOptions().
+		Set(framerinterface.OptionCRCParam, multicrc.Crc16MODBUS),
+		map[framerinterface.FramerOption]interface{}{
+			framerinterface.OptionByteFrameEnd: 0xC0,
+			framerinterface.OptionByteEscape:   0xDB,
+		})
+
+	testDetect(t, "COBS", framerinterface.DefaultFramerOptions().
+		Set(framerinterface.OptionCRCParam, multicrc.Crc32C),
+		map[framerinterface.FramerOption]interface{}{
+			framerinterface.OptionByteFrameEnd: 0x00,
+		})
+}
+
+func TestNotDetected(t *testing.T) {
+	/* Use fixed data, random data can contain a few frames that match a CRC8 by accident */
+	data := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	_, err := Detect(bytes.NewReader(data), &Config{Duration: time.Second})
+	if err != ErrorNotDetected {
+		t.Error("Random data was detected", err)
+	}
+}
+
+func TestCaptureTimeout(t *testing.T) {
+	/* The link supports read deadlines, so capturing must stop even though no data arrives */
+	port, _ := testutil.NewLink(nil, nil)
+
+	start := time.Now()
+	data, err := Capture(port, &Config{Duration: 50 * time.Millisecond})
+	if err != nil || len(data) != 0 {
+		t.Error("Unexpected capture result", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("Capture did not stop")
+	}
+}
@@ -0,0 +1,250 @@
+package framer
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/BertoldVdb/go-misc/bufferfifo"
+	pdu "github.com/BertoldVdb/go-misc/pdubuf"
+	"github.com/BertoldVdb/go-misc/serialpacket/framer/framerinterface"
+)
+
+var (
+	// ErrorClosed is returned by Receive when the receiver was closed and all packets were read
+	ErrorClosed = errors.New("Receiver has been closed")
+)
+
+// OverflowPolicy specifies what happens when a packet is received while the queue is full
+type OverflowPolicy int
+
+const (
+	// OverflowDropNewest discards the packet that was just received
+	OverflowDropNewest OverflowPolicy = 0
+
+	// OverflowDropOldest discards the oldest packet in the queue
+	OverflowDropOldest OverflowPolicy = 1
+
+	// OverflowBlock stops the receiver until there is space in the queue
+	OverflowBlock OverflowPolicy = 2
+)
+
+// ReceiverStats contains the statistics of the framer together with the queue counters
+type ReceiverStats struct {
+	framerinterface.BaseStats
+
+	QueueDroppedNewest uint64
+	QueueDroppedOldest uint64
+	QueueBlocked       uint64
+}
+
+// Receiver runs a framer and queues the received packets, so they can be obtained using Receive
+// instead of a callback.
+type Receiver struct {
+	sync.Mutex
+
+	framer framerinterface.Framer
+	depth  int
+	policy OverflowPolicy
+
+	queue    *bufferfifo.FIFO
+	metadata []framerinterface.PacketMetadata
+	freelist *bufferfifo.FIFO
+
+	canReceiveSignal chan (struct{})
+	canQueueSignal   chan (struct{})
+
+	closed   bool
+	closeErr error
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	stats ReceiverStats
+}
+
+// NewReceiver creates a receiver that queues at most depth packets
+func NewReceiver(framer framerinterface.Framer, depth int, policy OverflowPolicy) *Receiver {
+	if depth < 1 {
+		depth = 1
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Receiver{
+		framer:           framer,
+		depth:            depth,
+		policy:           policy,
+		queue:            bufferfifo.New(depth),
+		freelist:         bufferfifo.New(depth),
+		canReceiveSignal: make(chan (struct{}), 1),
+		canQueueSignal:   make(chan (struct{}), 1),
+		ctx:              ctx,
+		cancel:           cancel,
+	}
+}
+
+func signalChannel(c chan (struct{})) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+/* popWithoutLock removes the oldest packet and its metadata. The lock must be held */
+func (r *Receiver) popWithoutLock() (*pdu.PDU, *framerinterface.PacketMetadata) {
+	p := r.queue.Pop()
+	if p == nil {
+		return nil, nil
+	}
+
+	metadata := r.metadata[0]
+	r.metadata = r.metadata[1:]
+
+	return p, &metadata
+}
+
+func (r *Receiver) handlePacket(payload []byte, metadata *framerinterface.PacketMetadata) error {
+	p := r.freelist.Pop()
+	if p == nil {
+		p = pdu.Alloc(0, len(payload), len(payload))
+	} else {
+		p.Realloc(0, len(payload), len(payload))
+	}
+	copy(p.Buf(), payload)
+
+	r.Lock()
+	for r.queue.Len() >= r.depth && !r.closed {
+		switch r.policy {
+		case OverflowDropNewest:
+			r.Unlock()
+			atomic.AddUint64(&r.stats.QueueDroppedNewest, 1)
+			r.freelist.Push(p)
+			return nil
+
+		case OverflowDropOldest:
+			old, _ := r.popWithoutLock()
+			r.freelist.Push(old)
+			atomic.AddUint64(&r.stats.QueueDroppedOldest, 1)
+
+		default:
+			r.Unlock()
+			atomic.AddUint64(&r.stats.QueueBlocked, 1)
+			<-r.canQueueSignal
+			r.Lock()
+		}
+	}
+
+	if r.closed {
+		r.Unlock()
+		return nil
+	}
+
+	r.queue.Push(p)
+	r.metadata = append(r.metadata, *metadata)
+	r.Unlock()
+
+	signalChannel(r.canReceiveSignal)
+	return nil
+}
+
+// Run runs the framer until it returns or Close is called. The error is also returned by Receive once the
+// queue is empty.
+func (r *Receiver) Run() error {
+	var err error
+	if framer, ok := r.framer.(framerinterface.FramerContext); ok {
+		err = framer.RunContext(r.ctx, nil, r.handlePacket)
+	} else {
+		err = r.framer.Run(r.handlePacket)
+	}
+
+	r.Lock()
+	if !r.closed {
+		r.closed = true
+		r.closeErr = err
+	}
+	r.Unlock()
+
+	signalChannel(r.canReceiveSignal)
+	signalChannel(r.canQueueSignal)
+
+	return err
+}
+
+// Close stops the receiver. If the framer does not support RunContext it keeps running until its port is
+// closed, but received packets are discarded.
+func (r *Receiver) Close() error {
+	r.cancel()
+
+	r.Lock()
+	if !r.closed {
+		r.closed = true
+		r.closeErr = ErrorClosed
+	}
+	r.Unlock()
+
+	signalChannel(r.canReceiveSignal)
+	signalChannel(r.canQueueSignal)
+
+	return nil
+}
+
+// Receive returns the oldest queued packet. It blocks until a packet is available, ctx expires or the
+// receiver stops. The returned PDU belongs to the caller, it can be given back using Release.
+func (r *Receiver) Receive(ctx context.Context) (*pdu.PDU, *framerinterface.PacketMetadata, error) {
+	for {
+		r.Lock()
+		p, metadata := r.popWithoutLock()
+		remaining := r.queue.Len()
+		closed := r.closed
+		closeErr := r.closeErr
+		r.Unlock()
+
+		if p != nil {
+			if remaining > 0 || closed {
+				/* Another goroutine can potentially also receive */
+				signalChannel(r.canReceiveSignal)
+			}
+			signalChannel(r.canQueueSignal)
+
+			return p, metadata, nil
+		}
+
+		if closed {
+			signalChannel(r.canReceiveSignal)
+			return nil, nil, closeErr
+		}
+
+		select {
+		case <-r.canReceiveSignal:
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+	}
+}
+
+// Release gives a PDU returned by Receive back to the receiver, so it can be reused
+func (r *Receiver) Release(p *pdu.PDU) {
+	if r.freelist.Len() < r.depth {
+		r.freelist.Push(p)
+	}
+}
+
+// Len returns the number of queued packets
+func (r *Receiver) Len() int {
+	r.Lock()
+	defer r.Unlock()
+
+	return r.queue.Len()
+}
+
+// GetStats returns a safely accessed snapshot of the statistics
+func (r *Receiver) GetStats() ReceiverStats {
+	return ReceiverStats{
+		BaseStats:          r.framer.GetStats(),
+		QueueDroppedNewest: atomic.LoadUint64(&r.stats.QueueDroppedNewest),
+		QueueDroppedOldest: atomic.LoadUint64(&r.stats.QueueDroppedOldest),
+		QueueBlocked:       atomic.LoadUint64(&r.stats.QueueBlocked),
+	}
+}
@@ -0,0 +1,122 @@
+package framer
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/BertoldVdb/go-misc/serialpacket/framer/testutil"
+)
+
+func createReceiver(t *testing.T, depth int, policy OverflowPolicy) (*Receiver, *testutil.LoopbackReadWriter) {
+	loopback := testutil.NewLoopback()
+	framer, err := NewFramer("hdlc", loopback, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewReceiver(framer, depth, policy)
+	go r.Run()
+
+	return r, loopback
+}
+
+func testPackets(n int) [][]byte {
+	var result [][]byte
+	for i := 0; i < n; i++ {
+		result = append(result, testutil.RandomBytes(32))
+	}
+	return result
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	timeout := time.After(time.Second)
+	for !cond() {
+		select {
+		case <-timeout:
+			t.Fatal("Condition was not reached")
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func receiveAndCheck(t *testing.T, r *Receiver, packets [][]byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	for i, m := range packets {
+		p, metadata, err := r.Receive(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(p.Buf(), m) {
+			t.Errorf("Packet %d is wrong", i)
+		}
+		if metadata.RxTime.IsZero() {
+			t.Error("Metadata is missing")
+		}
+		r.Release(p)
+	}
+}
+
+func TestReceiverDropOldest(t *testing.T) {
+	r, loopback := createReceiver(t, 4, OverflowDropOldest)
+	defer loopback.Close()
+
+	packets := testPackets(10)
+	for _, m := range packets {
+		r.framer.SendPacket(m)
+	}
+
+	waitFor(t, func() bool { return r.GetStats().QueueDroppedOldest == 6 })
+	receiveAndCheck(t, r, packets[6:])
+}
+
+func TestReceiverDropNewest(t *testing.T) {
+	r, loopback := createReceiver(t, 4, OverflowDropNewest)
+	defer loopback.Close()
+
+	packets := testPackets(10)
+	for _, m := range packets {
+		r.framer.SendPacket(m)
+	}
+
+	waitFor(t, func() bool { return r.GetStats().QueueDroppedNewest == 6 })
+	receiveAndCheck(t, r, packets[:4])
+}
+
+func TestReceiverBlock(t *testing.T) {
+	r, loopback := createReceiver(t, 2, OverflowBlock)
+
+	packets := testPackets(10)
+	go func() {
+		for _, m := range packets {
+			r.framer.SendPacket(m)
+		}
+	}()
+
+	waitFor(t, func() bool { return r.GetStats().QueueBlocked > 0 })
+	receiveAndCheck(t, r, packets)
+
+	loopback.Close()
+	if _, _, err := r.Receive(context.Background()); err == nil {
+		t.Error("Receive did not fail after closing the port")
+	}
+}
+
+func TestReceiverClose(t *testing.T) {
+	r, loopback := createReceiver(t, 4, OverflowBlock)
+	defer loopback.Close()
+
+	packets := testPackets(1)
+	r.framer.SendPacket(packets[0])
+	waitFor(t, func() bool { return r.Len() == 1 })
+
+	r.Close()
+	receiveAndCheck(t, r, packets)
+
+	if _, _, err := r.Receive(context.Background()); err != ErrorClosed {
+		t.Error("Wrong error after close", err)
+	}
+}
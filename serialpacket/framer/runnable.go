@@ -0,0 +1,44 @@
+package framer
+
+import (
+	"context"
+
+	"github.com/BertoldVdb/go-misc/serialpacket/framer/framerinterface"
+)
+
+// Runnable runs a framer as a multirun.RunnableReady. Closing it stops the receiver without closing the port.
+type Runnable struct {
+	framer  framerinterface.FramerContext
+	handler framerinterface.FramerReceivedPacketHandler
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewRunnable creates a Runnable that passes received packets to handler
+func NewRunnable(framer framerinterface.FramerContext, handler framerinterface.FramerReceivedPacketHandler) *Runnable {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Runnable{
+		framer:  framer,
+		handler: handler,
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+// Run runs the framer until Close is called or an error occurs. Ready is called once the receiver has started.
+func (r *Runnable) Run(ready func()) error {
+	err := r.framer.RunContext(r.ctx, ready, r.handler)
+	if err == context.Canceled {
+		return nil
+	}
+
+	return err
+}
+
+// Close stops the framer
+func (r *Runnable) Close() error {
+	r.cancel()
+	return nil
+}
@@ -0,0 +1,278 @@
+package slip
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/BertoldVdb/go-misc/multicrc"
+	"github.com/BertoldVdb/go-misc/serialpacket/framer/framerinterface"
+)
+
+// SLIP is a packet framer that implements the Serial Line Internet Protocol (RFC 1055)
+type SLIP struct {
+	port         io.ReadWriter
+	maxPacketLen int
+
+	sendBuffer struct {
+		sync.Mutex
+		data bytes.Buffer
+		crc  *multicrc.CRC
+	}
+
+	stats framerinterface.BaseStats
+
+	crcParams *multicrc.Params
+
+	frameEnd           byte
+	frameEscape        byte
+	frameEscapedEnd    byte
+	frameEscapedEscape byte
+
+	monitor framerinterface.FrameMonitor
+}
+
+// NewSLIPFramer is used to create a SLIP framer
+func NewSLIPFramer(port io.ReadWriter, options *framerinterface.FramerOptions) (*SLIP, error) {
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+
+	s := &SLIP{
+		port:               port,
+		crcParams:          options.GetDefault(framerinterface.OptionCRCParam, multicrc.CrcNone).(*multicrc.Params),
+		maxPacketLen:       options.GetInt(framerinterface.OptionMaxPacketLen, 256),
+		frameEnd:           byte(options.GetInt(framerinterface.OptionByteFrameEnd, 0xC0)),
+		frameEscape:        byte(options.GetInt(framerinterface.OptionByteEscape, 0xDB)),
+		frameEscapedEnd:    byte(options.GetInt(framerinterface.OptionByteEscapedFrameEnd, 0xDC)),
+		frameEscapedEscape: byte(options.GetInt(framerinterface.OptionByteEscapedEscape, 0xDD)),
+	}
+
+	/* The escaped symbols must not be special themselves */
+	if s.frameEnd == s.frameEscape || s.frameEscapedEnd == s.frameEscapedEscape ||
+		s.frameEscapedEnd == s.frameEnd || s.frameEscapedEnd == s.frameEscape ||
+		s.frameEscapedEscape == s.frameEnd || s.frameEscapedEscape == s.frameEscape {
+		return nil, errors.New("SLIP special characters are not unique")
+	}
+
+	/* Create CRC module for sender */
+	s.sendBuffer.crc = multicrc.NewCRC(s.crcParams)
+
+	return s, nil
+}
+
+func (s *SLIP) writeEscaped(payload []byte) {
+	for _, m := range payload {
+		if m == s.frameEnd {
+			s.sendBuffer.data.WriteByte(s.frameEscape)
+			s.sendBuffer.data.WriteByte(s.frameEscapedEnd)
+		} else if m == s.frameEscape {
+			s.sendBuffer.data.WriteByte(s.frameEscape)
+			s.sendBuffer.data.WriteByte(s.frameEscapedEscape)
+		} else {
+			s.sendBuffer.data.WriteByte(m)
+		}
+	}
+}
+
+// SendPacket is used to send a packet to the port using SLIP framing
+func (s *SLIP) SendPacket(payload []byte) (int64, error) {
+	s.sendBuffer.Lock()
+	defer s.sendBuffer.Unlock()
+	defer s.sendBuffer.data.Reset()
+
+	/* Leading END flushes any line noise received before the packet */
+	s.sendBuffer.data.WriteByte(s.frameEnd)
+	s.writeEscaped(payload)
+	var crcBuf [8]byte
+	s.writeEscaped(s.sendBuffer.crc.Reset().AddBytes(payload).ResultBytes(crcBuf[:], false))
+	s.sendBuffer.data.WriteByte(s.frameEnd)
+
+	n, err := s.sendBuffer.data.WriteTo(s.port)
+
+	if n > 0 {
+		nu := uint64(n)
+		iu := uint64(len(payload))
+		if iu > nu {
+			iu = nu
+		}
+
+		atomic.AddUint64(&s.stats.FramesSent, 1)
+		atomic.AddUint64(&s.stats.BytesSent, iu)
+		atomic.AddUint64(&s.stats.BytesSentEscaped, nu)
+	}
+
+	return n, err
+}
+
+// SetPort can be used to change the port used by the framer. It may not be executed concurrently
+// with Run
+func (s *SLIP) SetPort(port io.ReadWriter) error {
+	s.sendBuffer.Lock()
+	defer s.sendBuffer.Unlock()
+
+	s.port = port
+
+	return nil
+}
+
+// SetMonitor sets a function that is called for every received frame that is dropped. It may not be
+// executed concurrently with Run
+func (s *SLIP) SetMonitor(monitor framerinterface.FrameMonitor) {
+	s.monitor = monitor
+}
+
+func (s *SLIP) monitorFrame(frame []byte, status framerinterface.FrameStatus, metadata *framerinterface.PacketMetadata) {
+	if s.monitor != nil {
+		metadata.Status = status
+		s.monitor(frame, status, metadata)
+	}
+}
+
+// Run should be called to start the receiver process. It will only return
+// on read errors (eg, port closed)
+func (s *SLIP) Run(receivedPacket framerinterface.FramerReceivedPacketHandler) error {
+	return s.RunContext(context.Background(), nil, receivedPacket)
+}
+
+// RunContext is like Run, but it also returns when ctx is cancelled. A partially received frame is
+// counted in FramesReceivedIncomplete. Ready is called when the receiver has started.
+func (s *SLIP) RunContext(ctx context.Context, ready func(), receivedPacket framerinterface.FramerReceivedPacketHandler) error {
+	var tmpBuf [512]byte
+	var rxBuffer bytes.Buffer
+
+	isEscaped := false
+	isValid := true
+	isFirst := true
+	escapedLen := 0
+
+	reset := func() {
+		isValid = true
+		isEscaped = false
+		isFirst = true
+		escapedLen = 0
+
+		rxBuffer.Reset()
+	}
+
+	var firstByteTimestamp time.Time
+	var lastFrameEnd time.Time
+
+	crc := multicrc.NewCRC(s.crcParams)
+
+	defer framerinterface.WatchContext(ctx, s.port)()
+
+	if ready != nil {
+		ready()
+	}
+
+	for {
+		n, err := s.port.Read(tmpBuf[:])
+		now := time.Now()
+
+		for _, m := range tmpBuf[:n] {
+			atomic.AddUint64(&s.stats.BytesReceivedEscaped, 1)
+			escapedLen++
+
+			if isFirst {
+				firstByteTimestamp = now
+				isFirst = false
+			}
+
+			if m == s.frameEnd {
+				if rxBuffer.Len() > 0 {
+					atomic.AddUint64(&s.stats.BytesReceived, uint64(rxBuffer.Len()))
+
+					frame := rxBuffer.Bytes()
+					pkt := framerinterface.PacketMetadata{
+						RxTime:        firstByteTimestamp,
+						RxTimeEnd:     now,
+						LengthEscaped: escapedLen,
+					}
+					if !lastFrameEnd.IsZero() {
+						pkt.Gap = firstByteTimestamp.Sub(lastFrameEnd)
+					}
+					lastFrameEnd = now
+
+					if isValid && !isEscaped {
+						atomic.AddUint64(&s.stats.FramesReceivedValid, 1)
+
+						if len(frame) < crc.ResultLenBytes() {
+							atomic.AddUint64(&s.stats.FramesReceivedWrongChecksum, 1)
+							s.monitorFrame(frame, framerinterface.FrameWrongChecksum, &pkt)
+						} else {
+							crcIndex := len(frame) - crc.ResultLenBytes()
+							pkt.CRC = framerinterface.CRCValue(frame[crcIndex:], false)
+
+							var crcCalcBuf [8]byte
+							if bytes.Equal(crc.Reset().AddBytes(frame[:crcIndex]).ResultBytes(crcCalcBuf[:], false), frame[crcIndex:]) {
+								err := receivedPacket(frame[:crcIndex], &pkt)
+								if err != nil {
+									return err
+								}
+							} else {
+								atomic.AddUint64(&s.stats.FramesReceivedWrongChecksum, 1)
+								s.monitorFrame(frame, framerinterface.FrameWrongChecksum, &pkt)
+							}
+						}
+					} else if !isValid {
+						s.monitorFrame(frame, framerinterface.FrameOversized, &pkt)
+					} else {
+						atomic.AddUint64(&s.stats.FramesReceivedInvalid, 1)
+						s.monitorFrame(frame, framerinterface.FrameInvalid, &pkt)
+					}
+				} else {
+					atomic.AddUint64(&s.stats.FramesReceivedZeroLength, 1)
+				}
+
+				reset()
+
+			} else if isEscaped {
+				isEscaped = false
+
+				/* RFC 1055: An invalid escape sequence keeps the byte as is */
+				if m == s.frameEscapedEnd {
+					m = s.frameEnd
+				} else if m == s.frameEscapedEscape {
+					m = s.frameEscape
+				}
+
+				if isValid {
+					rxBuffer.WriteByte(m)
+				}
+
+			} else if m == s.frameEscape {
+				isEscaped = true
+
+			} else if isValid {
+				rxBuffer.WriteByte(m)
+			}
+
+			if isValid && s.maxPacketLen > 0 && rxBuffer.Len() > s.maxPacketLen {
+				atomic.AddUint64(&s.stats.FramesReceivedOversized, 1)
+				isValid = false
+			}
+		}
+
+		if ctx.Err() != nil {
+			if rxBuffer.Len() > 0 {
+				atomic.AddUint64(&s.stats.BytesReceived, uint64(rxBuffer.Len()))
+				atomic.AddUint64(&s.stats.FramesReceivedIncomplete, 1)
+			}
+			return ctx.Err()
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// GetStats returns a safely accessed snapshot of the statistics
+func (s *SLIP) GetStats() framerinterface.BaseStats {
+	return s.stats.CopyBaseStatsAtomic()
+}
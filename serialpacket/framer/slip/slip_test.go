@@ -0,0 +1,34 @@
+package slip
+
+import (
+	"testing"
+
+	"github.com/BertoldVdb/go-misc/multicrc"
+	"github.com/BertoldVdb/go-misc/serialpacket/framer/framerinterface"
+
+	"github.com/BertoldVdb/go-misc/serialpacket/framer/testutil"
+)
+
+func testWithOptions(t *testing.T, options *framerinterface.FramerOptions, expectError bool) {
+	/* Use testutil to run the test */
+	framer, err := NewSLIPFramer(nil, options)
+	if expectError {
+		if err == nil {
+			t.Error("Invalid options were accepted")
+		}
+		return
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.FramerRunTests(t, framer)
+}
+
+func TestSLIP(t *testing.T) {
+	testWithOptions(t, nil, false)
+	testWithOptions(t, framerinterface.DefaultFramerOptions().Set(framerinterface.OptionCRCParam, multicrc.Crc16CCITTFALSE), false)
+	testWithOptions(t, framerinterface.DefaultFramerOptions().Set(framerinterface.OptionByteFrameEnd, 0x7E), false)
+
+	testWithOptions(t, framerinterface.DefaultFramerOptions().Set(framerinterface.OptionByteEscape, 0xDC), true)
+}
@@ -0,0 +1,154 @@
+package tap
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	blockTypeSHB = 0x0A0D0D0A
+	blockTypeIDB = 0x00000001
+	blockTypeEPB = 0x00000006
+
+	byteOrderMagic = 0x1A2B3C4D
+
+	optionEnd = 0
+
+	/* Interface description block options */
+	optionIfName  = 2
+	optionTsResol = 9
+
+	/* Enhanced packet block options */
+	optionEPBFlags = 2
+)
+
+// LinkTypeUser0 is the first of the link types reserved for private use (147-162). Wireshark can be
+// configured to dissect them using the DLT_USER table.
+const LinkTypeUser0 = 147
+
+// Flags that can be set on a packet. They are stored in the epb_flags option.
+const (
+	FlagInbound  uint32 = 1
+	FlagOutbound uint32 = 2
+
+	FlagCRCError  uint32 = 1 << 24
+	FlagTooLong   uint32 = 1 << 25
+	FlagTooShort  uint32 = 1 << 26
+	FlagUnaligned uint32 = 1 << 28
+)
+
+// PcapngWriter writes packets to a pcapng stream. It is safe for concurrent use.
+type PcapngWriter struct {
+	sync.Mutex
+
+	w          io.Writer
+	buf        []byte
+	interfaces uint32
+}
+
+// NewPcapngWriter creates a writer and writes the section header
+func NewPcapngWriter(w io.Writer) (*PcapngWriter, error) {
+	p := &PcapngWriter{
+		w: w,
+	}
+
+	var body [16]byte
+	binary.LittleEndian.PutUint32(body[0:], byteOrderMagic)
+	binary.LittleEndian.PutUint16(body[4:], 1)
+	binary.LittleEndian.PutUint16(body[6:], 0)
+	/* Section length is not known */
+	binary.LittleEndian.PutUint64(body[8:], ^uint64(0))
+
+	p.Lock()
+	defer p.Unlock()
+
+	return p, p.writeBlock(blockTypeSHB, body[:], nil)
+}
+
+func appendOption(buf []byte, code uint16, value []byte) []byte {
+	buf = binary.LittleEndian.AppendUint16(buf, code)
+	buf = binary.LittleEndian.AppendUint16(buf, uint16(len(value)))
+	buf = append(buf, value...)
+	for len(buf)%4 != 0 {
+		buf = append(buf, 0)
+	}
+	return buf
+}
+
+/* writeBlock writes a block with the given body and options. The lock must be held */
+func (p *PcapngWriter) writeBlock(blockType uint32, body []byte, options []byte) error {
+	padding := (4 - len(body)%4) % 4
+	length := 12 + len(body) + padding + len(options)
+	if len(options) > 0 {
+		length += 4
+	}
+
+	buf := p.buf[:0]
+	buf = binary.LittleEndian.AppendUint32(buf, blockType)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(length))
+	buf = append(buf, body...)
+	for i := 0; i < padding; i++ {
+		buf = append(buf, 0)
+	}
+	if len(options) > 0 {
+		buf = append(buf, options...)
+		buf = appendOption(buf, optionEnd, nil)
+	}
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(length))
+	p.buf = buf
+
+	_, err := p.w.Write(buf)
+	return err
+}
+
+// AddInterface adds an interface with the given link type and returns its ID. Timestamps are stored with
+// nanosecond resolution. A snapLen of 0 means unlimited.
+func (p *PcapngWriter) AddInterface(linkType uint16, name string, snapLen uint32) (uint32, error) {
+	var body [8]byte
+	binary.LittleEndian.PutUint16(body[0:], linkType)
+	binary.LittleEndian.PutUint32(body[4:], snapLen)
+
+	var options []byte
+	if name != "" {
+		options = appendOption(options, optionIfName, []byte(name))
+	}
+	options = appendOption(options, optionTsResol, []byte{9})
+
+	p.Lock()
+	defer p.Unlock()
+
+	if err := p.writeBlock(blockTypeIDB, body[:], options); err != nil {
+		return 0, err
+	}
+
+	id := p.interfaces
+	p.interfaces++
+
+	return id, nil
+}
+
+// WritePacket writes a packet captured on the given interface. Flags is a combination of the Flag
+// constants, if it is zero the option is omitted.
+func (p *PcapngWriter) WritePacket(iface uint32, timestamp time.Time, data []byte, flags uint32) error {
+	ts := uint64(timestamp.UnixNano())
+
+	body := make([]byte, 20, 20+len(data))
+	binary.LittleEndian.PutUint32(body[0:], iface)
+	binary.LittleEndian.PutUint32(body[4:], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(body[8:], uint32(ts))
+	binary.LittleEndian.PutUint32(body[12:], uint32(len(data)))
+	binary.LittleEndian.PutUint32(body[16:], uint32(len(data)))
+	body = append(body, data...)
+
+	var options []byte
+	if flags != 0 {
+		options = appendOption(options, optionEPBFlags, binary.LittleEndian.AppendUint32(nil, flags))
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	return p.writeBlock(blockTypeEPB, body, options)
+}
@@ -0,0 +1,247 @@
+package tap
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	pdu "github.com/BertoldVdb/go-misc/pdubuf"
+	"github.com/BertoldVdb/go-misc/serialpacket/framer/framerinterface"
+)
+
+// Config contains the parameters of a tap. Zero values are replaced by the defaults.
+type Config struct {
+	// LinkType is the link type used for the frames. Default: LinkTypeUser0
+	LinkType uint16
+
+	// CaptureRaw enables capturing the escaped bytes that are read from and written to the port. They are
+	// stored on a second interface. The port must be given to the tap using SetPort or WrapPort.
+	CaptureRaw bool
+
+	// RawLinkType is the link type used for the escaped bytes. Default: LinkTypeUser0 + 1
+	RawLinkType uint16
+}
+
+// Tap wraps a framer and writes all sent and received frames to a pcapng stream. Frames that are
+// dropped by the framer are also written (with the CRC) if the framer implements FramerMonitor.
+// Received frames are timestamped using PacketMetadata.RxTime.
+type Tap struct {
+	framer framerinterface.Framer
+	writer *PcapngWriter
+	config Config
+
+	frameInterface uint32
+	rawInterface   uint32
+
+	monitor framerinterface.FrameMonitor
+
+	errMutex sync.Mutex
+	err      error
+}
+
+// NewTap creates a tap that writes to w. Config may be nil to use the defaults.
+func NewTap(framer framerinterface.Framer, w io.Writer, config *Config) (*Tap, error) {
+	t := &Tap{
+		framer: framer,
+	}
+
+	if config != nil {
+		t.config = *config
+	}
+	if t.config.LinkType == 0 {
+		t.config.LinkType = LinkTypeUser0
+	}
+	if t.config.RawLinkType == 0 {
+		t.config.RawLinkType = LinkTypeUser0 + 1
+	}
+
+	var err error
+	t.writer, err = NewPcapngWriter(w)
+	if err != nil {
+		return nil, err
+	}
+
+	t.frameInterface, err = t.writer.AddInterface(t.config.LinkType, "frames", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.config.CaptureRaw {
+		t.rawInterface, err = t.writer.AddInterface(t.config.RawLinkType, "raw", 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return t, nil
+}
+
+func (t *Tap) write(iface uint32, timestamp time.Time, data []byte, flags uint32) {
+	t.errMutex.Lock()
+	defer t.errMutex.Unlock()
+
+	if t.err != nil {
+		return
+	}
+
+	t.err = t.writer.WritePacket(iface, timestamp, data, flags)
+}
+
+// Err returns the first error that occurred while writing the capture. Once an error has occurred
+// nothing more is written.
+func (t *Tap) Err() error {
+	t.errMutex.Lock()
+	defer t.errMutex.Unlock()
+
+	return t.err
+}
+
+// SendPacket sends the packet using the framer and writes it to the capture
+func (t *Tap) SendPacket(payload []byte) (int64, error) {
+	timestamp := time.Now()
+
+	n, err := t.framer.SendPacket(payload)
+	if n > 0 {
+		t.write(t.frameInterface, timestamp, payload, FlagOutbound)
+	}
+
+	return n, err
+}
+
+// SendPDU sends the PDU using the framer and writes it to the capture. If the framer does not implement
+// FramerPDU the payload is sent using SendPacket.
+func (t *Tap) SendPDU(p *pdu.PDU) (int64, error) {
+	framer, ok := t.framer.(framerinterface.FramerPDU)
+	if !ok {
+		return t.SendPacket(p.Buf())
+	}
+
+	timestamp := time.Now()
+
+	n, err := framer.SendPDU(p)
+	if n > 0 {
+		t.write(t.frameInterface, timestamp, p.Buf(), FlagOutbound)
+	}
+
+	return n, err
+}
+
+// WrapPort returns a port that writes all bytes that pass through it to the capture if CaptureRaw is set.
+// It can be used to create the framer.
+func (t *Tap) WrapPort(port io.ReadWriter) io.ReadWriter {
+	if !t.config.CaptureRaw || port == nil {
+		return port
+	}
+
+	return &rawPort{
+		ReadWriter: port,
+		tap:        t,
+	}
+}
+
+// SetPort changes the port of the framer. If CaptureRaw is set the port is wrapped first.
+func (t *Tap) SetPort(port io.ReadWriter) error {
+	return t.framer.SetPort(t.WrapPort(port))
+}
+
+// GetStats returns the statistics of the framer
+func (t *Tap) GetStats() framerinterface.BaseStats {
+	return t.framer.GetStats()
+}
+
+// SetMonitor sets a function that is called for every frame dropped by the framer, in addition to writing
+// it to the capture. It may not be executed concurrently with Run
+func (t *Tap) SetMonitor(monitor framerinterface.FrameMonitor) {
+	t.monitor = monitor
+}
+
+func inboundFlags(status framerinterface.FrameStatus) uint32 {
+	flags := FlagInbound
+	switch status {
+	case framerinterface.FrameWrongChecksum:
+		flags |= FlagCRCError
+	case framerinterface.FrameOversized:
+		flags |= FlagTooLong
+	case framerinterface.FrameInvalid:
+		flags |= FlagUnaligned
+	}
+
+	return flags
+}
+
+func (t *Tap) handleDropped(frame []byte, status framerinterface.FrameStatus, metadata *framerinterface.PacketMetadata) {
+	t.write(t.frameInterface, metadata.RxTime, frame, inboundFlags(status))
+
+	if t.monitor != nil {
+		t.monitor(frame, status, metadata)
+	}
+}
+
+func (t *Tap) wrapHandler(receivedPacket framerinterface.FramerReceivedPacketHandler) framerinterface.FramerReceivedPacketHandler {
+	if framer, ok := t.framer.(framerinterface.FramerMonitor); ok {
+		framer.SetMonitor(t.handleDropped)
+	}
+
+	return func(payload []byte, metadata *framerinterface.PacketMetadata) error {
+		/* With OptionDeliverInvalid the framer also passes bad frames to the handler */
+		t.write(t.frameInterface, metadata.RxTime, payload, inboundFlags(metadata.Status))
+		return receivedPacket(payload, metadata)
+	}
+}
+
+// Run runs the framer and writes all received frames to the capture
+func (t *Tap) Run(receivedPacket framerinterface.FramerReceivedPacketHandler) error {
+	return t.framer.Run(t.wrapHandler(receivedPacket))
+}
+
+// RunContext is like Run, but it also returns when ctx is cancelled. If the framer does not implement
+// FramerContext it is only stopped when the port is closed.
+func (t *Tap) RunContext(ctx context.Context, ready func(), receivedPacket framerinterface.FramerReceivedPacketHandler) error {
+	framer, ok := t.framer.(framerinterface.FramerContext)
+	if !ok {
+		if ready != nil {
+			ready()
+		}
+		return t.Run(receivedPacket)
+	}
+
+	return framer.RunContext(ctx, ready, t.wrapHandler(receivedPacket))
+}
+
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+/* rawPort writes the escaped bytes to the capture */
+type rawPort struct {
+	io.ReadWriter
+	tap *Tap
+}
+
+func (r *rawPort) Read(p []byte) (int, error) {
+	n, err := r.ReadWriter.Read(p)
+	if n > 0 {
+		r.tap.write(r.tap.rawInterface, time.Now(), p[:n], FlagInbound)
+	}
+	return n, err
+}
+
+func (r *rawPort) Write(p []byte) (int, error) {
+	timestamp := time.Now()
+
+	n, err := r.ReadWriter.Write(p)
+	if n > 0 {
+		r.tap.write(r.tap.rawInterface, timestamp, p[:n], FlagOutbound)
+	}
+	return n, err
+}
+
+/* SetReadDeadline is forwarded so RunContext can still interrupt reads */
+func (r *rawPort) SetReadDeadline(t time.Time) error {
+	if deadliner, ok := r.ReadWriter.(readDeadliner); ok {
+		return deadliner.SetReadDeadline(t)
+	}
+	return os.ErrNoDeadline
+}
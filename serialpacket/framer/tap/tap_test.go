@@ -0,0 +1,150 @@
+package tap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/BertoldVdb/go-misc/multicrc"
+	"github.com/BertoldVdb/go-misc/serialpacket/framer/framerinterface"
+	"github.com/BertoldVdb/go-misc/serialpacket/framer/hdlc"
+)
+
+type testPort struct {
+	io.Reader
+	io.Writer
+}
+
+type capturedPacket struct {
+	iface uint32
+	data  []byte
+	flags uint32
+}
+
+func parseCapture(t *testing.T, capture []byte) ([]uint16, []capturedPacket) {
+	var linkTypes []uint16
+	var packets []capturedPacket
+
+	for len(capture) > 0 {
+		if len(capture) < 12 {
+			t.Fatal("Truncated block")
+		}
+
+		blockType := binary.LittleEndian.Uint32(capture)
+		length := binary.LittleEndian.Uint32(capture[4:])
+		if length%4 != 0 || int(length) > len(capture) || binary.LittleEndian.Uint32(capture[length-4:]) != length {
+			t.Fatal("Invalid block length")
+		}
+		body := capture[8 : length-4]
+
+		switch blockType {
+		case blockTypeSHB:
+			if binary.LittleEndian.Uint32(body) != byteOrderMagic {
+				t.Fatal("Wrong byte order magic")
+			}
+		case blockTypeIDB:
+			linkTypes = append(linkTypes, binary.LittleEndian.Uint16(body))
+		case blockTypeEPB:
+			capLen := binary.LittleEndian.Uint32(body[12:])
+			pkt := capturedPacket{
+				iface: binary.LittleEndian.Uint32(body),
+				data:  body[20 : 20+capLen],
+			}
+
+			options := body[20+(capLen+3)/4*4:]
+			if len(options) >= 8 && binary.LittleEndian.Uint16(options) == optionEPBFlags {
+				pkt.flags = binary.LittleEndian.Uint32(options[4:])
+			}
+			packets = append(packets, pkt)
+		}
+
+		capture = capture[length:]
+	}
+
+	return linkTypes, packets
+}
+
+func TestTap(t *testing.T) {
+	options := framerinterface.DefaultFramerOptions().
+		Set(framerinterface.OptionCRCParam, multicrc.Crc16CCITTFALSE).
+		Set(framerinterface.OptionMaxPacketLen, 16)
+
+	/* Generate the received data using a second framer */
+	var input bytes.Buffer
+	remote, _ := hdlc.NewHDLCFramer(&testPort{Writer: &input}, options)
+	remote.SendPacket([]byte("Hello"))
+	remote.SendPacket([]byte("Broken"))
+	input.Bytes()[input.Len()-3] ^= 0x01
+	remote.SendPacket([]byte("This frame is too long"))
+
+	var output bytes.Buffer
+	framer, _ := hdlc.NewHDLCFramer(nil, options)
+
+	var capture bytes.Buffer
+	tap, err := NewTap(framer, &capture, &Config{CaptureRaw: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tap.SetPort(&testPort{Reader: &input, Writer: &output})
+
+	tap.SendPacket([]byte("Request"))
+
+	var dropped []framerinterface.FrameStatus
+	tap.SetMonitor(func(frame []byte, status framerinterface.FrameStatus, metadata *framerinterface.PacketMetadata) {
+		dropped = append(dropped, status)
+	})
+
+	if err := tap.Run(func(payload []byte, metadata *framerinterface.PacketMetadata) error {
+		return nil
+	}); err != io.EOF {
+		t.Error("Unexpected error", err)
+	}
+
+	if tap.Err() != nil {
+		t.Fatal(tap.Err())
+	}
+	if len(dropped) != 2 || dropped[0] != framerinterface.FrameWrongChecksum || dropped[1] != framerinterface.FrameOversized {
+		t.Error("Monitor was not called correctly", dropped)
+	}
+
+	linkTypes, packets := parseCapture(t, capture.Bytes())
+	if len(linkTypes) != 2 || linkTypes[0] != LinkTypeUser0 || linkTypes[1] != LinkTypeUser0+1 {
+		t.Fatal("Wrong interfaces", linkTypes)
+	}
+
+	var frames []capturedPacket
+	var rawIn, rawOut []byte
+	for _, pkt := range packets {
+		if pkt.iface == 0 {
+			frames = append(frames, pkt)
+		} else if pkt.flags == FlagInbound {
+			rawIn = append(rawIn, pkt.data...)
+		} else {
+			rawOut = append(rawOut, pkt.data...)
+		}
+	}
+
+	if len(frames) != 4 {
+		t.Fatal("Wrong amount of frames captured", len(frames))
+	}
+	if !bytes.Equal(frames[0].data, []byte("Request")) || frames[0].flags != FlagOutbound {
+		t.Error("Sent frame is wrong")
+	}
+	if !bytes.Equal(frames[1].data, []byte("Hello")) || frames[1].flags != FlagInbound {
+		t.Error("Received frame is wrong")
+	}
+	if !bytes.HasPrefix(frames[2].data, []byte("Broken")) || frames[2].flags != FlagInbound|FlagCRCError {
+		t.Error("Frame with wrong CRC is wrong")
+	}
+	if frames[3].flags != FlagInbound|FlagTooLong {
+		t.Error("Oversized frame is wrong")
+	}
+
+	if !bytes.Equal(rawOut, output.Bytes()) {
+		t.Error("Raw sent bytes are wrong")
+	}
+	if len(rawIn) == 0 || !bytes.HasSuffix(rawIn, []byte{0x7E}) {
+		t.Error("Raw received bytes are wrong")
+	}
+}
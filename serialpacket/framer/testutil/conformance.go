@@ -0,0 +1,254 @@
+package testutil
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BertoldVdb/go-misc/multicrc"
+	"github.com/BertoldVdb/go-misc/serialpacket/framer/framerinterface"
+)
+
+// FramerConstructor creates a framer that uses the given port
+type FramerConstructor func(port io.ReadWriter, options *framerinterface.FramerOptions) (framerinterface.Framer, error)
+
+const (
+	conformancePackets  = 100
+	conformanceProbes   = 100
+	conformanceRecovery = 10
+)
+
+/* conformanceSpecial contains the special characters and escape codes of all framers with their default
+ * options. Payloads use them often, so faults regularly hit delimiters and escape sequences. */
+var conformanceSpecial = []byte{0x00, 0x7E, 0x7D, 0x5E, 0x5D, 0xC0, 0xDB, 0xDC, 0xDD, 0xAA, 0x55, 'B'}
+
+type conformanceScenario struct {
+	name   string
+	config LinkConfig
+
+	/* injected returns true if the scenario really injected its fault */
+	injected func(stats LinkStats, elapsed time.Duration) bool
+}
+
+func conformanceScenarios() []conformanceScenario {
+	return []conformanceScenario{
+		{
+			name:   "rate",
+			config: LinkConfig{BaudRate: 1000000},
+			injected: func(stats LinkStats, elapsed time.Duration) bool {
+				return elapsed >= time.Duration(stats.BytesDelivered)*10*time.Microsecond
+			},
+		}, {
+			name:     "fragmented",
+			config:   LinkConfig{MaxReadSize: 7, Seed: 1},
+			injected: func(stats LinkStats, elapsed time.Duration) bool { return stats.ReadsFragmented > 0 },
+		}, {
+			name:     "biterrors",
+			config:   LinkConfig{BitErrorRate: 1e-3, MaxReadSize: 64, Seed: 2},
+			injected: func(stats LinkStats, elapsed time.Duration) bool { return stats.BitsFlipped > 0 },
+		}, {
+			name:     "drops",
+			config:   LinkConfig{DropRate: 1e-2, MaxReadSize: 64, Seed: 3},
+			injected: func(stats LinkStats, elapsed time.Duration) bool { return stats.BytesDropped > 0 },
+		}, {
+			name:     "bursts",
+			config:   LinkConfig{BurstRate: 1e-2, BurstLength: 4, MaxReadSize: 64, Seed: 4},
+			injected: func(stats LinkStats, elapsed time.Duration) bool { return stats.Bursts > 0 },
+		}, {
+			name:     "garbage",
+			config:   LinkConfig{GarbageRate: 0.3, GarbageLength: 16, MaxReadSize: 64, Seed: 5},
+			injected: func(stats LinkStats, elapsed time.Duration) bool { return stats.GarbageInserted > 0 },
+		}, {
+			name: "all",
+			config: LinkConfig{BitErrorRate: 5e-4, DropRate: 5e-3, BurstRate: 5e-3, BurstLength: 3, GarbageRate: 0.1, GarbageLength: 16,
+				MaxReadSize: 13, Seed: 6},
+			injected: func(stats LinkStats, elapsed time.Duration) bool {
+				return stats.WritesImpaired > 0 && stats.GarbageInserted > 0
+			},
+		},
+	}
+}
+
+/* conformancePayloads returns payloads over the full byte range, every other one mostly made of special characters */
+func conformancePayloads(seed int64) [][]byte {
+	r := rand.New(rand.NewSource(seed))
+
+	payloads := make([][]byte, conformancePackets)
+	for i := range payloads {
+		payload := make([]byte, 16+r.Intn(80))
+		for j := range payload {
+			if i%2 == 1 && r.Intn(4) > 0 {
+				payload[j] = conformanceSpecial[r.Intn(len(conformanceSpecial))]
+			} else {
+				payload[j] = byte(r.Intn(256))
+			}
+		}
+		payloads[i] = payload
+	}
+
+	return payloads
+}
+
+func runConformanceScenario(t *testing.T, create FramerConstructor, scenario *conformanceScenario) {
+	options := framerinterface.DefaultFramerOptions().Set(framerinterface.OptionCRCParam, multicrc.Crc32MPEG2)
+
+	a, b := NewLink(&scenario.config, nil)
+	tx, err := create(a, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rx, err := create(b, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var rxMutex sync.Mutex
+	var received [][]byte
+	probeReceived := func() bool {
+		rxMutex.Lock()
+		defer rxMutex.Unlock()
+		return len(received) > 0 && bytes.HasPrefix(received[len(received)-1], []byte("Probe "))
+	}
+
+	done := make(chan (error), 1)
+	go func() {
+		done <- rx.Run(func(payload []byte, metadata *framerinterface.PacketMetadata) error {
+			rxMutex.Lock()
+			received = append(received, append([]byte(nil), payload...))
+			rxMutex.Unlock()
+			return nil
+		})
+	}()
+
+	start := time.Now()
+
+	payloads := conformancePayloads(scenario.config.Seed)
+	for _, payload := range payloads {
+		tx.SendPacket(payload)
+	}
+
+	/* After the faults stop, the framer must find the next frame. A false frame start can make it wait
+	 * for more data, so probes are sent until one of them arrives. */
+	a.SetConfig(&LinkConfig{BaudRate: scenario.config.BaudRate, MaxReadSize: scenario.config.MaxReadSize})
+	recovered := false
+	for i := 0; i < conformanceProbes && !recovered; i++ {
+		probe := []byte(fmt.Sprintf("Probe %d", i))
+		tx.SendPacket(probe)
+		payloads = append(payloads, probe)
+
+		for wait := 0; wait < 10 && !recovered; wait++ {
+			time.Sleep(time.Millisecond)
+			recovered = probeReceived()
+		}
+	}
+	if !recovered {
+		t.Error("Framer did not recover after the faults")
+	}
+
+	/* Once a frame was received, the framer is synchronized and must not lose any packet */
+	for i := 0; i < conformanceRecovery; i++ {
+		packet := []byte(fmt.Sprintf("Recovery %d", i))
+		tx.SendPacket(packet)
+		payloads = append(payloads, packet)
+	}
+	a.Close()
+
+	select {
+	case err := <-done:
+		if err != io.EOF {
+			t.Error("Wrong error returned after closing", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Framer did not stop")
+	}
+
+	link := a.GetStats()
+	txStats := tx.GetStats()
+	rxStats := rx.GetStats()
+
+	if !scenario.injected(link, time.Since(start)) {
+		t.Error("Fault was not injected")
+	}
+
+	/* Every received packet must have been sent, in order */
+	i := 0
+	for _, r := range received {
+		for i < len(payloads) && !bytes.Equal(payloads[i], r) {
+			i++
+		}
+		if i == len(payloads) {
+			t.Fatal("Received corrupted or reordered packet")
+		}
+		i++
+	}
+
+	if len(received) < conformanceRecovery {
+		t.Fatal("Recovery packets were lost", len(received))
+	}
+	tail := received[len(received)-conformanceRecovery:]
+	for i, r := range tail {
+		if !bytes.Equal(r, payloads[len(payloads)-conformanceRecovery+i]) {
+			t.Error("Recovery packet", i, "was lost")
+		}
+	}
+
+	if scenario.config == (LinkConfig{BaudRate: scenario.config.BaudRate, MaxReadSize: scenario.config.MaxReadSize, Seed: scenario.config.Seed}) &&
+		len(received) != len(payloads) {
+		t.Error("Packets were lost on a link without faults", len(received), len(payloads))
+	}
+
+	var bytesSent uint64
+	for _, payload := range payloads {
+		bytesSent += uint64(len(payload))
+	}
+	if txStats.FramesSent != uint64(len(payloads)) || txStats.BytesSent != bytesSent {
+		t.Error("Sent statistics are wrong", txStats)
+	}
+	if txStats.BytesSentEscaped != link.BytesWritten {
+		t.Error("BytesSentEscaped", txStats.BytesSentEscaped, "does not match link", link.BytesWritten)
+	}
+
+	if link.BytesDelivered != link.BytesWritten-link.BytesDropped+link.BytesGarbage {
+		t.Error("Link lost bytes")
+	}
+	if rxStats.BytesReceivedEscaped != link.BytesDelivered {
+		t.Error("BytesReceivedEscaped", rxStats.BytesReceivedEscaped, "does not match link", link.BytesDelivered)
+	}
+
+	/* FramesReceivedValid also counts complete frames with a wrong checksum, those are not delivered */
+	delivered := uint64(len(received))
+	if rxStats.FramesReceivedValid < delivered || rxStats.FramesReceivedValid-delivered > rxStats.FramesReceivedWrongChecksum {
+		t.Error("FramesReceivedValid", rxStats.FramesReceivedValid, "does not match delivered packets", delivered, rxStats)
+	}
+
+	/* A lost packet must show up as an error, a perfect link must not cause any */
+	errorCount := rxStats.FramesReceivedWrongChecksum + rxStats.FramesReceivedInvalid + rxStats.FramesReceivedOversized
+	if len(received) < len(payloads) && errorCount == 0 {
+		t.Error("Packets were lost without errors", rxStats)
+	}
+	if link.BitsFlipped+link.BytesBurstDamage+link.BytesDropped > 0 &&
+		rxStats.FramesReceivedWrongChecksum+rxStats.FramesReceivedInvalid == 0 {
+		t.Error("Damaged frames were not counted", rxStats)
+	}
+	if link.WritesImpaired == 0 && link.GarbageInserted == 0 &&
+		errorCount+rxStats.FramesReceivedIncomplete != 0 {
+		t.Error("Errors were counted on a perfect link", rxStats)
+	}
+}
+
+// FramerConformance sends packets over a simulated serial link with different impairments, which also hit
+// delimiters and escape sequences. It verifies that the framer never delivers a corrupted packet, that it
+// recovers when the faults stop and that its counters match the link and the injected faults. The framer must send every
+// packet using a single write.
+func FramerConformance(t *testing.T, create FramerConstructor) {
+	for _, scenario := range conformanceScenarios() {
+		scenario := scenario
+		t.Run(scenario.name, func(t *testing.T) {
+			runConformanceScenario(t, create, &scenario)
+		})
+	}
+}
@@ -0,0 +1,326 @@
+package testutil
+
+import (
+	"io"
+	"math/rand"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LinkConfig describes the impairments of one direction of a simulated serial link. The zero value is a
+// perfect link without rate limiting.
+type LinkConfig struct {
+	// BaudRate limits the speed of the link. Every byte takes 10 bit times. If <=0 the speed is unlimited.
+	BaudRate int
+
+	// BitErrorRate is the probability that a bit is flipped
+	BitErrorRate float64
+
+	// DropRate is the probability that a byte is lost
+	DropRate float64
+
+	// BurstRate is the probability that a burst of BurstLength corrupted bytes starts at a byte
+	BurstRate   float64
+	BurstLength int
+
+	// GarbageRate is the probability that between 1 and GarbageLength random bytes are inserted before a write
+	GarbageRate   float64
+	GarbageLength int
+
+	// MaxReadSize limits the amount of bytes returned by a read. Every read returns a random amount
+	// between 1 and MaxReadSize. If <=0 reads are not fragmented.
+	MaxReadSize int
+
+	// Seed is used to initialize the random generator, so the impairments are reproducible
+	Seed int64
+}
+
+// LinkStats counts the faults that were injected in one direction of the link
+type LinkStats struct {
+	Writes         uint64
+	WritesImpaired uint64
+
+	BytesWritten   uint64
+	BytesDelivered uint64
+
+	BitsFlipped      uint64
+	BytesDropped     uint64
+	Bursts           uint64
+	GarbageInserted  uint64
+	BytesGarbage     uint64
+	ReadsFragmented  uint64
+	BytesBurstDamage uint64
+}
+
+type linkDirection struct {
+	sync.Mutex
+	cond *sync.Cond
+
+	config LinkConfig
+	rand   *rand.Rand
+
+	data     []byte
+	times    []time.Time
+	lastTime time.Time
+
+	closed   bool
+	deadline time.Time
+	timer    *time.Timer
+
+	stats LinkStats
+}
+
+func newLinkDirection(config *LinkConfig) *linkDirection {
+	d := &linkDirection{}
+	d.cond = sync.NewCond(&d.Mutex)
+	d.setConfig(config)
+
+	return d
+}
+
+func (d *linkDirection) setConfig(config *LinkConfig) {
+	d.Lock()
+	defer d.Unlock()
+
+	if config == nil {
+		config = &LinkConfig{}
+	}
+	d.config = *config
+	d.rand = rand.New(rand.NewSource(config.Seed))
+}
+
+/* impair applies the configured faults to p. The lock must be held */
+func (d *linkDirection) impair(p []byte) []byte {
+	c := &d.config
+	out := make([]byte, 0, len(p)+c.GarbageLength)
+
+	if c.GarbageRate > 0 && c.GarbageLength > 0 && d.rand.Float64() < c.GarbageRate {
+		n := 1 + d.rand.Intn(c.GarbageLength)
+		for i := 0; i < n; i++ {
+			out = append(out, byte(d.rand.Intn(256)))
+		}
+
+		atomic.AddUint64(&d.stats.GarbageInserted, 1)
+		atomic.AddUint64(&d.stats.BytesGarbage, uint64(n))
+	}
+
+	impaired := false
+	burst := 0
+
+	for _, b := range p {
+		if c.DropRate > 0 && d.rand.Float64() < c.DropRate {
+			atomic.AddUint64(&d.stats.BytesDropped, 1)
+			impaired = true
+			continue
+		}
+
+		if burst == 0 && c.BurstRate > 0 && c.BurstLength > 0 && d.rand.Float64() < c.BurstRate {
+			atomic.AddUint64(&d.stats.Bursts, 1)
+			burst = c.BurstLength
+		}
+
+		if burst > 0 {
+			burst--
+
+			b ^= byte(1 + d.rand.Intn(255))
+			atomic.AddUint64(&d.stats.BytesBurstDamage, 1)
+			impaired = true
+		}
+
+		if c.BitErrorRate > 0 {
+			for bit := 0; bit < 8; bit++ {
+				if d.rand.Float64() < c.BitErrorRate {
+					b ^= 1 << uint(bit)
+					atomic.AddUint64(&d.stats.BitsFlipped, 1)
+					impaired = true
+				}
+			}
+		}
+
+		out = append(out, b)
+	}
+
+	if impaired {
+		atomic.AddUint64(&d.stats.WritesImpaired, 1)
+	}
+
+	return out
+}
+
+func (d *linkDirection) write(p []byte) (int, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	atomic.AddUint64(&d.stats.Writes, 1)
+	atomic.AddUint64(&d.stats.BytesWritten, uint64(len(p)))
+
+	out := d.impair(p)
+
+	var byteTime time.Duration
+	if d.config.BaudRate > 0 {
+		byteTime = 10 * time.Second / time.Duration(d.config.BaudRate)
+	}
+
+	now := time.Now()
+	if d.lastTime.Before(now) {
+		d.lastTime = now
+	}
+
+	for _, b := range out {
+		d.lastTime = d.lastTime.Add(byteTime)
+		d.data = append(d.data, b)
+		d.times = append(d.times, d.lastTime)
+	}
+
+	d.cond.Broadcast()
+
+	return len(p), nil
+}
+
+func (d *linkDirection) read(p []byte) (int, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	for {
+		now := time.Now()
+
+		if !d.deadline.IsZero() && !now.Before(d.deadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+
+		if len(d.data) > 0 {
+			if wait := d.times[0].Sub(now); wait > 0 {
+				d.Unlock()
+				time.Sleep(wait)
+				d.Lock()
+				continue
+			}
+
+			n := 0
+			for n < len(d.data) && n < len(p) && !d.times[n].After(now) {
+				n++
+			}
+
+			if d.config.MaxReadSize > 0 {
+				max := 1 + d.rand.Intn(d.config.MaxReadSize)
+				if n > max {
+					n = max
+					atomic.AddUint64(&d.stats.ReadsFragmented, 1)
+				}
+			}
+
+			copy(p, d.data[:n])
+			d.data = d.data[n:]
+			d.times = d.times[n:]
+
+			atomic.AddUint64(&d.stats.BytesDelivered, uint64(n))
+			return n, nil
+		}
+
+		if d.closed {
+			return 0, io.EOF
+		}
+
+		d.cond.Wait()
+	}
+}
+
+func (d *linkDirection) setReadDeadline(t time.Time) {
+	d.Lock()
+	defer d.Unlock()
+
+	d.deadline = t
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+
+	if !t.IsZero() {
+		d.timer = time.AfterFunc(time.Until(t), func() {
+			d.Lock()
+			d.cond.Broadcast()
+			d.Unlock()
+		})
+	}
+
+	d.cond.Broadcast()
+}
+
+func (d *linkDirection) close() {
+	d.Lock()
+	defer d.Unlock()
+
+	d.closed = true
+	d.cond.Broadcast()
+}
+
+func (d *linkDirection) getStats() LinkStats {
+	return LinkStats{
+		Writes:           atomic.LoadUint64(&d.stats.Writes),
+		WritesImpaired:   atomic.LoadUint64(&d.stats.WritesImpaired),
+		BytesWritten:     atomic.LoadUint64(&d.stats.BytesWritten),
+		BytesDelivered:   atomic.LoadUint64(&d.stats.BytesDelivered),
+		BitsFlipped:      atomic.LoadUint64(&d.stats.BitsFlipped),
+		BytesDropped:     atomic.LoadUint64(&d.stats.BytesDropped),
+		Bursts:           atomic.LoadUint64(&d.stats.Bursts),
+		GarbageInserted:  atomic.LoadUint64(&d.stats.GarbageInserted),
+		BytesGarbage:     atomic.LoadUint64(&d.stats.BytesGarbage),
+		ReadsFragmented:  atomic.LoadUint64(&d.stats.ReadsFragmented),
+		BytesBurstDamage: atomic.LoadUint64(&d.stats.BytesBurstDamage),
+	}
+}
+
+// LinkEnd is one end of a simulated serial link. Bytes written to it are impaired according to the
+// configuration of its transmit direction and can be read from the other end.
+type LinkEnd struct {
+	rx *linkDirection
+	tx *linkDirection
+}
+
+// NewLink creates a simulated serial link. The first end transmits using configAB, the second using configBA.
+// Either config may be nil for a perfect direction.
+func NewLink(configAB *LinkConfig, configBA *LinkConfig) (*LinkEnd, *LinkEnd) {
+	ab := newLinkDirection(configAB)
+	ba := newLinkDirection(configBA)
+
+	return &LinkEnd{rx: ba, tx: ab}, &LinkEnd{rx: ab, tx: ba}
+}
+
+// Read reads bytes sent by the other end. It returns io.EOF once the link is closed and all bytes were read.
+func (l *LinkEnd) Read(p []byte) (int, error) {
+	return l.rx.read(p)
+}
+
+// Write sends bytes to the other end. It does not block, the bytes become available at the rate of the link.
+func (l *LinkEnd) Write(p []byte) (int, error) {
+	return l.tx.write(p)
+}
+
+// SetReadDeadline interrupts blocking reads at the given time. A zero value disables the deadline.
+func (l *LinkEnd) SetReadDeadline(t time.Time) error {
+	l.rx.setReadDeadline(t)
+	return nil
+}
+
+// SetConfig changes the impairments of the transmit direction. The random generator is reseeded.
+func (l *LinkEnd) SetConfig(config *LinkConfig) {
+	l.tx.setConfig(config)
+}
+
+// GetStats returns the faults that were injected in the transmit direction
+func (l *LinkEnd) GetStats() LinkStats {
+	return l.tx.getStats()
+}
+
+// Close closes both directions. The other end can still read the bytes that are in transit.
+func (l *LinkEnd) Close() error {
+	l.tx.close()
+	l.rx.close()
+	return nil
+}
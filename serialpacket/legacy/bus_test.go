@@ -0,0 +1,69 @@
+package serialpacket
+
+import (
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/BertoldVdb/go-misc/bidirpipe"
+)
+
+/* newMultidrop connects n device ports to one host port. Every frame is written by the simulators using a
+ * single write, so frames of different devices are never mixed. */
+func newMultidrop(n int) (io.ReadWriteCloser, []io.ReadWriteCloser) {
+	host, hub := bidirpipe.CreateBidirPipe()
+
+	var mutex sync.Mutex
+	var devices, hubSides []io.ReadWriteCloser
+	for i := 0; i < n; i++ {
+		device, hubSide := bidirpipe.CreateBidirPipe()
+		devices = append(devices, device)
+		hubSides = append(hubSides, hubSide)
+
+		go func() {
+			buf := make([]byte, 512)
+			for {
+				n, err := hubSide.Read(buf)
+				if err != nil {
+					return
+				}
+
+				mutex.Lock()
+				hub.Write(buf[:n])
+				mutex.Unlock()
+			}
+		}()
+	}
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, err := hub.Read(buf)
+			if err != nil {
+				for _, m := range hubSides {
+					m.Close()
+				}
+				return
+			}
+
+			for _, m := range hubSides {
+				m.Write(buf[:n])
+			}
+		}
+	}()
+
+	return host, devices
+}
+
+func startBus(t *testing.T, port io.ReadWriteCloser, key []byte, pipelined bool) *Bus {
+	bus := CreateProtocol(port, key)
+	if pipelined {
+		if err := bus.EnablePipelining(8); err != nil {
+			t.Fatal(err)
+		}
+	}
+	go bus.ProtocolHandler()
+	t.Cleanup(func() { bus.CloseProtocol() })
+
+	return bus
+}
@@ -0,0 +1,154 @@
+package serialpacket
+
+import (
+	"context"
+	"time"
+
+	"github.com/BertoldVdb/go-misc/serialpacket/framer/framerinterface"
+	"github.com/BertoldVdb/go-misc/serialpacket/framer/legacy"
+	"github.com/BertoldVdb/go-misc/slotset"
+)
+
+type pendingCommand struct {
+	device *Device
+
+	reply []byte
+}
+
+type pipeline struct {
+	slots *slotset.SlotSet
+
+	/* Only one command per address can be outstanding, otherwise replies can't be matched */
+	addressLock [256]chan (struct{})
+
+	ready chan (struct{})
+}
+
+// EnablePipelining allows commands to different addresses to be in flight at the same time, at most slots
+// commands are outstanding. Replies are matched by address, so all devices must include their address in
+// the reply frames. A NACK does not reset the line, as other commands may be outstanding.
+// It must be called before ProtocolHandler and before Framer, otherwise ErrorFramerInUse is returned.
+func (s *Bus) EnablePipelining(slots int) error {
+	if slots < 1 {
+		slots = 1
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.framerUsed {
+		return ErrorFramerInUse
+	}
+
+	/* Replies are only matched by address, so the framer must pass it to the receiver */
+	framer, err := legacy.NewLegacyFramer(s.port, framerinterface.DefaultFramerOptions().Set(framerinterface.OptionAddressed, true))
+	if err != nil {
+		return err
+	}
+
+	p := &pipeline{
+		slots: slotset.New(slots, nil),
+		ready: make(chan (struct{})),
+	}
+	for i := range p.addressLock {
+		p.addressLock[i] = make(chan (struct{}), 1)
+	}
+
+	s.pipeline = p
+	s.framer = framer
+	return nil
+}
+
+func (s *Bus) pipelineStarted() {
+	if s.pipeline != nil {
+		close(s.pipeline.ready)
+	}
+}
+
+func (s *Bus) pipelineClose() {
+	if s.pipeline != nil {
+		s.pipeline.slots.Close()
+	}
+}
+
+/* pipelineReply matches an ACK or NACK with the outstanding command for the address */
+func (s *Bus) pipelineReply(address uint8, payload []byte, err error) {
+	s.pipeline.slots.IterateActive(func(slot *slotset.Slot) (bool, error) {
+		cmd := slot.Data.(*pendingCommand)
+		if cmd.device.address != address {
+			return true, nil
+		}
+
+		cmd.reply = append([]byte(nil), payload...)
+		slot.PostWithoutLock(err)
+		return false, nil
+	})
+}
+
+/* pipelineDisconnect cancels the outstanding command of a device */
+func (s *Bus) pipelineDisconnect(dev *Device) {
+	s.pipeline.slots.IterateActive(func(slot *slotset.Slot) (bool, error) {
+		if slot.Data.(*pendingCommand).device == dev {
+			slot.PostWithoutLock(ErrorNotConnected)
+		}
+		return true, nil
+	})
+}
+
+func (s *Device) sendCommandPipelined(ctx context.Context, packet []byte, timeout int) ([]byte, error) {
+	p := s.bus.pipeline
+	closed := s.bus.closed.Chan()
+
+	select {
+	case <-p.ready:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-closed:
+		return nil, ErrorClosed
+	}
+
+	lock := p.addressLock[s.address]
+	select {
+	case lock <- struct{}{}:
+		defer func() { <-lock }()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-closed:
+		return nil, ErrorClosed
+	}
+
+	slot, err := p.slots.Get(ctx)
+	if err == slotset.ErrorClosed {
+		return nil, ErrorClosed
+	} else if err != nil {
+		return nil, err
+	}
+	defer p.slots.Put(slot)
+
+	cmd := &pendingCommand{device: s}
+	slot.Data = cmd
+	if timeout > 0 {
+		slot.Activate()
+	}
+
+	if err := s.sendPacket(packet); err != nil || timeout <= 0 {
+		slot.Deactivate()
+		return nil, err
+	}
+
+	select {
+	case err, ok := <-slot.WaitGetChan():
+		if !ok {
+			return nil, ErrorClosed
+		}
+		return cmd.reply, err
+
+	case <-time.After(time.Duration(timeout) * time.Millisecond):
+		slot.Deactivate()
+		return nil, ErrorTimeout
+
+	case <-ctx.Done():
+		slot.Deactivate()
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,73 @@
+package serialpacket
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/BertoldVdb/go-misc/bidirpipe"
+)
+
+func TestPipelined(t *testing.T) {
+	host, devices := newMultidrop(2)
+
+	release := make(chan (struct{}))
+	for i, port := range devices {
+		sim := NewSimulator(port, &SimulatorConfig{Address: uint8(i + 1), Serial: []byte{byte(i)}, AddressedReplies: true})
+		if i == 0 {
+			/* The first device answers late, the reply is sent by another goroutine */
+			sim.Handle(0x10, func(payload []byte) ([]byte, error) {
+				go func() {
+					<-release
+					sim.SendUnsolicited(messageAck, []byte("slow"))
+				}()
+				return nil, ErrorNoReply
+			})
+		}
+		go sim.Run()
+	}
+
+	bus := startBus(t, host, nil, true)
+
+	slow := make(chan ([]byte), 1)
+	go func() {
+		dev := bus.GetDevice(1)
+		dev.ConnectForce([]byte{0})
+		reply, _ := dev.SendCommand(0x10, nil, 2000)
+		slow <- reply
+	}()
+
+	/* The second device must be usable while the first command is outstanding */
+	fast := bus.GetDevice(2)
+	if serial, err := fast.Connect(); err != nil || !bytes.Equal(serial, []byte{1}) {
+		t.Error("Connect failed while other command was outstanding", err)
+	}
+	close(release)
+
+	select {
+	case reply := <-slow:
+		if string(reply) != "slow" {
+			t.Error("Wrong reply", reply)
+		}
+	case <-time.After(time.Second):
+		t.Error("No reply to slow command")
+	}
+
+	/* Per device timeouts still apply */
+	missing := bus.GetDevice(3)
+	missing.Timeout = 20
+	if _, err := missing.GetDeviceSerial(); err != ErrorTimeout {
+		t.Error("Expected timeout", err)
+	}
+}
+
+func TestPipeliningFramerInUse(t *testing.T) {
+	host, _ := bidirpipe.CreateBidirPipe()
+
+	/* A monitor attached to the framer would be lost if it was replaced */
+	bus := CreateProtocol(host, nil)
+	bus.Framer()
+	if err := bus.EnablePipelining(8); err != ErrorFramerInUse {
+		t.Error("Framer was replaced after it was handed out", err)
+	}
+}
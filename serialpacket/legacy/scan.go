@@ -0,0 +1,215 @@
+package serialpacket
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ScanConfig contains the parameters of a bus scan. Zero values are replaced by the defaults.
+type ScanConfig struct {
+	// Addresses are the addresses that are probed. Default: 0x00 - 0xFE
+	Addresses []uint8
+
+	// Timeout is the timeout of every command. Default: 50ms
+	Timeout time.Duration
+
+	// Parallel is the amount of addresses that is probed at the same time. This is only possible if
+	// pipelining is enabled, otherwise the addresses are probed one by one. Default: 1
+	Parallel int
+}
+
+// DefaultScanConfig returns the default scan configuration
+func DefaultScanConfig() *ScanConfig {
+	addresses := make([]uint8, 0, 255)
+	for i := 0; i < AddressDefault; i++ {
+		addresses = append(addresses, uint8(i))
+	}
+
+	return &ScanConfig{
+		Addresses: addresses,
+		Timeout:   50 * time.Millisecond,
+		Parallel:  1,
+	}
+}
+
+func (c *ScanConfig) withDefaults() ScanConfig {
+	def := DefaultScanConfig()
+	if c == nil {
+		return *def
+	}
+
+	result := *c
+	if len(result.Addresses) == 0 {
+		result.Addresses = def.Addresses
+	}
+	if result.Timeout <= 0 {
+		result.Timeout = def.Timeout
+	}
+	if result.Parallel <= 0 {
+		result.Parallel = def.Parallel
+	}
+
+	return result
+}
+
+// ScanResult describes an address where a device responded
+type ScanResult struct {
+	Address uint8
+
+	// Serial is the full serial of the device, nil if it could not be read
+	Serial []byte
+
+	// Collision is true if the replies were garbled or inconsistent, this happens when multiple devices
+	// use the same address
+	Collision bool
+}
+
+/* garbledFrames returns the amount of frames dropped by the framer */
+func (s *Bus) garbledFrames() uint64 {
+	s.Lock()
+	framer := s.framer
+	s.Unlock()
+
+	stats := framer.GetStats()
+	return stats.FramesReceivedWrongChecksum + stats.FramesReceivedOversized + stats.FramesReceivedInvalid
+}
+
+/* isFatal returns true for errors that stop the scan */
+func isFatal(ctx context.Context, err error) bool {
+	return err == ErrorClosed || ctx.Err() != nil
+}
+
+/* probe returns nil if no device responded at the address. When measureGarbled is set, dropped frames are
+ * counted as collisions, this is only valid when no other commands are outstanding */
+func (s *Bus) probe(ctx context.Context, address uint8, timeoutMs int, measureGarbled bool) (*ScanResult, error) {
+	dev := s.GetDevice(address)
+	dev.Timeout = timeoutMs
+
+	result := &ScanResult{Address: address}
+	garbled := s.garbledFrames()
+
+	collision := func() bool {
+		return measureGarbled && s.garbledFrames() != garbled
+	}
+
+	random := make([]byte, 8)
+	rand.Read(random)
+
+	reply, err := dev.SendCommandContext(ctx, messagePing, random, timeoutMs)
+	if isFatal(ctx, err) {
+		return nil, err
+	}
+
+	if err == ErrorTimeout {
+		if collision() {
+			result.Collision = true
+			return result, nil
+		}
+		return nil, nil
+	}
+
+	/* A NACK is not expected, but it means something is listening */
+	var nack *NackError
+	if (err == nil && !bytes.Equal(reply, random)) || (err != nil && !errors.As(err, &nack)) {
+		result.Collision = true
+	}
+
+	/* Different devices will return different serials */
+	var serials [2][]byte
+	for i := range serials {
+		serials[i], err = dev.SendCommandContext(ctx, messageID, nil, timeoutMs)
+		if isFatal(ctx, err) {
+			return nil, err
+		}
+		if err != nil {
+			serials[i] = nil
+		}
+	}
+
+	if serials[0] != nil && serials[1] != nil && !bytes.Equal(serials[0], serials[1]) {
+		result.Collision = true
+	}
+	if serials[0] != nil {
+		result.Serial = serials[0]
+	} else {
+		result.Serial = serials[1]
+	}
+
+	if collision() {
+		result.Collision = true
+	}
+
+	return result, nil
+}
+
+// Scan probes the addresses using the ping and ID commands and returns the devices that responded, sorted
+// by address. Garbled replies are only detected when the scan is not done in parallel. Without pipelining
+// every address without device also costs a line reset.
+func (s *Bus) Scan(ctx context.Context, config *ScanConfig) ([]ScanResult, error) {
+	c := config.withDefaults()
+
+	timeoutMs := int(c.Timeout / time.Millisecond)
+	if timeoutMs < 1 {
+		timeoutMs = 1
+	}
+
+	parallel := c.Parallel
+	if s.pipeline == nil {
+		parallel = 1
+	}
+
+	var mutex sync.Mutex
+	var results []ScanResult
+	var scanErr error
+
+	var wg sync.WaitGroup
+	sem := make(chan (struct{}), parallel)
+
+	for _, address := range c.Addresses {
+		if address == AddressDefault {
+			continue
+		}
+
+		sem <- struct{}{}
+
+		mutex.Lock()
+		stop := scanErr != nil
+		mutex.Unlock()
+		if stop {
+			<-sem
+			break
+		}
+
+		wg.Add(1)
+		go func(address uint8) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			result, err := s.probe(ctx, address, timeoutMs, parallel == 1)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			if err != nil {
+				if scanErr == nil {
+					scanErr = err
+				}
+			} else if result != nil {
+				results = append(results, *result)
+			}
+		}(address)
+	}
+
+	wg.Wait()
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Address < results[j].Address
+	})
+
+	return results, scanErr
+}
@@ -0,0 +1,58 @@
+package serialpacket
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestScan(t *testing.T) {
+	for _, pipelined := range []bool{false, true} {
+		host, devices := newMultidrop(3)
+
+		for i, address := range []uint8{3, 7, 9} {
+			sim := NewSimulator(devices[i], &SimulatorConfig{Address: address, Serial: []byte{address}, AddressedReplies: pipelined})
+			if address == 9 {
+				/* Two devices with the same address return different serials */
+				var mutex sync.Mutex
+				count := 0
+				sim.Handle(messageID, func(payload []byte) ([]byte, error) {
+					mutex.Lock()
+					defer mutex.Unlock()
+
+					count++
+					return []byte{9, byte(count)}, nil
+				})
+			}
+			go sim.Run()
+		}
+
+		bus := startBus(t, host, nil, pipelined)
+
+		results, err := bus.Scan(context.Background(), &ScanConfig{
+			Addresses: []uint8{1, 2, 3, 7, 8, 9, 10},
+			Timeout:   20 * time.Millisecond,
+			Parallel:  4,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := []ScanResult{
+			{Address: 3, Serial: []byte{3}},
+			{Address: 7, Serial: []byte{7}},
+			{Address: 9, Serial: []byte{9, 1}, Collision: true},
+		}
+		if len(results) != len(expected) {
+			t.Fatal("Wrong scan results", results)
+		}
+		for i := range expected {
+			if results[i].Address != expected[i].Address || !bytes.Equal(results[i].Serial, expected[i].Serial) ||
+				results[i].Collision != expected[i].Collision {
+				t.Error("Wrong scan result", results[i], "expected", expected[i])
+			}
+		}
+	}
+}
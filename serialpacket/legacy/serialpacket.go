@@ -2,28 +2,20 @@ package serialpacket
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
-	"errors"
+	"fmt"
 	"io"
 	"math/rand"
 	"sync"
 	"time"
 
-	"github.com/sigurn/crc8"
+	"github.com/BertoldVdb/go-misc/closeflag"
+	"github.com/BertoldVdb/go-misc/serialpacket/framer/framerinterface"
+	"github.com/BertoldVdb/go-misc/serialpacket/framer/legacy"
 )
 
-const AddressDefault = 0xFF
-
-var crcTable *crc8.Table
-
-func init() {
-	crcParam := crc8.Params{
-		Poly: 0x9B,
-		Init: 0x12,
-		Name: "CRC-8/Packet",
-	}
-	crcTable = crc8.MakeTable(crcParam)
-}
+const AddressDefault = legacy.AddressNone
 
 type Error string
 
@@ -34,16 +26,32 @@ const (
 	ErrorNack         = Error("Command rejected")
 	ErrorSyncFailed   = Error("Invaild sync response")
 	ErrorNotConnected = Error("Not connected")
+	ErrorClosed       = Error("Bus closed")
+	ErrorFramerInUse  = Error("Framer already in use")
 )
 
-type receiverStateType int
+// NackError is returned when a device rejects a command, it contains the payload of the NACK.
+// errors.Is(err, ErrorNack) is true for a NackError.
+type NackError struct {
+	Payload []byte
+}
 
-const (
-	waitSync   receiverStateType = 0
-	readLength receiverStateType = 1
-	readPacket receiverStateType = 2
-	readCRC    receiverStateType = 3
-)
+func (e *NackError) Error() string {
+	if len(e.Payload) == 0 {
+		return string(ErrorNack)
+	}
+	return fmt.Sprintf("%s (%x)", ErrorNack, e.Payload)
+}
+
+func (e *NackError) Is(target error) bool {
+	return target == ErrorNack
+}
+
+func newNackError(payload []byte) *NackError {
+	return &NackError{
+		Payload: append([]byte(nil), payload...),
+	}
+}
 
 type MessageType byte
 
@@ -63,23 +71,26 @@ type commandReplyStruct struct {
 
 type commandStruct struct {
 	Device *Device
+	Ctx    context.Context
 
 	Packet      []byte
 	Timeout     <-chan (time.Time)
 	TimeoutMs   int
 	Unsolicited bool
 	ReplyChan   chan (commandReplyStruct)
+
+	/* Abandoned is set by the protocol handler when the caller stopped waiting */
+	Abandoned bool
 }
 
 type Bus struct {
 	sync.Mutex
 
-	port io.ReadWriteCloser
+	port   io.ReadWriteCloser
+	framer *legacy.Legacy
 
-	receiverState        receiverStateType
-	receiverPacketLength uint8
-	receiverPacketIndex  uint8
-	receiverBuffer       [256]byte
+	/* framerUsed is set once the framer was returned by Framer, it can't be replaced anymore */
+	framerUsed bool
 
 	unsolicitedHandler func(msgType MessageType, buf []byte)
 
@@ -90,8 +101,11 @@ type Bus struct {
 	disconnectChan chan (*Device)
 
 	currentCommand *commandStruct
+	pipeline       *pipeline
 
 	unlockKey []byte
+
+	closed closeflag.CloseFlag
 }
 
 type Device struct {
@@ -130,27 +144,20 @@ func (s *Bus) GetDevice(address uint8) *Device {
 	}
 }
 
-func (s *Bus) calcCRC(d *Device, cmd MessageType, payload []byte) (uint8, error) {
-	crc := crc8.Checksum(payload, crcTable)
-
-	if d != nil {
-		if cmd != messagePing && cmd != messageID {
-			d.Lock()
-			crc ^= d.compressedSerial
-			synced := d.synced
-			d.Unlock()
-
-			if !synced {
-				return 0, ErrorNotConnected
-			}
-		}
+/* crcXOR returns the value XORed with the CRC of a command, this binds it to the serial number of the device */
+func (s *Device) crcXOR(cmd MessageType) (uint8, error) {
+	if cmd == messagePing || cmd == messageID {
+		return 0, nil
 	}
 
-	if crc == 0 {
-		crc = 0xAA
+	s.Lock()
+	defer s.Unlock()
+
+	if !s.synced {
+		return 0, ErrorNotConnected
 	}
 
-	return crc, nil
+	return s.compressedSerial, nil
 }
 
 func (s *Bus) sendReset() error {
@@ -181,106 +188,64 @@ func (s *Bus) sendReset() error {
 }
 
 func (s *Device) sendPacket(payload []byte) error {
-	pl := len(payload)
-
-	if pl >= 256 || pl < 1 {
-		return errors.New("Payload too long or too short")
+	if len(payload) == 0 {
+		return legacy.ErrorPacketLength
 	}
 
-	/* Calculate CRC */
-	var buffer = make([]byte, 0, pl+3)
-	buffer = append(buffer, 'B')
-	if s.address != 0xFF {
-		buffer = append(buffer, s.address)
-	}
-	buffer = append(buffer, byte(pl))
-	buffer = append(buffer, payload...)
-	crc, err := s.bus.calcCRC(s, MessageType(payload[0]), payload)
+	xor, err := s.crcXOR(MessageType(payload[0]))
 	if err != nil {
 		return err
 	}
 
-	buffer = append(buffer, crc)
-
-	_, err = s.bus.port.Write(buffer)
+	_, err = s.bus.framer.SendFrame(s.address, payload, xor)
 	return err
 }
 
-func (s *Bus) processInput(buffer []byte) error {
-	for _, m := range buffer {
-		switch s.receiverState {
-		case waitSync:
-			if m == 'B' {
-				s.receiverState = readLength
-			}
-
-		case readLength:
-			s.receiverPacketLength = m
-			s.receiverPacketIndex = 0
+func (s *Bus) processPacket(packet []byte) {
+	if s.pipeline != nil {
+		address := packet[0]
+		packet = packet[1:]
 
-			if m == 0 {
-				s.receiverState = waitSync
-			} else {
-				s.receiverState = readPacket
-			}
+		switch MessageType(packet[0]) {
+		case messageAck:
+			s.pipelineReply(address, packet[1:], nil)
+			return
+		case messageNack:
+			s.pipelineReply(address, packet[1:], newNackError(packet[1:]))
+			return
+		}
+	}
 
-		case readPacket:
-			s.receiverBuffer[s.receiverPacketIndex] = m
-			s.receiverPacketIndex++
-			if s.receiverPacketIndex == s.receiverPacketLength {
-				s.receiverState = readCRC
-			}
+	msgType := MessageType(packet[0])
 
-		case readCRC:
-			receivedPacket := s.receiverBuffer[:s.receiverPacketLength]
-			crc, err := s.calcCRC(nil, 0, receivedPacket)
-			if err != nil {
-				return err
-			}
+	if msgType == messageAck {
+		s.processCommandReply(packet[1:], nil)
+	} else if msgType == messageNack {
+		s.processCommandReply(packet[1:], newNackError(packet[1:]))
+	} else {
+		s.Lock()
+		handler := s.unsolicitedHandler
+		s.Unlock()
 
-			if crc == m {
-				msgType := MessageType(receivedPacket[0])
-
-				if msgType == messageAck {
-					s.processCommandReply(receivedPacket[1:], nil)
-				} else if msgType == messageNack {
-					s.processCommandReply(receivedPacket[1:], ErrorNack)
-				} else {
-					s.Lock()
-					handler := s.unsolicitedHandler
-					s.Unlock()
-
-					if handler != nil {
-						handler(msgType, receivedPacket[1:])
-					}
-				}
-			}
-			s.receiverState = waitSync
+		if handler != nil {
+			handler(msgType, packet[1:])
 		}
 	}
-
-	return nil
 }
 
 func (s *Bus) readWorker() error {
 	defer close(s.rxChan)
 
-	var buffer [64]byte
-
-	for {
-		n, err := s.port.Read(buffer[:])
-		if err != nil {
-			return err
-		}
-
-		s.rxChan <- buffer[:n]
+	return s.framer.Run(func(payload []byte, metadata *framerinterface.PacketMetadata) error {
+		/* The payload is only valid until the protocol handler acknowledges it */
+		s.rxChan <- payload
 		_, ok := <-s.rxChanAck
 		if !ok {
-			break
+			return io.EOF
 		}
-	}
 
-	return nil
+		return nil
+	})
 }
 
 func (s *Bus) drain(ms int) {
@@ -306,7 +271,7 @@ func (s *Bus) processCommandReply(payload []byte, err error) {
 	}
 
 	if s.currentCommand != nil {
-		if s.currentCommand.ReplyChan != nil {
+		if s.currentCommand.ReplyChan != nil && !s.currentCommand.Abandoned {
 
 			pCopy := make([]byte, len(payload))
 			copy(pCopy, payload)
@@ -322,6 +287,10 @@ func (s *Bus) processCommandReply(payload []byte, err error) {
 }
 
 func (s *Bus) ProtocolHandler() error {
+	s.Lock()
+	s.framerUsed = true
+	s.Unlock()
+
 	s.rxChan = make(chan ([]byte))
 	s.rxChanAck = make(chan (struct{}))
 	defer close(s.rxChanAck)
@@ -330,34 +299,43 @@ func (s *Bus) ProtocolHandler() error {
 	s.sendReset()
 
 	/* Start receiver */
-	s.receiverState = waitSync
 	go s.readWorker()
+	s.pipelineStarted()
+
+	/* Commands that are pending or queued fail with ErrorClosed */
+	defer s.pipelineClose()
+	defer s.closed.Close()
 
 loop:
 	for {
 		cmdInChan := s.cmdChan
 		var timeoutChan <-chan (time.Time)
+		var cancelChan <-chan (struct{})
 		if s.currentCommand != nil {
 			cmdInChan = nil
 			timeoutChan = s.currentCommand.Timeout
+			if !s.currentCommand.Abandoned {
+				cancelChan = s.currentCommand.Ctx.Done()
+			}
 		}
 
 		select {
-		case buffer, ok := <-s.rxChan:
+		case packet, ok := <-s.rxChan:
 			if !ok {
 				break loop
 			}
 
-			err := s.processInput(buffer)
-			if err != nil {
-				return err
-			}
-
+			s.processPacket(packet)
 			s.rxChanAck <- struct{}{}
 
 		case <-timeoutChan:
 			s.processCommandReply(nil, ErrorTimeout)
 
+		case <-cancelChan:
+			/* The caller stops waiting, but the command stays on the line until its reply or timeout, so a
+			 * late reply is not taken for the reply of the next command. The line is not reset. */
+			s.currentCommand.Abandoned = true
+
 		case dev := <-s.disconnectChan:
 			dev.Lock()
 			dev.synced = false
@@ -371,8 +349,16 @@ loop:
 					s.processCommandReply(nil, ErrorNotConnected)
 				}
 			}
+			if s.pipeline != nil {
+				s.pipelineDisconnect(dev)
+			}
 
 		case cmd := <-cmdInChan:
+			if cmd.Ctx.Err() != nil {
+				/* The caller is no longer waiting */
+				continue
+			}
+
 			s.currentCommand = cmd
 
 			err := cmd.Device.sendPacket(cmd.Packet)
@@ -390,40 +376,74 @@ loop:
 }
 
 func (s *Device) SendCommand(cmd MessageType, payload []byte, timeout int) ([]byte, error) {
+	return s.SendCommandContext(context.Background(), cmd, payload, timeout)
+}
+
+// SendCommandContext is like SendCommand, but it also returns when ctx is cancelled. If the bus stops
+// ErrorClosed is returned. A cancelled command is not retracted, the next command is only sent after its
+// reply or timeout.
+func (s *Device) SendCommandContext(ctx context.Context, cmd MessageType, payload []byte, timeout int) ([]byte, error) {
 	buf := make([]byte, 1, 1+len(payload))
 	buf[0] = byte(cmd)
 	buf = append(buf, payload...)
 
+	if s.bus.pipeline != nil {
+		return s.sendCommandPipelined(ctx, buf, timeout)
+	}
+
 	unsolicited := timeout <= 0
 
 	cmdS := &commandStruct{
 		Packet:      buf,
 		Device:      s,
+		Ctx:         ctx,
 		Unsolicited: unsolicited,
 		ReplyChan:   make(chan (commandReplyStruct), 1),
 		TimeoutMs:   timeout,
 	}
 
-	s.bus.cmdChan <- cmdS
-	reply := <-cmdS.ReplyChan
+	select {
+	case s.bus.cmdChan <- cmdS:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-s.bus.closed.Chan():
+		return nil, ErrorClosed
+	}
 
-	return reply.Payload, reply.Error
+	select {
+	case reply := <-cmdS.ReplyChan:
+		return reply.Payload, reply.Error
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-s.bus.closed.Chan():
+		return nil, ErrorClosed
+	}
 }
 
 func (s *Device) GetDeviceSerial() ([]byte, error) {
+	return s.GetDeviceSerialContext(context.Background())
+}
+
+// GetDeviceSerialContext is like GetDeviceSerial, but it also returns when ctx is cancelled
+func (s *Device) GetDeviceSerialContext(ctx context.Context) ([]byte, error) {
 	s.Lock()
 	sync := s.synced
 	s.Unlock()
 
 	if !sync {
-		return s.SendCommand(messageID, nil, s.Timeout)
+		return s.SendCommandContext(ctx, messageID, nil, s.Timeout)
 	}
 
-	return s.SendCommand(messageIDHash, nil, s.Timeout)
+	return s.SendCommandContext(ctx, messageIDHash, nil, s.Timeout)
 }
 
 func (s *Device) GetSystemTime() (uint64, error) {
-	reply, err := s.SendCommand(messageSysTime, nil, s.Timeout)
+	return s.GetSystemTimeContext(context.Background())
+}
+
+// GetSystemTimeContext is like GetSystemTime, but it also returns when ctx is cancelled
+func (s *Device) GetSystemTimeContext(ctx context.Context) (uint64, error) {
+	reply, err := s.SendCommandContext(ctx, messageSysTime, nil, s.Timeout)
 	if err != nil {
 		return 0, err
 	}
@@ -439,7 +459,7 @@ func (s *Device) GetSystemTime() (uint64, error) {
 	return 0, nil
 }
 
-func (s *Device) syncTry() error {
+func (s *Device) syncTry(ctx context.Context) error {
 	random := make([]byte, 16)
 
 	for i := 0; i < 3; i++ {
@@ -447,7 +467,7 @@ func (s *Device) syncTry() error {
 		syncRandom := random[:len]
 		rand.Read(syncRandom)
 
-		reply, err := s.SendCommand(messagePing, syncRandom, s.Timeout)
+		reply, err := s.SendCommandContext(ctx, messagePing, syncRandom, s.Timeout)
 		if err != nil {
 			return err
 		} else if bytes.Compare(reply, syncRandom) != 0 {
@@ -459,7 +479,10 @@ func (s *Device) syncTry() error {
 }
 
 func (s *Device) Disconnect() {
-	s.bus.disconnectChan <- s
+	select {
+	case s.bus.disconnectChan <- s:
+	case <-s.bus.closed.Chan():
+	}
 }
 
 func (s *Device) ConnectForce(serial []byte) ([]byte, error) {
@@ -480,7 +503,23 @@ func (s *Device) ConnectForce(serial []byte) ([]byte, error) {
 	return serial, nil
 }
 
+// Serial returns the serial of the device, or nil if it is not connected
+func (s *Device) Serial() []byte {
+	s.Lock()
+	defer s.Unlock()
+
+	if !s.synced {
+		return nil
+	}
+	return s.fullSerial
+}
+
 func (s *Device) Connect() ([]byte, error) {
+	return s.ConnectContext(context.Background())
+}
+
+// ConnectContext is like Connect, but it also returns when ctx is cancelled
+func (s *Device) ConnectContext(ctx context.Context) ([]byte, error) {
 	var retVal error
 
 	s.Lock()
@@ -488,8 +527,8 @@ func (s *Device) Connect() ([]byte, error) {
 	s.Unlock()
 
 	for i := 0; i < 3; i++ {
-		retVal = s.syncTry()
-		if retVal == nil {
+		retVal = s.syncTry(ctx)
+		if retVal == nil || ctx.Err() != nil || retVal == ErrorClosed {
 			break
 		}
 	}
@@ -498,7 +537,7 @@ func (s *Device) Connect() ([]byte, error) {
 		return nil, retVal
 	}
 
-	serial, err := s.GetDeviceSerial()
+	serial, err := s.GetDeviceSerialContext(ctx)
 	if serial != nil && err == nil {
 		compressedSerial := uint8(0)
 		for _, m := range serial {
@@ -520,7 +559,12 @@ func (s *Device) Connect() ([]byte, error) {
 }
 
 func (s *Device) TestComm() error {
-	serial2, err := s.GetDeviceSerial()
+	return s.TestCommContext(context.Background())
+}
+
+// TestCommContext is like TestComm, but it also returns when ctx is cancelled
+func (s *Device) TestCommContext(ctx context.Context) error {
+	serial2, err := s.GetDeviceSerialContext(ctx)
 	if err != nil {
 		return err
 	}
@@ -537,7 +581,7 @@ func (s *Device) TestComm() error {
 	}
 
 	if bytes.Compare(serial, serial2) != 0 {
-		return ErrorNack
+		return newNackError(nil)
 	}
 
 	return nil
@@ -549,11 +593,23 @@ func CreateProtocol(port io.ReadWriteCloser, key []byte) *Bus {
 	a.cmdChan = make(chan (*commandStruct), 20)
 	a.disconnectChan = make(chan (*Device))
 	a.port = port
+	/* The default options are always valid */
+	a.framer, _ = legacy.NewLegacyFramer(port, nil)
 	a.unlockKey = key
 
 	return a
 }
 
+// Framer returns the framer used by the bus, eg. to read its statistics or to monitor dropped frames
+func (s *Bus) Framer() *legacy.Legacy {
+	s.Lock()
+	defer s.Unlock()
+
+	s.framerUsed = true
+	return s.framer
+}
+
 func (s *Bus) CloseProtocol() error {
+	s.closed.Close()
 	return s.port.Close()
 }
@@ -0,0 +1,133 @@
+package serialpacket
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BertoldVdb/go-misc/bidirpipe"
+)
+
+func TestContextAndClose(t *testing.T) {
+	for _, pipelined := range []bool{false, true} {
+		host, device := bidirpipe.CreateBidirPipe()
+
+		sim := NewSimulator(device, &SimulatorConfig{Address: 1, Serial: []byte{1}, AddressedReplies: pipelined})
+		sim.Handle(0x10, func(payload []byte) ([]byte, error) {
+			return nil, ErrorNoReply
+		})
+		go sim.Run()
+
+		bus := startBus(t, host, nil, pipelined)
+		dev := bus.GetDevice(1)
+		dev.ConnectForce([]byte{1})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		_, err := dev.SendCommandContext(ctx, 0x10, nil, 5000)
+		cancel()
+		if err != context.DeadlineExceeded {
+			t.Error("Wrong error after cancelling", err)
+		}
+
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			bus.CloseProtocol()
+		}()
+		if _, err := dev.SendCommand(0x10, nil, 5000); err != ErrorClosed {
+			t.Error("Pending command did not fail", err)
+		}
+		if _, err := dev.Connect(); err != ErrorClosed {
+			t.Error("Command after closing did not fail", err)
+		}
+	}
+}
+
+func TestNack(t *testing.T) {
+	host, device := bidirpipe.CreateBidirPipe()
+
+	sim := NewSimulator(device, &SimulatorConfig{Address: 1, Serial: []byte{1}})
+	sim.Handle(0x10, func(payload []byte) ([]byte, error) {
+		return nil, &NackError{Payload: []byte{0x42}}
+	})
+	go sim.Run()
+
+	bus := startBus(t, host, nil, false)
+	dev := bus.GetDevice(1)
+	dev.ConnectForce([]byte{1})
+
+	var nack *NackError
+	if _, err := dev.SendCommand(0x10, nil, 1000); !errors.As(err, &nack) || !errors.Is(err, ErrorNack) || !bytes.Equal(nack.Payload, []byte{0x42}) {
+		t.Error("Expected NACK with payload", err)
+	}
+}
+
+/* resetCounter counts the line resets written by the bus */
+type resetCounter struct {
+	io.ReadWriteCloser
+
+	mutex  sync.Mutex
+	resets int
+}
+
+func (r *resetCounter) Write(p []byte) (int, error) {
+	if len(p) == 258 && bytes.Count(p, []byte{0}) == len(p) {
+		r.mutex.Lock()
+		r.resets++
+		r.mutex.Unlock()
+	}
+	return r.ReadWriteCloser.Write(p)
+}
+
+func (r *resetCounter) count() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.resets
+}
+
+func TestCancelWithoutReset(t *testing.T) {
+	host, device := bidirpipe.CreateBidirPipe()
+
+	release := make(chan (struct{}))
+	sim := NewSimulator(device, &SimulatorConfig{Address: 1, Serial: []byte{1}})
+	sim.Handle(0x10, func(payload []byte) ([]byte, error) {
+		go func() {
+			<-release
+			sim.SendUnsolicited(messageAck, []byte("late"))
+		}()
+		return nil, ErrorNoReply
+	})
+	sim.Handle(0x11, func(payload []byte) ([]byte, error) {
+		return []byte("next"), nil
+	})
+	go sim.Run()
+
+	port := &resetCounter{ReadWriteCloser: host}
+	bus := startBus(t, port, nil, false)
+	dev := bus.GetDevice(1)
+	dev.ConnectForce([]byte{1})
+
+	/* The first command finishes after the initial reset */
+	if reply, err := dev.SendCommand(0x11, nil, 1000); string(reply) != "next" || err != nil {
+		t.Fatal("Command failed", reply, err)
+	}
+	resets := port.count()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if _, err := dev.SendCommandContext(ctx, 0x10, nil, 2000); err != context.Canceled {
+		t.Error("Wrong error after cancelling", err)
+	}
+	close(release)
+
+	/* The late reply of the cancelled command must not be returned for the next one */
+	if reply, err := dev.SendCommand(0x11, nil, 1000); string(reply) != "next" || err != nil {
+		t.Error("Wrong reply after cancelling", string(reply), err)
+	}
+	if port.count() != resets {
+		t.Error("Cancelling reset the line")
+	}
+}
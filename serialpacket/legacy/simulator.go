@@ -0,0 +1,297 @@
+package serialpacket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/BertoldVdb/go-misc/serialpacket/framer/framerinterface"
+	"github.com/BertoldVdb/go-misc/serialpacket/framer/legacy"
+)
+
+// ErrorNoReply can be returned by a SimulatorHandler to not send a reply
+const ErrorNoReply = Error("No reply")
+
+// SimulatorHandler handles a command received by the simulator. The returned payload is sent in an ACK. If
+// an error is returned a NACK is sent instead, with the payload of a *NackError if one is used.
+type SimulatorHandler func(payload []byte) ([]byte, error)
+
+// SimulatorConfig contains the parameters of a simulated device
+type SimulatorConfig struct {
+	// Address of the device. If it is AddressDefault the device receives frames without address.
+	Address uint8
+
+	// Serial is the full serial of the device
+	Serial []byte
+
+	// UnlockKey is the key that must be received before the device answers commands, nil if not needed
+	UnlockKey []byte
+
+	// AddressedReplies adds the address to the replies, this is needed when the bus uses pipelining
+	AddressedReplies bool
+
+	// SysTime returns the system time, by default the amount of milliseconds since the simulator was created
+	SysTime func() uint64
+}
+
+// Simulator implements the device side of the protocol, so a Bus can be tested without hardware, eg.
+// using bidirpipe. It answers ping, ID, ID hash and system time commands.
+type Simulator struct {
+	sync.Mutex
+
+	config   SimulatorConfig
+	framer   *legacy.Legacy
+	handlers map[MessageType]SimulatorHandler
+
+	compressedSerial uint8
+	unlocked         bool
+	online           bool
+	keyWindow        []byte
+
+	txQueue chan (simulatorFrame)
+}
+
+type simulatorFrame struct {
+	payload []byte
+	done    chan (error)
+}
+
+/* simulatorPort passes all received bytes to the unlock key detector */
+type simulatorPort struct {
+	io.ReadWriter
+	sim *Simulator
+}
+
+func (p simulatorPort) Read(buf []byte) (int, error) {
+	n, err := p.ReadWriter.Read(buf)
+	p.sim.detectKey(buf[:n])
+	return n, err
+}
+
+// NewSimulator creates a simulated device that uses the port
+func NewSimulator(port io.ReadWriter, config *SimulatorConfig) *Simulator {
+	s := &Simulator{
+		config:   *config,
+		handlers: make(map[MessageType]SimulatorHandler),
+		online:   true,
+		txQueue:  make(chan (simulatorFrame), 16),
+	}
+
+	s.SetSerial(config.Serial)
+	s.unlocked = len(config.UnlockKey) == 0
+
+	if s.config.SysTime == nil {
+		start := time.Now()
+		s.config.SysTime = func() uint64 {
+			return uint64(time.Since(start) / time.Millisecond)
+		}
+	}
+
+	options := framerinterface.DefaultFramerOptions()
+	if config.Address != AddressDefault {
+		options = options.Set(framerinterface.OptionAddressed, true)
+	}
+	s.framer, _ = legacy.NewLegacyFramer(simulatorPort{port, s}, options)
+	s.framer.SetReceiveCRCXOR(s.crcXOR)
+
+	s.Handle(messagePing, func(payload []byte) ([]byte, error) {
+		return payload, nil
+	})
+	s.Handle(messageID, s.serialHandler)
+	s.Handle(messageIDHash, s.serialHandler)
+	s.Handle(messageSysTime, func(payload []byte) ([]byte, error) {
+		var reply [8]byte
+		binary.BigEndian.PutUint64(reply[:], s.config.SysTime())
+		return reply[:], nil
+	})
+
+	return s
+}
+
+// Handle sets the handler for a command, replacing the built-in handler if there is one. A nil handler
+// makes the device NACK the command.
+func (s *Simulator) Handle(cmd MessageType, handler SimulatorHandler) {
+	s.Lock()
+	defer s.Unlock()
+
+	if handler == nil {
+		delete(s.handlers, cmd)
+	} else {
+		s.handlers[cmd] = handler
+	}
+}
+
+// SetSerial changes the serial of the device, eg. to simulate that another board was installed
+func (s *Simulator) SetSerial(serial []byte) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.config.Serial = append([]byte(nil), serial...)
+	s.compressedSerial = 0
+	for _, m := range serial {
+		s.compressedSerial ^= m
+	}
+}
+
+// SetOnline can be used to simulate a device that is disconnected from the bus, it does not answer commands
+func (s *Simulator) SetOnline(online bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.online = online
+}
+
+// Unlocked returns if the unlock key was received
+func (s *Simulator) Unlocked() bool {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.unlocked
+}
+
+// Framer returns the framer used by the simulator
+func (s *Simulator) Framer() *legacy.Legacy {
+	return s.framer
+}
+
+func (s *Simulator) serialHandler(payload []byte) ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	return append([]byte(nil), s.config.Serial...), nil
+}
+
+func (s *Simulator) detectKey(data []byte) {
+	key := s.config.UnlockKey
+	if len(key) == 0 {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	for _, m := range data {
+		s.keyWindow = append(s.keyWindow, m)
+		if len(s.keyWindow) > len(key) {
+			s.keyWindow = s.keyWindow[1:]
+		}
+		if bytes.Equal(s.keyWindow, key) {
+			s.unlocked = true
+		}
+	}
+}
+
+/* crcXOR returns the value the host XORed with the CRC of a command */
+func (s *Simulator) crcXOR(payload []byte) uint8 {
+	if s.config.Address != AddressDefault {
+		payload = payload[1:]
+	}
+
+	if len(payload) == 0 {
+		return 0
+	}
+
+	switch MessageType(payload[0]) {
+	case messagePing, messageID:
+		return 0
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	return s.compressedSerial
+}
+
+func (s *Simulator) send(payload []byte) error {
+	frame := simulatorFrame{
+		payload: payload,
+		done:    make(chan (error), 1),
+	}
+
+	s.txQueue <- frame
+	return <-frame.done
+}
+
+// SendUnsolicited sends a message that is not a reply to a command. Run must be executing.
+func (s *Simulator) SendUnsolicited(msgType MessageType, payload []byte) error {
+	return s.send(append([]byte{byte(msgType)}, payload...))
+}
+
+func (s *Simulator) replyAddress() uint8 {
+	if s.config.AddressedReplies {
+		return s.config.Address
+	}
+	return AddressDefault
+}
+
+func (s *Simulator) writer(stop chan (struct{})) {
+	for {
+		select {
+		case frame := <-s.txQueue:
+			_, err := s.framer.SendFrame(s.replyAddress(), frame.payload, 0)
+			frame.done <- err
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (s *Simulator) handleCommand(payload []byte) {
+	s.Lock()
+	handler := s.handlers[MessageType(payload[0])]
+	active := s.online && s.unlocked
+	s.Unlock()
+
+	if !active {
+		return
+	}
+
+	var reply []byte
+	var err error
+	if handler != nil {
+		reply, err = handler(payload[1:])
+	} else {
+		err = newNackError([]byte{payload[0]})
+	}
+
+	if err == ErrorNoReply {
+		return
+	}
+
+	if err != nil {
+		var nack *NackError
+		if errors.As(err, &nack) {
+			reply = nack.Payload
+		} else {
+			reply = nil
+		}
+		reply = append([]byte{byte(messageNack)}, reply...)
+	} else {
+		reply = append([]byte{byte(messageAck)}, reply...)
+	}
+
+	/* Replies are queued, so the receiver keeps reading while the host is writing */
+	s.txQueue <- simulatorFrame{payload: reply, done: make(chan (error), 1)}
+}
+
+// Run runs the simulator until the port returns an error
+func (s *Simulator) Run() error {
+	stop := make(chan (struct{}))
+	defer close(stop)
+	go s.writer(stop)
+
+	return s.framer.Run(func(payload []byte, metadata *framerinterface.PacketMetadata) error {
+		if s.config.Address != AddressDefault {
+			if payload[0] != s.config.Address {
+				return nil
+			}
+			payload = payload[1:]
+		}
+
+		s.handleCommand(payload)
+		return nil
+	})
+}
@@ -0,0 +1,105 @@
+package serialpacket
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/BertoldVdb/go-misc/bidirpipe"
+)
+
+func TestSimulator(t *testing.T) {
+	host, device := bidirpipe.CreateBidirPipe()
+
+	key := []byte("Open sesame")
+	sim := NewSimulator(device, &SimulatorConfig{
+		Address:   5,
+		Serial:    []byte{1, 2, 3, 4, 5, 6},
+		UnlockKey: key,
+		SysTime:   func() uint64 { return 1234 },
+	})
+	sim.Handle(0x10, func(payload []byte) ([]byte, error) {
+		return append(payload, payload...), nil
+	})
+	sim.Handle(0x11, func(payload []byte) ([]byte, error) {
+		return nil, &NackError{Payload: []byte{0x42}}
+	})
+	go sim.Run()
+
+	bus := startBus(t, host, key, false)
+
+	unsolicited := make(chan ([]byte), 1)
+	bus.SetUnsolicitedHandler(func(msgType MessageType, buf []byte) {
+		if msgType == 0x20 {
+			unsolicited <- append([]byte(nil), buf...)
+		}
+	})
+
+	dev := bus.GetDevice(5)
+	serial, err := dev.Connect()
+	if err != nil || !bytes.Equal(serial, []byte{1, 2, 3, 4, 5, 6}) {
+		t.Fatal("Connect failed", serial, err)
+	}
+	if !sim.Unlocked() {
+		t.Error("Simulator was not unlocked")
+	}
+
+	if tm, err := dev.GetSystemTime(); tm != 1234 || err != nil {
+		t.Error("Wrong system time", tm, err)
+	}
+	if err := dev.TestComm(); err != nil {
+		t.Error("TestComm failed", err)
+	}
+
+	/* Another serial with the same compressed serial is only detected by TestComm */
+	dev.ConnectForce([]byte{7})
+	var mismatch *NackError
+	if err := dev.TestComm(); !errors.As(err, &mismatch) {
+		t.Error("Wrong serial was not detected", err)
+	}
+
+	/* Commands with a CRC that is not bound to the right serial are ignored */
+	dev.ConnectForce([]byte{9, 9})
+	if _, err := dev.GetSystemTime(); err != ErrorTimeout {
+		t.Error("Command with wrong serial was answered", err)
+	}
+	dev.ConnectForce(serial)
+
+	if reply, err := dev.SendCommand(0x10, []byte{7, 8}, dev.Timeout); err != nil || !bytes.Equal(reply, []byte{7, 8, 7, 8}) {
+		t.Error("Custom handler failed", reply, err)
+	}
+
+	var nack *NackError
+	if _, err := dev.SendCommand(0x11, nil, dev.Timeout); !errors.As(err, &nack) || !bytes.Equal(nack.Payload, []byte{0x42}) {
+		t.Error("Expected NACK with payload", err)
+	}
+	if _, err := dev.SendCommand(0x12, nil, dev.Timeout); !errors.Is(err, ErrorNack) {
+		t.Error("Unknown command was not rejected", err)
+	}
+
+	go sim.SendUnsolicited(0x20, []byte{1, 2})
+	select {
+	case buf := <-unsolicited:
+		if !bytes.Equal(buf, []byte{1, 2}) {
+			t.Error("Wrong unsolicited message", buf)
+		}
+	case <-time.After(time.Second):
+		t.Error("Unsolicited message was not received")
+	}
+}
+
+func TestSimulatorLocked(t *testing.T) {
+	host, device := bidirpipe.CreateBidirPipe()
+
+	sim := NewSimulator(device, &SimulatorConfig{Address: AddressDefault, Serial: []byte{1}, UnlockKey: []byte("Key")})
+	go sim.Run()
+
+	bus := startBus(t, host, []byte("Wrong"), false)
+	dev := bus.GetDefaultDevice()
+	dev.Timeout = 50
+
+	if _, err := dev.Connect(); err != ErrorTimeout || sim.Unlocked() {
+		t.Error("Locked device answered", err)
+	}
+}
@@ -0,0 +1,333 @@
+package serialpacket
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"time"
+)
+
+// EventType describes a change in the presence of a device
+type EventType int
+
+const (
+	// EventConnected is emitted when a device was (re)connected
+	EventConnected EventType = 0
+
+	// EventDisconnected is emitted when a connected device stops responding correctly
+	EventDisconnected EventType = 1
+
+	// EventSerialChanged is emitted before EventConnected when a device reconnects with a different serial,
+	// eg. because another board was installed at the same address
+	EventSerialChanged EventType = 2
+)
+
+func (e EventType) String() string {
+	switch e {
+	case EventConnected:
+		return "Connected"
+	case EventDisconnected:
+		return "Disconnected"
+	case EventSerialChanged:
+		return "SerialChanged"
+	}
+	return "Unknown"
+}
+
+// Event is passed to the event handler of the supervisor
+type Event struct {
+	Type   EventType
+	Device *Device
+
+	// Serial is the serial of the device. For EventSerialChanged it is the new serial.
+	Serial []byte
+
+	// OldSerial is the previous serial, only set for EventSerialChanged
+	OldSerial []byte
+
+	// Error is the reason of the disconnection, only set for EventDisconnected
+	Error error
+}
+
+// SupervisorConfig contains the parameters of the supervisor. Zero values are replaced by the defaults.
+type SupervisorConfig struct {
+	// Interval is the time between two TestComm calls of a connected device. Default: 5s
+	Interval time.Duration
+
+	// BackoffMin is the time between the first reconnect attempts. Default: 500ms
+	BackoffMin time.Duration
+
+	// BackoffMax is the maximum time between reconnect attempts. Default: 30s
+	BackoffMax time.Duration
+
+	// BackoffFactor is the factor used to increase the time after every failed attempt. Default: 2
+	BackoffFactor float64
+
+	// OnEvent is called when the presence of a device changes. Calls are not concurrent.
+	OnEvent func(event Event)
+}
+
+// DefaultSupervisorConfig returns the default supervisor configuration
+func DefaultSupervisorConfig() *SupervisorConfig {
+	return &SupervisorConfig{
+		Interval:      5 * time.Second,
+		BackoffMin:    500 * time.Millisecond,
+		BackoffMax:    30 * time.Second,
+		BackoffFactor: 2,
+	}
+}
+
+func (c *SupervisorConfig) withDefaults() SupervisorConfig {
+	def := DefaultSupervisorConfig()
+	if c == nil {
+		return *def
+	}
+
+	result := *c
+	if result.Interval <= 0 {
+		result.Interval = def.Interval
+	}
+	if result.BackoffMin <= 0 {
+		result.BackoffMin = def.BackoffMin
+	}
+	if result.BackoffMax < result.BackoffMin {
+		result.BackoffMax = def.BackoffMax
+		if result.BackoffMax < result.BackoffMin {
+			result.BackoffMax = result.BackoffMin
+		}
+	}
+	if result.BackoffFactor < 1 {
+		result.BackoffFactor = def.BackoffFactor
+	}
+
+	return result
+}
+
+/* backoff returns the wait time before reconnect attempt n (starting from 0) */
+func (c *SupervisorConfig) backoff(n int) time.Duration {
+	wait := float64(c.BackoffMin)
+	for i := 0; i < n && wait < float64(c.BackoffMax); i++ {
+		wait *= c.BackoffFactor
+	}
+
+	if wait > float64(c.BackoffMax) {
+		return c.BackoffMax
+	}
+	return time.Duration(wait)
+}
+
+type supervisedDevice struct {
+	cancel    context.CancelFunc
+	connected bool
+	serial    []byte
+}
+
+// Supervisor periodically tests the communication with devices and reconnects them when needed
+type Supervisor struct {
+	sync.Mutex
+
+	bus    *Bus
+	config SupervisorConfig
+
+	devices map[*Device]*supervisedDevice
+	eventMu sync.Mutex
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	running bool
+	wg      sync.WaitGroup
+}
+
+// NewSupervisor creates a supervisor for devices on the bus. It implements multirun.Runnable.
+func (s *Bus) NewSupervisor(config *SupervisorConfig) *Supervisor {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Supervisor{
+		bus:     s,
+		config:  config.withDefaults(),
+		devices: make(map[*Device]*supervisedDevice),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+// Add starts supervising a device of the bus. A device that is not connected is connected by the supervisor.
+func (s *Supervisor) Add(dev *Device) {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.devices[dev]; ok || dev.bus != s.bus {
+		return
+	}
+
+	sd := &supervisedDevice{}
+	s.devices[dev] = sd
+
+	if s.running {
+		s.start(dev, sd)
+	}
+}
+
+// Remove stops supervising a device
+func (s *Supervisor) Remove(dev *Device) {
+	s.Lock()
+	defer s.Unlock()
+
+	if sd, ok := s.devices[dev]; ok {
+		if sd.cancel != nil {
+			sd.cancel()
+		}
+		delete(s.devices, dev)
+	}
+}
+
+// Connected returns if the device is currently connected according to the supervisor
+func (s *Supervisor) Connected(dev *Device) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	sd, ok := s.devices[dev]
+	return ok && sd.connected
+}
+
+/* start must be called with the lock held */
+func (s *Supervisor) start(dev *Device, sd *supervisedDevice) {
+	ctx, cancel := context.WithCancel(s.ctx)
+	sd.cancel = cancel
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.supervise(ctx, dev, sd)
+	}()
+}
+
+// Run supervises the devices until Close is called or the bus is closed. A supervisor can't be restarted,
+// Run returns immediately once Close was called or a previous Run returned.
+func (s *Supervisor) Run() error {
+	if s.ctx.Err() != nil {
+		return nil
+	}
+
+	s.Lock()
+	s.running = true
+	for dev, sd := range s.devices {
+		s.start(dev, sd)
+	}
+	s.Unlock()
+
+	var err error
+	select {
+	case <-s.ctx.Done():
+	case <-s.bus.closed.Chan():
+		err = ErrorClosed
+	}
+
+	s.cancel()
+	s.wg.Wait()
+
+	s.Lock()
+	s.running = false
+	s.Unlock()
+
+	return err
+}
+
+// Close stops the supervisor
+func (s *Supervisor) Close() error {
+	s.cancel()
+	return nil
+}
+
+func (s *Supervisor) emit(event Event) {
+	if s.config.OnEvent == nil {
+		return
+	}
+
+	s.eventMu.Lock()
+	defer s.eventMu.Unlock()
+
+	s.config.OnEvent(event)
+}
+
+func (s *Supervisor) setState(sd *supervisedDevice, connected bool, serial []byte) {
+	s.Lock()
+	defer s.Unlock()
+
+	sd.connected = connected
+	if serial != nil {
+		sd.serial = serial
+	}
+}
+
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (s *Supervisor) supervise(ctx context.Context, dev *Device, sd *supervisedDevice) {
+	s.Lock()
+	oldSerial := sd.serial
+	s.Unlock()
+
+	/* A device that is already connected is only tested */
+	connected := false
+	if serial := dev.Serial(); serial != nil {
+		connected = true
+		s.setState(sd, true, serial)
+		s.emit(Event{Type: EventConnected, Device: dev, Serial: serial})
+		oldSerial = serial
+	}
+
+	attempt := 0
+	for ctx.Err() == nil {
+		if !connected {
+			serial, err := dev.ConnectContext(ctx)
+			if err == ErrorClosed || ctx.Err() != nil {
+				return
+			}
+
+			if err != nil {
+				if !sleepContext(ctx, s.config.backoff(attempt)) {
+					return
+				}
+				attempt++
+				continue
+			}
+
+			attempt = 0
+			connected = true
+			s.setState(sd, true, serial)
+
+			if oldSerial != nil && !bytes.Equal(oldSerial, serial) {
+				s.emit(Event{Type: EventSerialChanged, Device: dev, Serial: serial, OldSerial: oldSerial})
+			}
+			oldSerial = serial
+			s.emit(Event{Type: EventConnected, Device: dev, Serial: serial})
+		}
+
+		if !sleepContext(ctx, s.config.Interval) {
+			return
+		}
+
+		err := dev.TestCommContext(ctx)
+		if err == ErrorClosed || ctx.Err() != nil {
+			return
+		}
+
+		if err != nil {
+			/* Try to reconnect immediately, a rebooted device usually responds again */
+			connected = false
+			dev.Disconnect()
+			s.setState(sd, false, nil)
+			s.emit(Event{Type: EventDisconnected, Device: dev, Serial: oldSerial, Error: err})
+		}
+	}
+}
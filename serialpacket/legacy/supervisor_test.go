@@ -0,0 +1,73 @@
+package serialpacket
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/BertoldVdb/go-misc/bidirpipe"
+)
+
+func TestSupervisor(t *testing.T) {
+	host, device := bidirpipe.CreateBidirPipe()
+
+	sim := NewSimulator(device, &SimulatorConfig{Address: 1, Serial: []byte{1, 2}})
+	go sim.Run()
+
+	bus := startBus(t, host, nil, false)
+	dev := bus.GetDevice(1)
+	dev.Timeout = 50
+
+	events := make(chan (Event), 10)
+	supervisor := bus.NewSupervisor(&SupervisorConfig{
+		Interval:   20 * time.Millisecond,
+		BackoffMin: 10 * time.Millisecond,
+		BackoffMax: 50 * time.Millisecond,
+		OnEvent: func(event Event) {
+			events <- event
+		},
+	})
+	supervisor.Add(dev)
+	done := make(chan (error), 1)
+	go func() {
+		done <- supervisor.Run()
+	}()
+
+	expect := func(eventType EventType, serial []byte) {
+		select {
+		case event := <-events:
+			if event.Type != eventType || !bytes.Equal(event.Serial, serial) {
+				t.Error("Wrong event", event.Type, event.Serial, "expected", eventType, serial)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("Missing event", eventType)
+		}
+	}
+
+	expect(EventConnected, []byte{1, 2})
+
+	/* Replace the board */
+	sim.SetOnline(false)
+	expect(EventDisconnected, []byte{1, 2})
+	sim.SetSerial([]byte{3, 4})
+	sim.SetOnline(true)
+
+	expect(EventSerialChanged, []byte{3, 4})
+	expect(EventConnected, []byte{3, 4})
+
+	if !supervisor.Connected(dev) {
+		t.Error("Device is not connected")
+	}
+
+	supervisor.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return after Close")
+	}
+
+	/* The supervisor is one-shot */
+	if err := supervisor.Run(); err != nil {
+		t.Error("Second Run failed", err)
+	}
+}
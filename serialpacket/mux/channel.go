@@ -0,0 +1,381 @@
+package mux
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/BertoldVdb/go-misc/bufferfifo"
+	"github.com/BertoldVdb/go-misc/closeflag"
+	pdu "github.com/BertoldVdb/go-misc/pdubuf"
+	"github.com/BertoldVdb/go-misc/serialpacket/framer/framerinterface"
+)
+
+// ChannelConfig contains the parameters of a channel. Zero values are replaced by the defaults.
+type ChannelConfig struct {
+	// DisableFlowControl disables credit based flow control. With flow control the remote side can only
+	// send Window packets that were not yet processed by Run. Both sides must use the same setting.
+	DisableFlowControl bool
+
+	// Window is the amount of packets the remote side may send before it has to wait for credits. Default: 8
+	Window int
+
+	// QueueLen is the amount of packets that can be queued before SendPacket blocks. Without flow control
+	// it is also the length of the receive queue. Default: 16
+	QueueLen int
+
+	// MaxPacketLen is the maximum size of the packets a stream is split into. It must leave room for the
+	// channel ID and the CRC in the maximum packet length of the framer. Default: 250, which fits the
+	// default limit of the framers with a 32 bit CRC.
+	MaxPacketLen int
+
+	// CreditTimeout is the time a sender waits for credits before it asks the remote side to send them
+	// again, as credit messages can be lost. Default: 250ms
+	CreditTimeout time.Duration
+}
+
+// DefaultChannelConfig returns the default channel configuration
+func DefaultChannelConfig() *ChannelConfig {
+	return &ChannelConfig{
+		Window:        8,
+		QueueLen:      16,
+		MaxPacketLen:  250,
+		CreditTimeout: 250 * time.Millisecond,
+	}
+}
+
+// ChannelStats contains statistics about a single channel. The BytesSentEscaped and
+// BytesReceivedEscaped values include the channel ID.
+type ChannelStats struct {
+	framerinterface.BaseStats
+
+	RxDropped       uint64
+	TxBlocked       uint64
+	CreditsSent     uint64
+	CreditsReceived uint64
+
+	CreditRequestsSent     uint64
+	CreditRequestsReceived uint64
+}
+
+type rxPacket struct {
+	pdu      *pdu.PDU
+	metadata framerinterface.PacketMetadata
+}
+
+// Channel is a logical channel of a Mux. It implements the framerinterface.Framer interface.
+type Channel struct {
+	sync.Mutex
+
+	mux    *Mux
+	id     uint8
+	config ChannelConfig
+
+	txQueue *bufferfifo.FIFO
+	txSpace chan (struct{})
+
+	/* Flow control uses 16 bit counters that wrap around, so lost credit messages are corrected by the
+	 * next one. txAllowed is the value txSent may reach, it is the remote rxConsumed plus the window. */
+	txSent      uint16
+	txAllowed   uint16
+	txBlockedAt time.Time
+
+	rxReceived    uint16
+	rxConsumed    uint16
+	rxCreditsSent uint16
+	rxForceCredit bool
+
+	rxQueue chan (*rxPacket)
+
+	closeflag closeflag.CloseFlag
+	stats     ChannelStats
+}
+
+func newChannel(m *Mux, id uint8, config *ChannelConfig) *Channel {
+	c := &Channel{
+		mux: m,
+		id:  id,
+	}
+
+	def := DefaultChannelConfig()
+	if config == nil {
+		config = def
+	}
+	c.config = *config
+	if c.config.Window <= 0 {
+		c.config.Window = def.Window
+	}
+	if c.config.QueueLen <= 0 {
+		c.config.QueueLen = def.QueueLen
+	}
+	if c.config.MaxPacketLen <= 0 {
+		c.config.MaxPacketLen = def.MaxPacketLen
+	}
+	if c.config.CreditTimeout <= 0 {
+		c.config.CreditTimeout = def.CreditTimeout
+	}
+
+	c.txQueue = bufferfifo.New(c.config.QueueLen)
+	c.txSpace = make(chan (struct{}), c.config.QueueLen)
+
+	if !c.config.DisableFlowControl {
+		c.txAllowed = uint16(c.config.Window)
+		c.rxQueue = make(chan (*rxPacket), c.config.Window)
+	} else {
+		c.rxQueue = make(chan (*rxPacket), c.config.QueueLen)
+	}
+
+	return c
+}
+
+// ID returns the channel ID
+func (c *Channel) ID() uint8 {
+	return c.id
+}
+
+// SendPacket queues a packet for transmission. It blocks when the transmit queue is full.
+func (c *Channel) SendPacket(payload []byte) (int64, error) {
+	if c.closeflag.IsClosed() || c.mux.closeflag.IsClosed() {
+		return 0, ErrorClosed
+	}
+
+	select {
+	case c.txSpace <- struct{}{}:
+	default:
+		atomic.AddUint64(&c.stats.TxBlocked, 1)
+
+		select {
+		case c.txSpace <- struct{}{}:
+		case <-c.closeflag.Chan():
+			return 0, ErrorClosed
+		case <-c.mux.closeflag.Chan():
+			return 0, ErrorClosed
+		}
+	}
+
+	p := pdu.Alloc(1, 0, len(payload))
+	p.Append(payload...)
+	p.ExtendLeft(1)[0] = c.id
+
+	c.txQueue.Push(p)
+	c.mux.signalWorker()
+
+	return int64(len(payload)), nil
+}
+
+/* popTx returns the next packet to send, or nil if there is none or no credits are left */
+func (c *Channel) popTx(now time.Time) *pdu.PDU {
+	c.Lock()
+	defer c.Unlock()
+
+	flowControl := !c.config.DisableFlowControl
+	if flowControl && c.txAllowed == c.txSent {
+		if len(c.txSpace) > 0 && c.txBlockedAt.IsZero() {
+			c.txBlockedAt = now
+		}
+		return nil
+	}
+
+	p := c.txQueue.Pop()
+	if p == nil {
+		return nil
+	}
+
+	if flowControl {
+		c.txSent++
+		c.txBlockedAt = time.Time{}
+	}
+	<-c.txSpace
+
+	return p
+}
+
+func (c *Channel) sent(payloadLen int, n int64, err error) {
+	if n > 0 {
+		atomic.AddUint64(&c.stats.FramesSent, 1)
+		atomic.AddUint64(&c.stats.BytesSent, uint64(payloadLen))
+		atomic.AddUint64(&c.stats.BytesSentEscaped, uint64(payloadLen+1))
+	}
+}
+
+/* newer returns true if counter a is ahead of b */
+func newer(a uint16, b uint16) bool {
+	return a != b && a-b < 0x8000
+}
+
+/* addCredits processes the amount of packets the remote side has consumed */
+func (c *Channel) addCredits(consumed uint16) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.config.DisableFlowControl {
+		return
+	}
+
+	allowed := consumed + uint16(c.config.Window)
+	if newer(allowed, c.txAllowed) {
+		atomic.AddUint64(&c.stats.CreditsReceived, uint64(allowed-c.txAllowed))
+		c.txAllowed = allowed
+	}
+}
+
+/* takeCredits returns the consumed counter if it should be sent to the remote side */
+func (c *Channel) takeCredits() (uint16, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	if !c.rxForceCredit && !c.creditsReady() {
+		return 0, false
+	}
+
+	atomic.AddUint64(&c.stats.CreditsSent, uint64(c.rxConsumed-c.rxCreditsSent))
+	c.rxCreditsSent = c.rxConsumed
+	c.rxForceCredit = false
+
+	return c.rxConsumed, true
+}
+
+/* creditsReady returns true if credits should be sent. The channel lock must be held */
+func (c *Channel) creditsReady() bool {
+	pending := int(c.rxConsumed - c.rxCreditsSent)
+	if pending <= 0 {
+		return false
+	}
+
+	return pending >= (c.config.Window+1)/2 || len(c.rxQueue) == 0
+}
+
+/* takeCreditRequest returns the sent counter if the channel waited too long for credits. Wait is the
+ * time until the next request is due, or -1 if the channel is not blocked. */
+func (c *Channel) takeCreditRequest(now time.Time) (sent uint16, request bool, wait time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.txBlockedAt.IsZero() {
+		return 0, false, -1
+	}
+
+	elapsed := now.Sub(c.txBlockedAt)
+	if elapsed < c.config.CreditTimeout {
+		return 0, false, c.config.CreditTimeout - elapsed
+	}
+
+	atomic.AddUint64(&c.stats.CreditRequestsSent, 1)
+	c.txBlockedAt = now
+	return c.txSent, true, c.config.CreditTimeout
+}
+
+/* creditRequest handles a request of a blocked remote sender. Packets it sent that were not received
+ * are lost, they are counted as consumed so the window does not shrink. */
+func (c *Channel) creditRequest(sent uint16) {
+	atomic.AddUint64(&c.stats.CreditRequestsReceived, 1)
+
+	c.Lock()
+	defer c.Unlock()
+
+	if c.config.DisableFlowControl {
+		return
+	}
+
+	if lost := sent - c.rxReceived; newer(sent, c.rxReceived) && int(lost) <= c.config.Window {
+		c.rxReceived += lost
+		c.rxConsumed += lost
+	}
+	c.rxForceCredit = true
+}
+
+func (c *Channel) consumed() {
+	if c.config.DisableFlowControl {
+		return
+	}
+
+	c.Lock()
+	c.rxConsumed++
+	ready := c.creditsReady()
+	c.Unlock()
+
+	if ready {
+		c.mux.signalWorker()
+	}
+}
+
+func (c *Channel) receive(payload []byte, metadata *framerinterface.PacketMetadata) {
+	atomic.AddUint64(&c.stats.BytesReceivedEscaped, uint64(len(payload)+1))
+
+	if !c.config.DisableFlowControl {
+		c.Lock()
+		c.rxReceived++
+		c.Unlock()
+	}
+
+	if len(payload) == 0 {
+		atomic.AddUint64(&c.stats.FramesReceivedZeroLength, 1)
+		c.consumed()
+		return
+	}
+
+	p := pdu.Alloc(0, len(payload), len(payload))
+	copy(p.Buf(), payload)
+
+	select {
+	case c.rxQueue <- &rxPacket{pdu: p, metadata: *metadata}:
+		atomic.AddUint64(&c.stats.FramesReceivedValid, 1)
+		atomic.AddUint64(&c.stats.BytesReceived, uint64(len(payload)))
+	default:
+		atomic.AddUint64(&c.stats.RxDropped, 1)
+		c.consumed()
+	}
+}
+
+// Run delivers the packets received on this channel to the handler. It returns when the channel or
+// the mux is closed, or when the handler returns an error.
+func (c *Channel) Run(receivedPacket framerinterface.FramerReceivedPacketHandler) error {
+	for {
+		select {
+		case p := <-c.rxQueue:
+			err := receivedPacket(p.pdu.Buf(), &p.metadata)
+			c.consumed()
+			if err != nil {
+				return err
+			}
+
+		case <-c.closeflag.Chan():
+			return ErrorClosed
+
+		case <-c.mux.closeflag.Chan():
+			return ErrorClosed
+		}
+	}
+}
+
+// Close closes the channel. Packets that are still queued are discarded.
+func (c *Channel) Close() error {
+	c.mux.removeChannel(c)
+	return c.closeflag.Close()
+}
+
+// SetPort is not supported on a channel
+func (c *Channel) SetPort(port io.ReadWriter) error {
+	return ErrorNotSupported
+}
+
+// GetStats returns a safely accessed snapshot of the channel statistics
+func (c *Channel) GetStats() framerinterface.BaseStats {
+	return c.stats.CopyBaseStatsAtomic()
+}
+
+// GetChannelStats returns a safely accessed snapshot of the channel statistics, including the
+// flow control counters
+func (c *Channel) GetChannelStats() ChannelStats {
+	return ChannelStats{
+		BaseStats:       c.stats.CopyBaseStatsAtomic(),
+		RxDropped:       atomic.LoadUint64(&c.stats.RxDropped),
+		TxBlocked:       atomic.LoadUint64(&c.stats.TxBlocked),
+		CreditsSent:     atomic.LoadUint64(&c.stats.CreditsSent),
+		CreditsReceived: atomic.LoadUint64(&c.stats.CreditsReceived),
+
+		CreditRequestsSent:     atomic.LoadUint64(&c.stats.CreditRequestsSent),
+		CreditRequestsReceived: atomic.LoadUint64(&c.stats.CreditRequestsReceived),
+	}
+}
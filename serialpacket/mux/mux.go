@@ -0,0 +1,320 @@
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/BertoldVdb/go-misc/closeflag"
+	"github.com/BertoldVdb/go-misc/serialpacket/framer/framerinterface"
+)
+
+var (
+	// ErrorClosed is returned when the channel or the mux was closed
+	ErrorClosed = errors.New("Channel has been closed")
+
+	// ErrorChannelInUse is returned by OpenChannel when the channel was already opened
+	ErrorChannelInUse = errors.New("Channel is already open")
+
+	// ErrorChannelReserved is returned by OpenChannel when the channel ID is used internally
+	ErrorChannelReserved = errors.New("Channel ID is reserved")
+
+	// ErrorNotSupported is returned by SetPort on a channel
+	ErrorNotSupported = errors.New("Operation is not supported on a channel")
+)
+
+const (
+	/* Channel used for control messages */
+	controlChannel = 0xFF
+
+	/* Carries the cumulative amount of consumed packets of a channel */
+	controlCredit = 0x01
+
+	/* Sent by a blocked sender, carries the cumulative amount of sent packets */
+	controlCreditRequest = 0x02
+)
+
+// Stats contains statistics about packets that could not be delivered to a channel
+type Stats struct {
+	framerinterface.BaseStats
+
+	UnknownChannel  uint64
+	InvalidReceived uint64
+}
+
+// Mux multiplexes several logical channels over a single framer by prefixing every packet with a
+// channel ID. Transmission is scheduled round robin between channels, so one channel cannot starve
+// the others.
+type Mux struct {
+	sync.Mutex
+
+	framer framerinterface.Framer
+
+	channels map[uint8]*Channel
+	order    []*Channel
+	lastSent int
+
+	kick      chan (struct{})
+	closeflag closeflag.CloseFlag
+
+	stats Stats
+}
+
+// NewMux creates a multiplexer on top of the given framer
+func NewMux(framer framerinterface.Framer) *Mux {
+	return &Mux{
+		framer:   framer,
+		channels: make(map[uint8]*Channel),
+		kick:     make(chan (struct{}), 1),
+		lastSent: -1,
+	}
+}
+
+func (m *Mux) signalWorker() {
+	select {
+	case m.kick <- struct{}{}:
+	default:
+	}
+}
+
+// OpenChannel opens a logical channel. Config may be nil to use the defaults. Both sides should open
+// the channel with the same window.
+func (m *Mux) OpenChannel(id uint8, config *ChannelConfig) (*Channel, error) {
+	if id == controlChannel {
+		return nil, ErrorChannelReserved
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	if m.closeflag.IsClosed() {
+		return nil, ErrorClosed
+	}
+
+	if _, ok := m.channels[id]; ok {
+		return nil, ErrorChannelInUse
+	}
+
+	c := newChannel(m, id, config)
+	m.channels[id] = c
+	m.order = append(m.order, c)
+	sort.Slice(m.order, func(i, j int) bool {
+		return m.order[i].id < m.order[j].id
+	})
+
+	return c, nil
+}
+
+// OpenStream opens a logical channel that is used as a byte stream
+func (m *Mux) OpenStream(id uint8, config *ChannelConfig) (*ChannelStream, error) {
+	c, err := m.OpenChannel(id, config)
+	if err != nil {
+		return nil, err
+	}
+
+	return newChannelStream(c), nil
+}
+
+func (m *Mux) removeChannel(c *Channel) {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.channels[c.id] != c {
+		return
+	}
+
+	delete(m.channels, c.id)
+	for i, k := range m.order {
+		if k == c {
+			m.order = append(m.order[:i], m.order[i+1:]...)
+			break
+		}
+	}
+}
+
+func (m *Mux) getChannel(id uint8) *Channel {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.channels[id]
+}
+
+func (m *Mux) handleControl(payload []byte) {
+	if len(payload) < 4 || (payload[0] != controlCredit && payload[0] != controlCreditRequest) {
+		atomic.AddUint64(&m.stats.InvalidReceived, 1)
+		return
+	}
+
+	c := m.getChannel(payload[1])
+	if c == nil {
+		atomic.AddUint64(&m.stats.UnknownChannel, 1)
+		return
+	}
+
+	value := binary.BigEndian.Uint16(payload[2:])
+	if payload[0] == controlCredit {
+		c.addCredits(value)
+	} else {
+		c.creditRequest(value)
+	}
+	m.signalWorker()
+}
+
+func (m *Mux) dispatch(payload []byte, metadata *framerinterface.PacketMetadata) error {
+	if len(payload) < 1 {
+		atomic.AddUint64(&m.stats.InvalidReceived, 1)
+		return nil
+	}
+
+	if payload[0] == controlChannel {
+		m.handleControl(payload[1:])
+		return nil
+	}
+
+	c := m.getChannel(payload[0])
+	if c == nil {
+		atomic.AddUint64(&m.stats.UnknownChannel, 1)
+		return nil
+	}
+
+	c.receive(payload[1:], metadata)
+	return nil
+}
+
+func (m *Mux) sendControl(messages []byte) {
+	for i := 0; i < len(messages); i += 5 {
+		m.framer.SendPacket(messages[i : i+5])
+	}
+}
+
+func (m *Mux) sendCredits() {
+	m.Lock()
+	var credits []byte
+	for _, c := range m.order {
+		if n, ok := c.takeCredits(); ok {
+			credits = append(credits, controlChannel, controlCredit, c.id, byte(n>>8), byte(n))
+		}
+	}
+	m.Unlock()
+
+	m.sendControl(credits)
+}
+
+/* sendCreditRequests asks for credits for channels that are blocked too long. It returns the time until
+ * the next request is due, or -1 if no channel is blocked. */
+func (m *Mux) sendCreditRequests(now time.Time) time.Duration {
+	m.Lock()
+	var requests []byte
+	wait := time.Duration(-1)
+	for _, c := range m.order {
+		sent, ok, d := c.takeCreditRequest(now)
+		if ok {
+			requests = append(requests, controlChannel, controlCreditRequest, c.id, byte(sent>>8), byte(sent))
+		}
+		if d >= 0 && (wait < 0 || d < wait) {
+			wait = d
+		}
+	}
+	m.Unlock()
+
+	m.sendControl(requests)
+	return wait
+}
+
+/* sendNext sends a single packet of the next channel that has data, returns false if nothing was sent */
+func (m *Mux) sendNext() bool {
+	now := time.Now()
+	m.Lock()
+
+	start := 0
+	for i, c := range m.order {
+		if int(c.id) > m.lastSent {
+			start = i
+			break
+		}
+	}
+
+	for i := range m.order {
+		c := m.order[(start+i)%len(m.order)]
+
+		p := c.popTx(now)
+		if p == nil {
+			continue
+		}
+
+		m.lastSent = int(c.id)
+		m.Unlock()
+
+		n, err := m.framer.SendPacket(p.Buf())
+		c.sent(p.Len()-1, n, err)
+		return true
+	}
+
+	m.Unlock()
+	return false
+}
+
+func (m *Mux) worker(done <-chan (struct{})) {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		for {
+			/* Credits are sent between every data packet to keep the remote side going */
+			m.sendCredits()
+			if !m.sendNext() {
+				break
+			}
+		}
+
+		var timerChan <-chan (time.Time)
+		if wait := m.sendCreditRequests(time.Now()); wait >= 0 {
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(wait)
+			timerChan = timer.C
+		}
+
+		select {
+		case <-done:
+			return
+		case <-m.closeflag.Chan():
+			return
+		case <-m.kick:
+		case <-timerChan:
+		}
+	}
+}
+
+// Run starts the receiver and the transmit scheduler. It returns when the underlying framer returns.
+func (m *Mux) Run() error {
+	done := make(chan (struct{}))
+	go m.worker(done)
+	defer close(done)
+
+	err := m.framer.Run(m.dispatch)
+	m.closeflag.Close()
+
+	return err
+}
+
+// Close stops the mux and all its channels. The underlying framer keeps running until its port is closed.
+func (m *Mux) Close() error {
+	return m.closeflag.Close()
+}
+
+// GetStats returns a safely accessed snapshot of the mux statistics
+func (m *Mux) GetStats() Stats {
+	return Stats{
+		BaseStats:       m.framer.GetStats(),
+		UnknownChannel:  atomic.LoadUint64(&m.stats.UnknownChannel),
+		InvalidReceived: atomic.LoadUint64(&m.stats.InvalidReceived),
+	}
+}
@@ -0,0 +1,283 @@
+package mux
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BertoldVdb/go-misc/bidirpipe"
+	"github.com/BertoldVdb/go-misc/multicrc"
+	"github.com/BertoldVdb/go-misc/serialpacket/framer/framerinterface"
+	"github.com/BertoldVdb/go-misc/serialpacket/framer/hdlc"
+	"github.com/BertoldVdb/go-misc/serialpacket/framer/testutil"
+)
+
+func createMux(t *testing.T, port io.ReadWriter) (*Mux, chan (error)) {
+	return createMuxWithOptions(t, port, framerinterface.DefaultFramerOptions().Set(framerinterface.OptionMaxPacketLen, 1024))
+}
+
+func createMuxWithOptions(t *testing.T, port io.ReadWriter, options *framerinterface.FramerOptions) (*Mux, chan (error)) {
+	framer, err := hdlc.NewHDLCFramer(port, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewMux(framer)
+	done := make(chan (error), 1)
+	go func() {
+		done <- m.Run()
+	}()
+
+	return m, done
+}
+
+func receiveChan(c *Channel) chan ([]byte) {
+	rxChan := make(chan ([]byte), 100)
+	go c.Run(func(payload []byte, metadata *framerinterface.PacketMetadata) error {
+		rxChan <- append([]byte(nil), payload...)
+		return nil
+	})
+	return rxChan
+}
+
+func TestNoStarvation(t *testing.T) {
+	p1, p2 := bidirpipe.CreateBidirPipe()
+	m1, done1 := createMux(t, p1)
+	m2, done2 := createMux(t, p2)
+
+	console1, _ := m1.OpenChannel(1, nil)
+	bulk1, _ := m1.OpenChannel(2, nil)
+	console2, _ := m2.OpenChannel(1, nil)
+	bulk2, _ := m2.OpenChannel(2, nil)
+
+	if _, err := m1.OpenChannel(1, nil); err != ErrorChannelInUse {
+		t.Error("Channel could be opened twice")
+	}
+	if _, err := m1.OpenChannel(controlChannel, nil); err != ErrorChannelReserved {
+		t.Error("Control channel could be opened")
+	}
+
+	/* Nobody reads the bulk channel, so its sender will block once the window and queue are full */
+	bulkDone := make(chan (struct{}))
+	go func() {
+		defer close(bulkDone)
+		for {
+			if _, err := bulk1.SendPacket(testutil.RandomBytes(200)); err != nil {
+				return
+			}
+		}
+	}()
+
+	rxConsole := receiveChan(console2)
+	for i := 0; i < 20; i++ {
+		packet := testutil.RandomBytes(16)
+		console1.SendPacket(packet)
+
+		select {
+		case rx := <-rxConsole:
+			if !bytes.Equal(rx, packet) {
+				t.Error("Received wrong console packet")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Console was starved")
+		}
+	}
+
+	bulkStats := bulk1.GetChannelStats()
+	if bulkStats.FramesSent != 8 || bulkStats.TxBlocked == 0 {
+		t.Error("Bulk channel was not flow controlled", bulkStats.FramesSent, bulkStats.TxBlocked)
+	}
+
+	/* Start reading, the bulk channel should continue */
+	rxBulk := receiveChan(bulk2)
+	for i := 0; i < 50; i++ {
+		select {
+		case <-rxBulk:
+		case <-time.After(time.Second):
+			t.Fatal("Bulk channel did not resume")
+		}
+	}
+
+	bulk1.Close()
+	<-bulkDone
+
+	m1.Close()
+	m2.Close()
+	p1.Close()
+	p2.Close()
+	<-done1
+	<-done2
+}
+
+func TestStream(t *testing.T) {
+	/* Full chunks must also fit in a framer with the default maximum length and a CRC */
+	for _, options := range []*framerinterface.FramerOptions{
+		framerinterface.DefaultFramerOptions().Set(framerinterface.OptionMaxPacketLen, 1024),
+		framerinterface.DefaultFramerOptions(),
+		framerinterface.DefaultFramerOptions().Set(framerinterface.OptionCRCParam, multicrc.Crc32MPEG2),
+	} {
+		testStream(t, options)
+	}
+}
+
+func testStream(t *testing.T, options *framerinterface.FramerOptions) {
+	p1, p2 := bidirpipe.CreateBidirPipe()
+	m1, done1 := createMuxWithOptions(t, p1, options)
+	m2, done2 := createMuxWithOptions(t, p2, options)
+	defer func() {
+		m1.Close()
+		m2.Close()
+		p1.Close()
+		p2.Close()
+		<-done1
+		<-done2
+	}()
+
+	s1, _ := m1.OpenStream(5, nil)
+	s2, _ := m2.OpenStream(5, nil)
+
+	data := testutil.RandomBytes(10000)
+	go s1.Write(data)
+
+	result := make([]byte, len(data))
+	readDone := make(chan (error), 1)
+	go func() {
+		_, err := io.ReadFull(s2, result)
+		readDone <- err
+	}()
+
+	select {
+	case err := <-readDone:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stream data was lost", m2.GetStats())
+	}
+	if !bytes.Equal(result, data) {
+		t.Error("Stream data was corrupted")
+	}
+
+	s2.Close()
+	if _, err := s2.Read(result); err != io.EOF {
+		t.Error("Wrong error after close", err)
+	}
+}
+
+/* dropFramer drops sent packets that match the filter */
+type dropFramer struct {
+	framerinterface.Framer
+
+	sync.Mutex
+	drop    func(payload []byte) bool
+	dropped int
+}
+
+func (d *dropFramer) SendPacket(payload []byte) (int64, error) {
+	d.Lock()
+	drop := d.drop(payload)
+	if drop {
+		d.dropped++
+	}
+	d.Unlock()
+
+	if drop {
+		return int64(len(payload)), nil
+	}
+	return d.Framer.SendPacket(payload)
+}
+
+func (d *dropFramer) droppedCount() int {
+	d.Lock()
+	defer d.Unlock()
+
+	return d.dropped
+}
+
+func createLossyMux(t *testing.T, port io.ReadWriter, drop func(payload []byte) bool) (*Mux, *dropFramer, chan (error)) {
+	framer, err := hdlc.NewHDLCFramer(port, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &dropFramer{Framer: framer, drop: drop}
+	m := NewMux(d)
+	done := make(chan (error), 1)
+	go func() {
+		done <- m.Run()
+	}()
+
+	return m, d, done
+}
+
+func TestLostCredits(t *testing.T) {
+	p1, p2 := bidirpipe.CreateBidirPipe()
+
+	/* The sender loses a fifth of the data packets, the receiver loses half of the credit messages */
+	random := rand.New(rand.NewSource(1))
+	var randomMutex sync.Mutex
+	lose := func(rate float64) bool {
+		randomMutex.Lock()
+		defer randomMutex.Unlock()
+		return random.Float64() < rate
+	}
+
+	m1, d1, done1 := createLossyMux(t, p1, func(payload []byte) bool {
+		return payload[0] != controlChannel && lose(0.2)
+	})
+	m2, d2, done2 := createLossyMux(t, p2, func(payload []byte) bool {
+		return payload[0] == controlChannel && payload[1] == controlCredit && lose(0.5)
+	})
+
+	config := &ChannelConfig{Window: 4, CreditTimeout: 20 * time.Millisecond}
+	tx, _ := m1.OpenChannel(1, config)
+	rx, _ := m2.OpenChannel(1, config)
+	rxChan := receiveChan(rx)
+
+	const count = 200
+	go func() {
+		for i := 0; i < count; i++ {
+			tx.SendPacket([]byte{byte(i)})
+		}
+	}()
+
+	/* Every packet that was not lost is received in order, the window never shrinks */
+	received := 0
+	last := -1
+	deadline := time.After(5 * time.Second)
+	for received+d1.droppedCount() < count {
+		select {
+		case p := <-rxChan:
+			if int(p[0]) <= last {
+				t.Fatal("Packet received out of order")
+			}
+			last = int(p[0])
+			received++
+		case <-time.After(10 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("Channel deadlocked after", received, "packets")
+		}
+	}
+
+	if d1.droppedCount() == 0 || d2.droppedCount() == 0 {
+		t.Error("No packets were dropped")
+	}
+
+	/* The counter is updated after the last packet was passed to the framer */
+	for i := 0; tx.GetChannelStats().FramesSent != count; i++ {
+		if i == 100 {
+			t.Fatal("Not all packets were sent", tx.GetChannelStats().FramesSent)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	m1.Close()
+	m2.Close()
+	p1.Close()
+	p2.Close()
+	<-done1
+	<-done2
+}
@@ -0,0 +1,78 @@
+package mux
+
+import (
+	"io"
+
+	"github.com/BertoldVdb/go-misc/bufferedpipe"
+	"github.com/BertoldVdb/go-misc/serialpacket/framer/framerinterface"
+)
+
+// ChannelStream exposes a channel as an io.ReadWriteCloser. Written data is split in packets of at most
+// MaxPacketLen bytes. If flow control is enabled, the remote side stops sending when data is not read.
+type ChannelStream struct {
+	channel *Channel
+	pipe    *bufferedpipe.BufferedPipe
+}
+
+func newChannelStream(c *Channel) *ChannelStream {
+	s := &ChannelStream{
+		channel: c,
+		pipe:    bufferedpipe.NewBufferedPipe(c.config.Window * c.config.MaxPacketLen),
+	}
+
+	go func() {
+		defer s.pipe.Close()
+
+		s.channel.Run(func(payload []byte, metadata *framerinterface.PacketMetadata) error {
+			_, err := s.pipe.Write(payload)
+			return err
+		})
+	}()
+
+	return s
+}
+
+// Channel returns the underlying channel, for example to obtain statistics
+func (s *ChannelStream) Channel() *Channel {
+	return s.channel
+}
+
+// Read implements the read function of io.Reader. It returns io.EOF after the channel was closed.
+func (s *ChannelStream) Read(p []byte) (int, error) {
+	n, err := s.pipe.Read(p)
+	if err == bufferedpipe.ErrorClosed {
+		err = io.EOF
+	}
+
+	return n, err
+}
+
+// Write implements the write function of io.Writer
+func (s *ChannelStream) Write(p []byte) (int, error) {
+	written := 0
+
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > s.channel.config.MaxPacketLen {
+			chunk = chunk[:s.channel.config.MaxPacketLen]
+		}
+
+		_, err := s.channel.SendPacket(chunk)
+		if err != nil {
+			return written, err
+		}
+
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+
+	return written, nil
+}
+
+// Close closes the stream and the underlying channel
+func (s *ChannelStream) Close() error {
+	err := s.channel.Close()
+	s.pipe.Close()
+
+	return err
+}